@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"time"
 
@@ -13,6 +14,9 @@ import (
 	"github.com/spf13/pflag"
 )
 
+// checkEpoch is the epoch used to compare replicas outside of the frontend.
+const checkEpoch = math.MaxUint64
+
 func initReadArg(buckets uint64, replicas int) *common.ReadArgs {
 	args := common.ReadArgs{}
 	args.TD = make([]common.PirArgs, replicas)
@@ -23,6 +27,36 @@ func initReadArg(buckets uint64, replicas int) *common.ReadArgs {
 	return &args
 }
 
+// StateTransferred writes to a replica which is not behind a frontend,
+// rebuilds a replacement for it by state transfer, and checks the two agree.
+// Both are flipped to the same epoch, so they are read at the same writes.
+func StateTransferred(config libtalek.ClientConfig, sc server.Config, spotChecks int) bool {
+	healthy := server.NewReplica("r0", "cpu.0", sc)
+	defer healthy.Close()
+	for i := 0; i < spotChecks; i++ {
+		cell := uint64(i) * (config.Config.NumBuckets / uint64(spotChecks))
+		data := make([]byte, config.Config.DataSize)
+		data[0] = byte(i)
+		write := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{Bucket1: cell, Bucket2: cell, Data: data, GlobalSeqNo: uint64(i) + 1}}
+		reply := &common.ReplicaWriteReply{}
+		if err := healthy.Write(write, reply); err != nil || reply.Err != "" {
+			log.Printf("Failed to write to replica: %v %v\n", err, reply.Err)
+			return false
+		}
+	}
+
+	rebuilt := server.NewReplica("r3", "cpu.0", sc)
+	defer rebuilt.Close()
+	if err := rebuilt.CatchUp(healthy); err != nil {
+		log.Printf("Failed to catch up replica: %v\n", err)
+		return false
+	}
+	flip := &common.ReplicaWriteArgs{EpochFlag: true, EpochID: checkEpoch, Phase: common.EpochImmediate}
+	healthy.Write(flip, &common.ReplicaWriteReply{})
+	rebuilt.Write(flip, &common.ReplicaWriteReply{})
+	return ReplicaCaughtUp(config, healthy, rebuilt, sc.TrustDomainIndex, checkEpoch, spotChecks)
+}
+
 // Consistency acts as a client driver against a talek system to verify that
 // consistency guarantees are enforced. It will write into a cell, and then
 // perform a set of reads to ensure that all servers expose the same snapshot
@@ -44,18 +78,21 @@ func main() {
 			WriteInterval:      time.Second * 5,
 			ReadInterval:       time.Second * 5,
 			MaxLoadFactor:      float64(0.95),
-			LoadFactorStep:     float64(0.05),
 		}
 		//Trust domains
 		td1 := common.NewTrustDomainConfig("td1", "localhost:9001", true, false)
 		td2 := common.NewTrustDomainConfig("td2", "localhost:9002", true, false)
 		sc1 := server.Config{Config: conf, WriteInterval: time.Second, ReadBatch: 4, TrustDomain: td1}
 		sc2 := server.Config{Config: conf, ReadBatch: 4, TrustDomain: td2, TrustDomainIndex: 1}
+		//client
+		config = &libtalek.ClientConfig{Config: conf, WriteInterval: time.Second, ReadInterval: time.Second, TrustDomains: []*common.TrustDomainConfig{td1, td2}, FrontendAddr: "http://localhost:9000"}
+		// State transfer is checked before the frontend starts advancing epochs.
+		if !StateTransferred(*config, sc1, *spotChecks) {
+			return
+		}
 		//replicas
 		r1 := server.NewReplica("r1", "cpu.0", sc1)
 		r2 := server.NewReplica("r2", "cpu.0", sc2)
-		//client
-		config = &libtalek.ClientConfig{Config: conf, WriteInterval: time.Second, ReadInterval: time.Second, TrustDomains: []*common.TrustDomainConfig{td1, td2}, FrontendAddr: "localhost:9000"}
 		//frontend
 		f0 := server.NewFrontend("f0", &sc1, []common.ReplicaInterface{common.ReplicaInterface(r1), common.ReplicaInterface(r2)})
 		f0.Verbose = true
@@ -87,6 +124,10 @@ func main() {
 		return
 	}
 
+	if !RootsVerified(*config, *leaderRPC, *spotChecks) {
+		return
+	}
+
 	c0 := libtalek.NewClient("testClient", *config, leaderRPC)
 	log.Println("Created client")
 	//time.Sleep(time.Duration(rand.Int()%int(clientConfig.WriteInterval)) * time.Nanosecond)
@@ -87,3 +87,59 @@ func WritesPersisted(config libtalek.ClientConfig, leaderRPC common.FrontendRPC,
 	fmt.Fprintf(os.Stderr, "\n")
 	return true
 }
+
+// ReplicaCaughtUp compares reads of single cells made directly against a
+// healthy replica and one rebuilt from it by state transfer, which must
+// share its trust domain. Both are read at the given epoch.
+func ReplicaCaughtUp(config libtalek.ClientConfig, healthy, rebuilt common.ReplicaInterface, trustDomain int, epoch uint64, spotChecks int) bool {
+	for cell := uint64(0); cell < config.Config.NumBuckets; cell += config.Config.NumBuckets / uint64(spotChecks) {
+		args := initReadArg(config.Config.NumBuckets, len(config.TrustDomains))
+		args.TD[trustDomain].RequestVector[cell/8] ^= (1 << (cell % 8))
+		encArgs, _ := args.Encode(config.TrustDomains)
+		request := &common.BatchReadRequest{Args: []common.EncodedReadArgs{encArgs}, Epoch: epoch}
+
+		expected := common.BatchReadReply{}
+		actual := common.BatchReadReply{}
+		if err := healthy.BatchRead(request, &expected); err != nil || expected.Err != "" {
+			fmt.Fprintf(os.Stderr, "read of cell %d from healthy replica failed: %v %v\n", cell, err, expected.Err)
+			return false
+		}
+		if err := rebuilt.BatchRead(request, &actual); err != nil || actual.Err != "" {
+			fmt.Fprintf(os.Stderr, "read of cell %d from rebuilt replica failed: %v %v\n", cell, err, actual.Err)
+			return false
+		}
+		if !bytes.Equal(expected.Replies[0].Data, actual.Replies[0].Data) {
+			fmt.Fprintf(os.Stderr, "Disagreement of value of cell %d between healthy and rebuilt replica.\n", cell)
+			return false
+		}
+		td := config.TrustDomains[trustDomain]
+		if !actual.Root.Verify(td, actual.Replies[0].Epoch, actual.Replies[0].GlobalSeqNo) || actual.Root.Root != expected.Root.Root {
+			fmt.Fprintf(os.Stderr, "Rebuilt replica did not sign the database root of the healthy replica.\n")
+			return false
+		}
+		fmt.Fprintf(os.Stderr, ".")
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return true
+}
+
+// RootsVerified makes reads through the frontend, expecting every trust domain
+// to have signed the same database root for each.
+func RootsVerified(config libtalek.ClientConfig, leaderRPC common.FrontendRPC, spotChecks int) bool {
+	for i := 0; i < spotChecks; i++ {
+		args := initReadArg(config.Config.NumBuckets, len(config.TrustDomains))
+		encArgs, _ := args.Encode(config.TrustDomains)
+		reply := common.ReadReply{}
+		if err := leaderRPC.Read(&encArgs, &reply); err != nil || reply.Err != "" {
+			fmt.Fprintf(os.Stderr, "read failed: %v %v\n", err, reply.Err)
+			return false
+		}
+		if err := reply.VerifyRoots(config.TrustDomains); err != nil {
+			fmt.Fprintf(os.Stderr, "read of epoch %d could not be verified: %v\n", reply.Epoch, err)
+			return false
+		}
+		fmt.Fprintf(os.Stderr, ".")
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+	return true
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/coreos/etcd/pkg/flags"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/protocol/notify"
+	raftprotocol "github.com/privacylab/talek/protocol/raft"
+	"github.com/privacylab/talek/server/coordinator"
+	"github.com/spf13/pflag"
+)
+
+// Starts the coordinator of a distributed trust domain operating with
+// configuration from talekutil
+func main() {
+	log.Println("-------------------------")
+	log.Println("--- Talek Coordinator ---")
+	log.Println("-------------------------")
+
+	// Support setting flags from either command-line arguments or environment variables
+	// command-line arguments take priority
+	configPath := pflag.StringP("config", "c", "coordinator.conf", "Talek Coordinator Configuration (env TALEK_CONFIG)")
+	commonPath := pflag.StringP("common", "f", "common.conf", "Talek Common Configuration (env TALEK_COMMON)")
+	listen := pflag.StringP("listen", "l", ":8080", "Listening Address")
+	persist := pflag.StringP("persist", "p", "", "Directory for persisted coordinator state (env TALEK_PERSIST)")
+	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
+	if err != nil {
+		log.Printf("Error reading environment variables, %v\n", err)
+		return
+	}
+	pflag.Parse()
+
+	log.Printf("Arguments:\n")
+	log.Printf("config=%v\n", *configPath)
+	log.Printf("common=%v\n", *commonPath)
+	log.Printf("persist=%v\n", *persist)
+
+	commonConfig := common.ConfigFromFile(*commonPath)
+	if commonConfig == nil {
+		log.Printf("Could not read %s!\n", *commonPath)
+		return
+	}
+	config := coordinator.ConfigFromFile(*configPath, commonConfig)
+	if config == nil {
+		log.Printf("Could not read %s!\n", *configPath)
+		return
+	}
+	if *persist != "" {
+		config.PersistPath = *persist
+	}
+	if config.SnapshotInterval <= 0 {
+		config.SnapshotInterval = time.Second
+	}
+
+	log.Printf("Using the following configuration:")
+	log.Printf("snapshotThreshold=%v\n", config.SnapshotThreshold)
+	log.Printf("snapshotInterval=%v\n", config.SnapshotInterval)
+	log.Printf("notifyAddresses=%v\n", config.NotifyAddresses)
+	log.Printf("persistPath=%v\n", config.PersistPath)
+	log.Printf("id=%v peers=%v\n", config.ID, config.Peers)
+	log.Printf("config.Config=%#+v\n", config.Config)
+
+	name := "coordinator"
+	if config.Identity != nil {
+		name = config.Identity.Name
+	}
+	servers := make([]notify.Interface, 0, len(config.NotifyAddresses))
+	for _, address := range config.NotifyAddresses {
+		servers = append(servers, notify.NewClient(name, address))
+	}
+
+	var s *coordinator.Server
+	if len(config.Peers) > 0 {
+		if _, ok := config.Peers[config.ID]; !ok {
+			log.Printf("ID %v is not among the peers of the coordinator.\n", config.ID)
+			return
+		}
+		peers := make(map[string]raftprotocol.Interface)
+		for id, address := range config.Peers {
+			if id != config.ID {
+				peers[id] = raftprotocol.NewClient(name, address)
+			}
+		}
+		s, err = coordinator.NewReplicatedServer(name, *listen, *config.Config, servers, config.SnapshotThreshold, config.SnapshotInterval, config.ID, peers, config.PersistPath)
+	} else {
+		s, err = coordinator.NewPersistentServer(name, *listen, *config.Config, servers, config.SnapshotThreshold, config.SnapshotInterval, config.PersistPath)
+	}
+	if err != nil {
+		log.Printf("Couldn't start the coordinator: %v\n", err)
+		return
+	}
+	if config.Identity != nil {
+		s.SetIdentity(config.Identity)
+	}
+
+	bindAddr, err := net.ResolveTCPAddr("tcp4", *listen)
+	if err != nil {
+		log.Printf("Couldn't resolve coordinator address: %v\n", err)
+		s.Close()
+		return
+	}
+	listener, err := net.ListenTCP("tcp4", bindAddr)
+	if err != nil {
+		log.Printf("Couldn't listen to coordinator address: %v\n", err)
+		s.Close()
+		return
+	}
+	go http.Serve(listener, s)
+
+	log.Println("Running.")
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	// Stop taking requests before the final state is persisted.
+	listener.Close()
+	s.Close()
+}
@@ -24,8 +24,10 @@ func main() {
 	// command-line arguments take priority
 	configPath := pflag.StringP("config", "c", "replica.conf", "Talek Replica Configuration (env TALEK_CONFIG)")
 	commonPath := pflag.StringP("common", "f", "common.conf", "Talek Common Configuration (env TALEK_COMMON)")
-	backing := pflag.StringP("backing", "b", "cpu.0", "PIR daemon method (env TALEK_BACKING)")
+	backing := pflag.StringP("backing", "b", "cpu.0", "PIR daemon method, or a comma separated list to partition the database (env TALEK_BACKING)")
 	listen := pflag.StringP("listen", "l", ":8080", "Listening Address")
+	persist := pflag.StringP("persist", "p", "", "Directory for persisted database state (env TALEK_PERSIST)")
+	peer := pflag.String("peer", "", "Address of a healthy replica to catch up from (env TALEK_PEER)")
 	err := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if err != nil {
 		log.Printf("Error reading environment variables, %v\n", err)
@@ -36,6 +38,8 @@ func main() {
 	log.Printf("Arguments:\n")
 	log.Printf("config=%v\n", *configPath)
 	log.Printf("backing=%v\n", *backing)
+	log.Printf("persist=%v\n", *persist)
+	log.Printf("peer=%v\n", *peer)
 
 	configString, err := ioutil.ReadFile(*configPath)
 	if err != nil {
@@ -57,6 +61,7 @@ func main() {
 		ReadBatch:        8,
 		TrustDomain:      &common.TrustDomainConfig{},
 		TrustDomainIndex: 0,
+		SnapshotInterval: 1000,
 	}
 	if err = json.Unmarshal(configString, &serverConfig); err != nil {
 		log.Printf("Could not parse %s: %v\n", *configPath, err)
@@ -66,6 +71,9 @@ func main() {
 		log.Printf("Could not parse %s: %v\n", *commonPath, err)
 		return
 	}
+	if *persist != "" {
+		serverConfig.PersistPath = *persist
+	}
 
 	log.Printf("Using the following configuration:")
 	log.Printf("serverConfig=%#+v\n", serverConfig)
@@ -78,11 +86,44 @@ func main() {
 		return
 	}
 
+	if *peer != "" {
+		peerRPC := common.NewReplicaRPC("peer", common.NewTrustDomainConfig("peer", *peer, true, false))
+		if err = r.Replica.CatchUp(peerRPC); err != nil {
+			log.Printf("Couldn't catch up from %s: %v\n", *peer, err)
+			r.Replica.Close()
+			listener.Close()
+			return
+		}
+	}
+
+	// A shard of a distributed trust domain is notified of new layouts
+	// at its own address in the trust domain.
+	notifyAddress := ""
+	if addresses, ok := serverConfig.TrustDomain.GetAddresses(); ok && serverConfig.CoordinatorAddress != "" {
+		if serverConfig.ShardID >= uint64(len(addresses)) {
+			log.Printf("No address for shard %d in the trust domain\n", serverConfig.ShardID)
+			r.Replica.Close()
+			listener.Close()
+			return
+		}
+		notifyAddress = addresses[serverConfig.ShardID]
+		if err = r.Register(notifyAddress); err != nil {
+			// Layouts are still polled for at each epoch.
+			log.Printf("Couldn't register with the coordinator: %v\n", err)
+			notifyAddress = ""
+		}
+	}
+
 	log.Println("Running.")
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
+	if notifyAddress != "" {
+		if err = r.Unregister(notifyAddress); err != nil {
+			log.Printf("Couldn't unregister from the coordinator: %v\n", err)
+		}
+	}
 	r.Replica.Close()
 	listener.Close()
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/libtalek"
 	"github.com/privacylab/talek/server"
+	"github.com/privacylab/talek/server/coordinator"
 	"github.com/spf13/pflag"
 )
 
@@ -26,6 +27,7 @@ func main() {
 	outputReplica := pflag.Bool("replica", false, "Create configuration for a talek server.")
 	outputTD := pflag.Bool("trustdomain", false, "Create raw trustdomain configuration.")
 	outputCommon := pflag.Bool("common", false, "Create common config template.")
+	outputCoordinator := pflag.Bool("coordinator", false, "Create configuration for a talek coordinator.")
 	name := pflag.String("name", "talek", "Server Name.")
 	address := pflag.String("address", "localhost:9000", "Server Address.")
 	index := pflag.Int("index", 0, "Trust Domain Index.")
@@ -34,6 +36,7 @@ func main() {
 	outfile := pflag.String("outfile", "talek.json", "Save configuration to file.")
 	private := pflag.Bool("private", false, "Include private key configuration.")
 	trustdomains := pflag.String("trustdomains", "talek.json", "Comma separated list of trust domains.")
+	notifyAddresses := pflag.String("notify", "", "Comma separated list of servers notified of coordinator snapshots.")
 	ferr := flags.SetPflagsFromEnv(common.EnvPrefix, pflag.CommandLine)
 	if ferr != nil {
 		fmt.Printf("Error reading environment variables, %v\n", ferr)
@@ -52,7 +55,6 @@ func main() {
 			InterestMultiple:   10,
 			InterestSeed:       int64(rand.Uint64()),
 			MaxLoadFactor:      0.95,
-			LoadFactorStep:     0.05,
 		}
 		sc := server.Config{
 			ReadBatch:     8,
@@ -71,11 +73,17 @@ func main() {
 		return
 	}
 
-	if !*outputReplica && !*outputTD && !*outputClient {
-		fmt.Println("Talekutil needs a mode: --client, --replica, or --trustdomain.")
+	modes := 0
+	for _, mode := range []bool{*outputReplica, *outputTD, *outputClient, *outputCoordinator} {
+		if mode {
+			modes++
+		}
+	}
+	if modes == 0 {
+		fmt.Println("Talekutil needs a mode: --client, --replica, --coordinator, or --trustdomain.")
 		return
-	} else if (*outputReplica && *outputTD) || (*outputClient && *outputReplica) || (*outputClient && *outputTD) {
-		fmt.Println("Mode must be one of --replica or --trustdomain or --client.")
+	} else if modes > 1 {
+		fmt.Println("Mode must be one of --replica or --trustdomain or --client or --coordinator.")
 		return
 	}
 
@@ -83,6 +91,10 @@ func main() {
 		clientUtil(*infile, *outfile, *trustdomains)
 		return
 	}
+	if *outputCoordinator {
+		coordinatorUtil(*name, *address, *infile, *outfile, *notifyAddresses)
+		return
+	}
 
 	var sc = server.Config{
 		ReadBatch:     8,
@@ -199,6 +211,67 @@ func main() {
 	}
 }
 
+// update/create coordinator configuration, including the private key with
+// which it signs snapshots.
+func coordinatorUtil(name string, address string, infile string, outfile string, notifyAddresses string) {
+	config := coordinator.Config{
+		SnapshotThreshold: 1000,
+		SnapshotInterval:  time.Second,
+	}
+	if len(infile) > 0 {
+		dat, readerr := ioutil.ReadFile(infile)
+		if readerr != nil {
+			fmt.Printf("Could not read input file: %v\n", readerr)
+			return
+		}
+		if err := json.Unmarshal(dat, &config); err != nil {
+			fmt.Printf("Could not parse input file: %v\n", err)
+			return
+		}
+	}
+	if config.Identity == nil {
+		config.Identity = common.NewTrustDomainConfig(name, address, true, false)
+	}
+	config.Identity.Name = name
+	config.Identity.Address = address
+	if len(notifyAddresses) > 0 {
+		config.NotifyAddresses = strings.Split(notifyAddresses, ",")
+	}
+
+	// As for a replica, the identity is written with its private key.
+	raw, err := json.Marshal(config)
+	if err != nil {
+		fmt.Printf("Cannot flatten coordinator: %v\n", err)
+		return
+	}
+	var coordstruct map[string]interface{}
+	if err = json.Unmarshal(raw, &coordstruct); err != nil {
+		fmt.Printf("Failed to unmarshal coordinator: %v\n", err)
+		return
+	}
+	raw, err = json.Marshal(config.Identity.Private())
+	if err != nil {
+		fmt.Printf("Failed to export identity: %v\n", err)
+		return
+	}
+	var idstruct map[string]interface{}
+	if err = json.Unmarshal(raw, &idstruct); err != nil {
+		fmt.Printf("Failed to unmarshal identity: %v\n", err)
+		return
+	}
+	coordstruct["Identity"] = idstruct
+
+	raw, err = json.MarshalIndent(coordstruct, "", "  ")
+	if err != nil {
+		fmt.Printf("Could not flatten combined coordinator config: %v\n", err)
+		return
+	}
+	if err = ioutil.WriteFile(outfile, raw, 0640); err != nil {
+		fmt.Printf("Failed to write file: %v\n", err)
+		return
+	}
+}
+
 // update/create client configuration with an explicit set of server trust domains.
 func clientUtil(infile string, outfile string, trustfiles string) {
 	domainPaths := strings.Split(trustfiles, ",")
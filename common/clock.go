@@ -0,0 +1,36 @@
+package common
+
+import (
+	"time"
+)
+
+// Clock provides the passage of time to the periodic loops of clients and
+// servers. Replacing it allows a system to be run under simulated time.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	// Go runs a loop which waits on the clock in its own goroutine.
+	Go(loop func())
+}
+
+// SystemClock is the Clock provided by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) Go(loop func()) {
+	go loop()
+}
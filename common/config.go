@@ -24,19 +24,53 @@ type Config struct {
 	InterestMultiple uint64
 	// Base seed for hashing interest vectors
 	InterestSeed int64
+	// Seed for placing items in cuckoo tables. Every trust domain places
+	// items identically, so that their responses to reads can be combined.
+	CuckooSeed int64
 	// Max fraction of DB capacity that can store messages
 	MaxLoadFactor float64
-
-	/** @todo remove below **/
-	// What fraction of items should be removed from the DB when items are removed?
-	LoadFactorStep float64
+	// How long are messages kept at least, once WindowSize newer messages
+	// have been written, while fewer than MaxRetainedItems have been?
+	MinRetention time.Duration `json:",string"`
+	// Max number of messages kept at a time, at most the capacity of the
+	// database. Defaults to WindowSize if 0. Messages are only kept past the
+	// window for MinRetention if it exceeds WindowSize.
+	MaxRetainedItems uint64
 }
 
-// WindowSize is a computed property of Config for how many items are available at a time
+// WindowSize is a computed property of Config for how many items are available at a time.
+// Items are evicted once WindowSize newer items have been written, unless
+// they are kept for MinRetention.
 func (cc *Config) WindowSize() uint64 {
 	return uint64(float64(cc.NumBuckets*cc.BucketDepth) * cc.MaxLoadFactor)
 }
 
+// RetentionLimit is the most items kept at a time. Items kept past the window
+// load tables beyond MaxLoadFactor, so no more are kept than tables hold.
+func (cc *Config) RetentionLimit() uint64 {
+	if cc.MaxRetainedItems == 0 {
+		return cc.WindowSize()
+	} else if capacity := cc.NumBuckets * cc.BucketDepth; cc.MaxRetainedItems > capacity {
+		return capacity
+	}
+	return cc.MaxRetainedItems
+}
+
+// Expired is whether an item written as seqNo at written (in Unix
+// nanoseconds) is evicted by the write of newSeqNo at now. Items are evicted
+// in order of GlobalSeqNo once WindowSize newer items have been written and
+// they are MinRetention old, or once RetentionLimit newer items have been
+// written. Messages are therefore kept for MinRetention, unless RetentionLimit
+// newer messages are written sooner.
+func (cc *Config) Expired(seqNo uint64, written int64, newSeqNo uint64, now int64) bool {
+	if seqNo+cc.RetentionLimit() <= newSeqNo {
+		return true
+	} else if seqNo+cc.WindowSize() > newSeqNo {
+		return false
+	}
+	return time.Duration(now-written) >= cc.MinRetention
+}
+
 // ConfigFromFile restores a JSON file. returns the config on success or nil if
 // loading or parsing the file fails.
 func ConfigFromFile(file string) *Config {
@@ -0,0 +1,58 @@
+package common
+
+/**
+ * Signed digests of the database, which let clients check that every trust
+ * domain served the same database for a read.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// DBRoot is the merkle root of the buckets of a database epoch, signed by the
+// trust domain which read it.
+type DBRoot struct {
+	Root      [32]byte
+	Signature [64]byte
+}
+
+// dbRootMessage binds a root to the epoch and writes it covers.
+func dbRootMessage(epoch uint64, seqNos Range, root [32]byte) []byte {
+	msg := make([]byte, 0, 8*(3+len(seqNos.Aborted))+len(root))
+	var buf [8]byte
+	for _, val := range append([]uint64{epoch, seqNos.Start, seqNos.End}, seqNos.Aborted...) {
+		binary.LittleEndian.PutUint64(buf[:], val)
+		msg = append(msg, buf[:]...)
+	}
+	return append(msg, root[:]...)
+}
+
+// NewDBRoot signs the root of an epoch with the key of a trust domain.
+func NewDBRoot(td *TrustDomainConfig, epoch uint64, seqNos Range, root [32]byte) (DBRoot, error) {
+	sig, err := td.Sign(dbRootMessage(epoch, seqNos, root))
+	return DBRoot{root, sig}, err
+}
+
+// Verify checks that a trust domain signed the root for an epoch.
+func (r *DBRoot) Verify(td *TrustDomainConfig, epoch uint64, seqNos Range) bool {
+	return td.Verify(dbRootMessage(epoch, seqNos, r.Root), r.Signature)
+}
+
+// VerifyRoots checks that every trust domain signed the same root for the
+// database a read was made against.
+func (r *ReadReply) VerifyRoots(trustDomains []*TrustDomainConfig) error {
+	if len(r.Roots) != len(trustDomains) {
+		return fmt.Errorf("read has %d roots for %d trust domains", len(r.Roots), len(trustDomains))
+	}
+	for i, td := range trustDomains {
+		if !r.Roots[i].Verify(td, r.Epoch, r.GlobalSeqNo) {
+			return fmt.Errorf("invalid root signature from trust domain %s", td.Name)
+		}
+		if r.Roots[i].Root != r.Roots[0].Root {
+			return errors.New("trust domains " + trustDomains[0].Name + " and " + td.Name + " served different databases")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestVerifyRoots(t *testing.T) {
+	tds := []*TrustDomainConfig{
+		NewTrustDomainConfig("one", "", true, false),
+		NewTrustDomainConfig("two", "", true, false),
+	}
+	seqNos := Range{Start: 1, End: 5}
+	reply := &ReadReply{Epoch: 3, GlobalSeqNo: seqNos, Roots: make([]DBRoot, len(tds))}
+	sign := func(i int, epoch uint64, root byte) {
+		r, err := NewDBRoot(tds[i], epoch, seqNos, [32]byte{root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply.Roots[i] = r
+	}
+
+	sign(0, 3, 1)
+	sign(1, 3, 1)
+	if err := reply.VerifyRoots(tds); err != nil {
+		t.Fatalf("Agreeing roots should verify: %v", err)
+	}
+
+	sign(1, 3, 2)
+	if err := reply.VerifyRoots(tds); err == nil {
+		t.Fatalf("Trust domains signing different roots should be detected")
+	}
+
+	sign(1, 4, 1)
+	if err := reply.VerifyRoots(tds); err == nil {
+		t.Fatalf("A root signed for another epoch should not verify")
+	}
+
+	sign(1, 3, 1)
+	reply.Roots[1].Signature = reply.Roots[0].Signature
+	if err := reply.VerifyRoots(tds); err == nil {
+		t.Fatalf("A root signed by another trust domain should not verify")
+	}
+
+	if err := reply.VerifyRoots(tds[:1]); err == nil {
+		t.Fatalf("Roots should be checked against every trust domain")
+	}
+
+	public := &TrustDomainConfig{Name: "public", SignPublicKey: tds[0].SignPublicKey}
+	if _, err := NewDBRoot(public, 3, seqNos, [32]byte{}); err == nil {
+		t.Fatalf("Signing should fail without a private key")
+	}
+}
@@ -19,6 +19,7 @@ type WriteArgs struct {
 	InterestVector []byte // sha256 hash - expect 32bytes
 	//Internal
 	GlobalSeqNo uint64
+	Time        int64            // When serialized, in Unix nanoseconds
 	ReplyChan   chan *WriteReply `json:"-"`
 }
 
@@ -50,7 +51,10 @@ type EncodedReadArgs struct {
 type ReadReply struct {
 	Err            string
 	Data           []byte
-	GlobalSeqNo    Range
+	GlobalSeqNo    Range        // The writes in the window of the database read
+	Epoch          uint64       // The epoch of the database read
+	Roots          []DBRoot     // The root signed by each trust domain
+	Digests        []ReadDigest // The response signed by each trust domain
 	LastInterestSN uint64
 }
 
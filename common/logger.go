@@ -4,10 +4,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sync"
 )
 
 var loggers = make([]*Logger, 0)
 var loggersSilent = false
+var loggersLock sync.Mutex
 
 // Logger tracks status.
 type Logger struct {
@@ -26,6 +28,8 @@ func NewLogger(name string) *Logger {
 	l.Info = log.New(os.Stdout, "["+name+"] INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	l.Warn = log.New(os.Stderr, "["+name+"] WARN: ", log.Ldate|log.Ltime|log.Lshortfile)
 	l.Error = log.New(os.Stderr, "["+name+"] ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
 	if loggersSilent {
 		l.Disable()
 	}
@@ -51,6 +55,8 @@ func (l *Logger) Disable() {
 
 // SilenceLoggers will disable all loggers created with this library
 func SilenceLoggers() {
+	loggersLock.Lock()
+	defer loggersLock.Unlock()
 	loggersSilent = true
 	for _, l := range loggers {
 		l.Disable()
@@ -0,0 +1,46 @@
+package common
+
+/**
+ * Signed digests of the responses of trust domains to reads, which let
+ * clients compare the answers of trust domains given the same request.
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// ReadDigest is the hash of a trust domain's padded response to a read,
+// signed by the trust domain along with the request it answered.
+type ReadDigest struct {
+	Digest    [32]byte
+	Signature [64]byte
+}
+
+// NewReadDigest hashes the response of a trust domain to a read.
+func NewReadDigest(data []byte) ReadDigest {
+	return ReadDigest{Digest: sha256.Sum256(data)}
+}
+
+// readDigestMessage binds a digest to the epoch read and the encrypted
+// request, so that it can not be presented as the answer to another read.
+func readDigestMessage(epoch uint64, request []byte, digest [32]byte) []byte {
+	msg := make([]byte, 8, 8+2*sha256.Size)
+	binary.LittleEndian.PutUint64(msg, epoch)
+	requestDigest := sha256.Sum256(request)
+	msg = append(msg, requestDigest[:]...)
+	return append(msg, digest[:]...)
+}
+
+// Sign signs the digest with the key of a trust domain, which answered
+// request at the given epoch.
+func (d *ReadDigest) Sign(td *TrustDomainConfig, epoch uint64, request []byte) (err error) {
+	d.Signature, err = td.Sign(readDigestMessage(epoch, request, d.Digest))
+	return
+}
+
+// Verify checks that a trust domain signed the digest as its answer to
+// request at the given epoch.
+func (d *ReadDigest) Verify(td *TrustDomainConfig, epoch uint64, request []byte) bool {
+	return td.Verify(readDigestMessage(epoch, request, d.Digest), d.Signature)
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestReadDigest(t *testing.T) {
+	td := NewTrustDomainConfig("one", "", true, false)
+	other := NewTrustDomainConfig("two", "", true, false)
+	request := []byte("request")
+
+	digest := NewReadDigest([]byte("response"))
+	if err := digest.Sign(td, 3, request); err != nil {
+		t.Fatal(err)
+	}
+	if !digest.Verify(td, 3, request) {
+		t.Fatalf("A signed digest should verify")
+	}
+	if digest.Verify(td, 4, request) {
+		t.Fatalf("A digest signed for another epoch should not verify")
+	}
+	if digest.Verify(td, 3, []byte("other request")) {
+		t.Fatalf("A digest signed for another request should not verify")
+	}
+	if digest.Verify(other, 3, request) {
+		t.Fatalf("A digest signed by another trust domain should not verify")
+	}
+
+	altered := NewReadDigest([]byte("altered"))
+	altered.Signature = digest.Signature
+	if altered.Verify(td, 3, request) {
+		t.Fatalf("A signature should not verify another response")
+	}
+}
@@ -6,3 +6,9 @@ type ReplicaInterface interface {
 	Write(args *ReplicaWriteArgs, reply *ReplicaWriteReply) error
 	BatchRead(args *BatchReadRequest, reply *BatchReadReply) error
 }
+
+// ReplicaStateInterface is implemented by replicas able to provide a
+// snapshot of their database to a peer that is catching up.
+type ReplicaStateInterface interface {
+	GetState(args *GetStateArgs, reply *GetStateReply) error
+}
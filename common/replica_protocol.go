@@ -5,27 +5,74 @@ type ReplicaWriteArgs struct {
 	WriteArgs
 	EpochFlag    bool
 	InterestFlag bool
+	// With EpochFlag, the epoch to advance to, and the step of doing so
+	EpochID uint64
+	Phase   EpochPhase
+	// Committing an epoch of a distributed trust domain, the root of the
+	// buckets of each shard as prepared, from which the root of the whole
+	// database is computed
+	ShardRoots [][32]byte
 }
 
+// EpochPhase is a step in advancing the epoch of the database seen by reads.
+// Replicas first prepare a snapshot of the writes they have applied. Once
+// every replica has prepared, each commits, and reads may name the new epoch.
+type EpochPhase int
+
+const (
+	// EpochImmediate prepares and commits an epoch in one step, for a
+	// replica whose reads are not combined with those of others.
+	EpochImmediate EpochPhase = iota
+	// EpochPrepare snapshots the applied writes as the next epoch.
+	EpochPrepare
+	// EpochCommit makes the prepared epoch current.
+	EpochCommit
+	// EpochAbort discards the epoch, returning to the previous one if it was
+	// already committed, when not every replica could commit it.
+	EpochAbort
+)
+
 // ReplicaWriteReply contain return status of writes
 type ReplicaWriteReply struct {
 	Err         string
-	GlobalSeqNo uint64
+	GlobalSeqNo uint64 // The latest write applied in order
 	InterestVec []byte
 	Signature   []byte
+	// Writes the replica has not received, which are holding back later ones
+	Missing []uint64
+	// Preparing an epoch of a distributed trust domain, the root of the
+	// buckets of the shard
+	Root [32]byte
+}
+
+// GetStateArgs request part of a consistent snapshot of a replica's database.
+type GetStateArgs struct {
+	Snapshot uint64 // From a previous reply, or 0 to begin a new transfer
+	Offset   uint64
+}
+
+// GetStateReply carries part of a snapshot of a replica's database.
+type GetStateReply struct {
+	Err      string
+	Snapshot uint64 // Identifies the snapshot being transferred
+	SeqNo    uint64 // The latest write reflected in the snapshot
+	Length   uint64 // Total length of the snapshot
+	Data     []byte
 }
 
 // BatchReadRequest are a batch of requests sent to PIR servers from frontend.
 type BatchReadRequest struct {
-	Args       []EncodedReadArgs // Set of Read requests
-	SeqNoRange Range
-	ReplyChan  chan *BatchReadReply `json:"-"`
+	Args      []EncodedReadArgs    // Set of Read requests
+	Epoch     uint64               // The committed epoch of the database to read
+	ReplyChan chan *BatchReadReply `json:"-"`
 }
 
 // BatchReadReply is a response to a BatchReadRequest.
 type BatchReadReply struct {
 	Err     string
 	Replies []ReadReply
+	Root    DBRoot       // The root of the epoch read
+	Digests []ReadDigest // Of the response to each read
 }
 
 /*************
@@ -41,3 +41,9 @@ func (r *ReplicaRPC) BatchRead(args *BatchReadRequest, reply *BatchReadReply) er
 	err := RPCCall(r.address, r.methodPrefix+".BatchRead", args, reply)
 	return err
 }
+
+// GetState fetches part of a snapshot of the replica's database.
+func (r *ReplicaRPC) GetState(args *GetStateArgs, reply *GetStateReply) error {
+	err := RPCCall(r.address, r.methodPrefix+".GetState", args, reply)
+	return err
+}
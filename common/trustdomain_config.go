@@ -3,6 +3,8 @@ package common
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"strings"
 
 	"github.com/agl/ed25519"
 	"golang.org/x/crypto/nacl/box"
@@ -112,3 +114,30 @@ func (td *TrustDomainConfig) GetAddress() (string, bool) {
 	}
 	return td.Address, td.IsValid
 }
+
+// GetAddresses returns the remote addresses of the servers of the TrustDomain.
+// A distributed trust domain lists the address of each server, in order of
+// the shard it holds, separated by commas.
+func (td *TrustDomainConfig) GetAddresses() ([]string, bool) {
+	if !td.IsValid {
+		return nil, false
+	}
+	if !td.IsDistributed {
+		return []string{td.Address}, true
+	}
+	return strings.Split(td.Address, ","), true
+}
+
+// Sign signs a message with the private signing key of the trust domain.
+func (td *TrustDomainConfig) Sign(message []byte) ([64]byte, error) {
+	var empty [64]byte
+	if td.signPrivateKey == empty {
+		return empty, errors.New("no private signing key for trust domain " + td.Name)
+	}
+	return *ed25519.Sign(&td.signPrivateKey, message), nil
+}
+
+// Verify checks that a message was signed by the trust domain.
+func (td *TrustDomainConfig) Verify(message []byte, signature [64]byte) bool {
+	return ed25519.Verify(&td.SignPublicKey, message, &signature)
+}
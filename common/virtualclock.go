@@ -0,0 +1,215 @@
+package common
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// VirtualClock is a common.Clock whose time only moves when advanced.
+// Timers due at the same instant fire in order of the function that set
+// them, then in the order they were set, so that the order of events does
+// not depend on goroutine scheduling.
+type VirtualClock struct {
+	lock    sync.Mutex
+	waiters *sync.Cond
+	now     time.Time
+	timers  timerHeap
+	count   uint64
+	loops   int
+	stopped bool
+}
+
+type timer struct {
+	deadline time.Time
+	caller   string
+	seq      uint64
+	c        chan time.Time
+}
+
+// NewVirtualClock creates a VirtualClock starting at a given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	v := &VirtualClock{}
+	v.now = start
+	v.waiters = sync.NewCond(&v.lock)
+	return v
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// Now returns the current virtual time.
+func (v *VirtualClock) Now() time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.now
+}
+
+// Sleep blocks until the virtual time has advanced by d.
+func (v *VirtualClock) Sleep(d time.Duration) {
+	<-v.schedule(d, callerName(2))
+}
+
+// After provides a channel which receives the virtual time once it has
+// advanced by d.
+func (v *VirtualClock) After(d time.Duration) <-chan time.Time {
+	return v.schedule(d, callerName(2))
+}
+
+// Go runs a loop in its own goroutine, counting it among the loops which
+// BlockUntilIdle waits on until it returns.
+func (v *VirtualClock) Go(loop func()) {
+	v.lock.Lock()
+	v.loops++
+	v.lock.Unlock()
+	go func() {
+		defer func() {
+			v.lock.Lock()
+			v.loops--
+			v.waiters.Broadcast()
+			v.lock.Unlock()
+		}()
+		loop()
+	}()
+}
+
+// Loops returns the number of loops started with Go which are running.
+func (v *VirtualClock) Loops() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.loops
+}
+
+// Pending returns the number of timers which have not yet fired.
+func (v *VirtualClock) Pending() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.timers)
+}
+
+// BlockUntil waits until at least n timers are pending.
+func (v *VirtualClock) BlockUntil(n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for len(v.timers) < n && !v.stopped {
+		v.waiters.Wait()
+	}
+}
+
+// BlockUntilIdle waits until there are at least as many pending timers as
+// running loops, which is when each loop is waiting on the clock.
+func (v *VirtualClock) BlockUntilIdle() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for len(v.timers) < v.loops && !v.stopped {
+		v.waiters.Wait()
+	}
+}
+
+// Next returns when the next timer is due, if there is one.
+func (v *VirtualClock) Next() (time.Time, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.timers) == 0 {
+		return time.Time{}, false
+	}
+	return v.timers[0].deadline, true
+}
+
+// Step advances time to the next due timer and fires it alone. It returns
+// false if there are no pending timers.
+func (v *VirtualClock) Step() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.timers) == 0 {
+		return false
+	}
+	t := heap.Pop(&v.timers).(*timer)
+	if t.deadline.After(v.now) {
+		v.now = t.deadline
+	}
+	t.c <- v.now
+	return true
+}
+
+// Advance moves time forward by d, firing each timer that becomes due in
+// turn.
+func (v *VirtualClock) Advance(d time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	end := v.now.Add(d)
+	for len(v.timers) > 0 && !v.timers[0].deadline.After(end) {
+		t := heap.Pop(&v.timers).(*timer)
+		v.now = t.deadline
+		t.c <- v.now
+	}
+	v.now = end
+}
+
+// Stop fires all pending timers, and causes future ones to fire
+// immediately, so that anything waiting on the clock can run to completion.
+func (v *VirtualClock) Stop() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.stopped = true
+	for len(v.timers) > 0 {
+		t := heap.Pop(&v.timers).(*timer)
+		t.c <- v.now
+	}
+	v.waiters.Broadcast()
+}
+
+/** Private methods **/
+
+func (v *VirtualClock) schedule(d time.Duration, caller string) chan time.Time {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 || v.stopped {
+		c <- v.now
+		return c
+	}
+	v.count++
+	heap.Push(&v.timers, &timer{v.now.Add(d), caller, v.count, c})
+	v.waiters.Broadcast()
+	return c
+}
+
+// callerName names the function skip frames above its caller.
+func callerName(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	if fn := runtime.FuncForPC(pc); fn != nil {
+		return fn.Name()
+	}
+	return ""
+}
+
+// timerHeap orders timers by deadline, then by caller and sequence.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].deadline.Equal(h[j].deadline) {
+		return h[i].deadline.Before(h[j].deadline)
+	}
+	if h[i].caller != h[j].caller {
+		return h[i].caller < h[j].caller
+	}
+	return h[i].seq < h[j].seq
+}
+func (h timerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *timerHeap) Push(x interface{}) {
+	*h = append(*h, x.(*timer))
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	*h = old[0 : n-1]
+	return t
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	v := NewVirtualClock(time.Unix(0, 0))
+	first := v.After(time.Second)
+	second := v.After(time.Millisecond)
+	if v.Pending() != 2 {
+		t.Fatalf("Expected 2 pending timers, got %d", v.Pending())
+	}
+	if !v.Step() {
+		t.Fatalf("Step should fire a timer")
+	}
+	select {
+	case now := <-second:
+		if now.Sub(time.Unix(0, 0)) != time.Millisecond {
+			t.Fatalf("Timer fired at wrong time: %v", now)
+		}
+	default:
+		t.Fatalf("Earliest timer should fire first")
+	}
+	select {
+	case <-first:
+		t.Fatalf("Only one timer should fire per step")
+	default:
+	}
+
+	v.Advance(time.Minute)
+	if v.Pending() != 0 || len(first) != 1 {
+		t.Fatalf("Advance should fire due timers")
+	}
+	if v.Now().Sub(time.Unix(0, 0)) != time.Minute+time.Millisecond {
+		t.Fatalf("Clock at wrong time after advance: %v", v.Now())
+	}
+
+	v.Stop()
+	select {
+	case <-v.After(time.Hour):
+	default:
+		t.Fatalf("Timers should fire immediately once stopped")
+	}
+}
+
+func TestVirtualClockLoops(t *testing.T) {
+	v := NewVirtualClock(time.Unix(0, 0))
+	done := make(chan struct{})
+	v.Go(func() {
+		for i := 0; i < 2; i++ {
+			v.Sleep(time.Second)
+		}
+		close(done)
+	})
+	if v.Loops() != 1 {
+		t.Fatalf("Expected 1 running loop, got %d", v.Loops())
+	}
+	v.BlockUntilIdle()
+	if v.Pending() != 1 {
+		t.Fatalf("An idle loop should be waiting on a timer")
+	}
+	v.Step()
+	v.BlockUntilIdle()
+	v.Step()
+	<-done
+	v.BlockUntilIdle()
+	if v.Loops() != 0 {
+		t.Fatalf("Loops should not be counted once they return")
+	}
+}
@@ -1,6 +1,9 @@
 package cuckoo
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 
@@ -27,8 +30,10 @@ type Table struct {
 	itemSize    uint64 // Number of bytes in an item. Must be fixed globally
 	data        []byte // Serialized cuckoo table data of all items {bucket1, bucket2, ...}
 	rand        *rand.Rand
+	source      *countingSource
 	log         *common.Logger
 	index       []ItemLocation // Meta data of each item's bucket locations and ID
+	dirty       []uint64       // Bitmap of buckets with data changed since TakeDirty
 }
 
 // NewTable creates a new cuckoo table optionaly backed by a pre-allocated memory area.
@@ -40,14 +45,16 @@ type Table struct {
 // randSeed = seed for PRNG
 func NewTable(name string, numBuckets uint64, bucketDepth uint64, itemSize uint64,
 	data []byte, randSeed int64) *Table {
-	t := &Table{name, numBuckets, bucketDepth, itemSize, nil, nil, nil, nil}
+	t := &Table{name, numBuckets, bucketDepth, itemSize, nil, nil, nil, nil, nil, nil}
 	if data == nil {
 		data = make([]byte, numBuckets*bucketDepth*itemSize)
 	}
 	t.data = data
-	t.rand = rand.New(rand.NewSource(randSeed))
+	t.source = newCountingSource(randSeed)
+	t.rand = rand.New(t.source)
 	t.log = common.NewLogger(name)
 	t.index = make([]ItemLocation, numBuckets*bucketDepth)
+	t.dirty = make([]uint64, (numBuckets+63)/64)
 
 	if uint64(len(data)) != numBuckets*bucketDepth*itemSize {
 		t.log.Error.Printf("NewTable(%v) failed: len(data)=%v is not equal to numBuckets*bucketDepth*itemSize (%v,%v,%v)", name, len(data), numBuckets, bucketDepth, itemSize)
@@ -183,10 +190,86 @@ func (t *Table) Remove(item *Item) bool {
 	return result || t.removeFromBucket(nextBucket, item)
 }
 
+// MarshalBinary serializes the full state of the table, including item
+// placement, item data, and the state of its PRNG, so that a restored table
+// will continue to make the same choices.
+func (t *Table) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	header := []uint64{t.numBuckets, t.bucketDepth, t.itemSize, uint64(t.source.seed), t.source.draws}
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	for _, loc := range t.index {
+		entry := [4]uint64{loc.id, loc.bucket1, loc.bucket2, 0}
+		if loc.filled {
+			entry[3] = 1
+		}
+		if err := binary.Write(&buf, binary.LittleEndian, entry); err != nil {
+			return nil, err
+		}
+	}
+	buf.Write(t.data)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary restores state produced by MarshalBinary. The table must
+// have been created by NewTable with the same dimensions; its data region is
+// overwritten in place, so a pre-allocated backing is kept.
+func (t *Table) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	var header [5]uint64
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header[0] != t.numBuckets || header[1] != t.bucketDepth || header[2] != t.itemSize {
+		return errors.New("serialized table has different dimensions")
+	}
+	index := make([]ItemLocation, len(t.index))
+	for i := range index {
+		var entry [4]uint64
+		if err := binary.Read(reader, binary.LittleEndian, &entry); err != nil {
+			return err
+		}
+		index[i] = ItemLocation{id: entry[0], bucket1: entry[1], bucket2: entry[2], filled: entry[3] == 1}
+	}
+	if uint64(reader.Len()) != uint64(len(t.data)) {
+		return errors.New("serialized table has wrong data length")
+	}
+
+	reader.Read(t.data)
+	t.index = index
+	for b := uint64(0); b < t.numBuckets; b++ {
+		t.markDirty(b)
+	}
+	t.source.restore(int64(header[3]), header[4])
+	return nil
+}
+
+// TakeDirty returns the buckets whose data has changed since the previous
+// call, in increasing order, and resets tracking. Both insertion and removal
+// mark a bucket dirty, since removal clears the data of an item.
+func (t *Table) TakeDirty() []uint64 {
+	buckets := make([]uint64, 0)
+	for w, word := range t.dirty {
+		for bit := uint64(0); word != 0; bit++ {
+			if word&1 != 0 {
+				buckets = append(buckets, uint64(w)*64+bit)
+			}
+			word >>= 1
+		}
+		t.dirty[w] = 0
+	}
+	return buckets
+}
+
 /********************
  * PRIVATE METHODS
  ********************/
 
+func (t *Table) markDirty(bucketIndex uint64) {
+	t.dirty[bucketIndex/64] |= 1 << (bucketIndex % 64)
+}
+
 // Checks if the `value` is in a specified bucket
 // - bucket MUST be within bounds
 // Returns: the true if `value.Equals(...)`
@@ -215,6 +298,7 @@ func (t *Table) tryInsertToBucket(bucketIndex uint64, item *Item) bool {
 	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
 		if !t.index[i].filled {
 			copy(t.data[i*t.itemSize:], item.Data)
+			t.markDirty(bucketIndex)
 			t.index[i].id = item.ID
 			t.index[i].bucket1 = item.Bucket1
 			t.index[i].bucket2 = item.Bucket2
@@ -262,13 +346,24 @@ func (t *Table) insertAndEvict(bucketIndex uint64, item *Item) (bool, *Item) {
 func (t *Table) removeFromBucket(bucketIndex uint64, item *Item) bool {
 	for i := bucketIndex * t.bucketDepth; i < (bucketIndex+1)*t.bucketDepth; i++ {
 		if item != nil && item.Equals(t.getItem(i)) {
-			t.index[i].filled = false
+			t.clearSlot(i)
+			t.markDirty(bucketIndex)
 			return true
 		}
 	}
 	return false
 }
 
+// Empties a slot, clearing its data so that the contents of the table depend
+// only on the placement of the items it holds.
+func (t *Table) clearSlot(itemIndex uint64) {
+	t.index[itemIndex].filled = false
+	data := t.data[itemIndex*t.itemSize : (itemIndex+1)*t.itemSize]
+	for i := range data {
+		data[i] = 0
+	}
+}
+
 func (t *Table) getItem(itemIndex uint64) *Item {
 	if !t.index[itemIndex].filled {
 		return nil
@@ -279,3 +374,33 @@ func (t *Table) getItem(itemIndex uint64) *Item {
 		t.index[itemIndex].bucket1,
 		t.index[itemIndex].bucket2}
 }
+
+// countingSource is a seeded PRNG source which counts its draws, so that its
+// state can be restored by replaying them.
+type countingSource struct {
+	rand.Source
+	seed  int64
+	draws uint64
+}
+
+func newCountingSource(seed int64) *countingSource {
+	return &countingSource{rand.NewSource(seed), seed, 0}
+}
+
+func (s *countingSource) Int63() int64 {
+	s.draws++
+	return s.Source.Int63()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.Source.Seed(seed)
+	s.seed = seed
+	s.draws = 0
+}
+
+func (s *countingSource) restore(seed int64, draws uint64) {
+	s.Seed(seed)
+	for s.draws < draws {
+		s.Int63()
+	}
+}
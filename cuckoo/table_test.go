@@ -361,3 +361,76 @@ func BenchmarkInserts(b *testing.B) {
 		}
 	}
 }
+
+func TestMarshalBinary(t *testing.T) {
+	fmt.Printf("TestMarshalBinary ...\n")
+	numBuckets := uint64(16)
+	table := NewTable("t", numBuckets, 2, testItemSize, nil, 7)
+	for i := 0; i < 20; i++ {
+		table.Insert(&Item{uint64(i), GetBytes("value" + strconv.Itoa(i)), randBucket(numBuckets), randBucket(numBuckets)})
+	}
+
+	state, err := table.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshaling table: %v\n", err)
+	}
+	restored := NewTable("r", numBuckets, 2, testItemSize, nil, 0)
+	if err := restored.UnmarshalBinary(state); err != nil {
+		t.Fatalf("error unmarshaling table: %v\n", err)
+	}
+	if restored.GetNumElements() != table.GetNumElements() || !bytes.Equal(restored.data, table.data) {
+		t.Fatalf("restored table differs from original\n")
+	}
+
+	// Both tables should make the same choices for subsequent operations.
+	for i := 20; i < 28; i++ {
+		item := &Item{uint64(i), GetBytes("value" + strconv.Itoa(i)), randBucket(numBuckets), randBucket(numBuckets)}
+		okA, evictedA := table.Insert(item)
+		okB, evictedB := restored.Insert(item)
+		if okA != okB || (evictedA == nil) != (evictedB == nil) || (evictedA != nil && !evictedA.Equals(evictedB)) {
+			t.Fatalf("restored table diverged on insert %d\n", i)
+		}
+	}
+	if !bytes.Equal(restored.data, table.data) {
+		t.Fatalf("restored table diverged from original\n")
+	}
+
+	if NewTable("s", numBuckets*2, 2, testItemSize, nil, 0).UnmarshalBinary(state) == nil {
+		t.Fatalf("should not restore into a table of different size\n")
+	}
+	fmt.Printf("... done \n")
+}
+
+func TestTakeDirty(t *testing.T) {
+	fmt.Printf("TestTakeDirty ...\n")
+	numBuckets := uint64(128)
+	table := NewTable("t", numBuckets, 2, testItemSize, nil, 0)
+	if len(table.TakeDirty()) != 0 {
+		t.Fatalf("new table should have no dirty buckets\n")
+	}
+
+	item := &Item{1, GetBytes("value1"), 3, 3}
+	table.Insert(item)
+	table.Insert(&Item{2, GetBytes("value2"), 70, 70})
+	dirty := table.TakeDirty()
+	if len(dirty) != 2 || dirty[0] != 3 || dirty[1] != 70 {
+		t.Fatalf("expected buckets 3 and 70 to be dirty, got %v\n", dirty)
+	}
+	if len(table.TakeDirty()) != 0 {
+		t.Fatalf("dirty buckets should be reset once taken\n")
+	}
+
+	// Removal clears the data of the item.
+	table.Remove(item)
+	dirty = table.TakeDirty()
+	if len(dirty) != 1 || dirty[0] != 3 {
+		t.Fatalf("expected removal to dirty bucket 3, got %v\n", dirty)
+	}
+
+	state, _ := table.MarshalBinary()
+	table.UnmarshalBinary(state)
+	if uint64(len(table.TakeDirty())) != numBuckets {
+		t.Fatalf("restoring a table should dirty every bucket\n")
+	}
+	fmt.Printf("... done \n")
+}
@@ -0,0 +1,262 @@
+package libtalek
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/merkle"
+)
+
+// checkRead removes the pads of trust domains from a copy of the response to
+// a read of a single bucket, and checks the bucket against the tag which
+// trust domains append to it. A corrupted response fails the check, while a
+// bucket which does not hold an expected message passes it.
+func checkRead(args *common.ReadArgs, data []byte) bool {
+	if len(data) < merkle.Size {
+		return false
+	}
+	plain := append([]byte{}, data...)
+	for i := range args.TD {
+		if err := drbg.Overlay(args.TD[i].PadSeed, plain); err != nil {
+			return false
+		}
+	}
+	tag := merkle.Leaf(plain[:len(plain)-merkle.Size])
+	return bytes.Equal(tag[:], plain[len(plain)-merkle.Size:])
+}
+
+// auditor looks for the trust domain responsible for a corrupted read. Each
+// audit read gives a pair of trust domains the same request, which neither can
+// tell apart from any other read, and compares their signed responses. A trust
+// domain in every pair which disagreed is named as faulty. When that does not
+// single one out, as with two trust domains, each suspect is then asked alone
+// for a random check bucket, whose tag shows whether it answered correctly.
+// Distributed trust domains are not audited, since the frontend combines the
+// responses of their servers, which no server signs. Nor are suspects read
+// alone when there are any, since their part of the response can not be
+// checked.
+type auditor struct {
+	trustDomains int
+	reads        []auditRead // Reads remaining to be made
+	disagreed    [][2]int
+	readAlone    bool // Whether suspects can be read alone
+}
+
+// auditRead is a read made by an audit. It either gives a pair of trust
+// domains the same request, or asks one trust domain alone for a bucket.
+type auditRead struct {
+	pair  [2]int
+	alone int // The trust domain read alone, or -1
+}
+
+// start begins an audit of every pair of trust domains, unless one is already
+// underway. It returns false if there are no pairs to audit.
+func (a *auditor) start(trustDomains []*common.TrustDomainConfig) bool {
+	if a.reads != nil {
+		return true
+	}
+	a.trustDomains = len(trustDomains)
+	a.readAlone = true
+	a.reads = make([]auditRead, 0)
+	a.disagreed = make([][2]int, 0)
+	for i := range trustDomains {
+		a.readAlone = a.readAlone && !trustDomains[i].IsDistributed
+		for j := i + 1; j < len(trustDomains); j++ {
+			if !trustDomains[i].IsDistributed && !trustDomains[j].IsDistributed {
+				a.reads = append(a.reads, auditRead{[2]int{i, j}, -1})
+			}
+		}
+	}
+	if len(a.reads) == 0 {
+		a.reads = nil
+		return false
+	}
+	return true
+}
+
+// next returns the read to make for the audit, if any.
+func (a *auditor) next() *auditRead {
+	if len(a.reads) == 0 {
+		return nil
+	}
+	return &a.reads[0]
+}
+
+// record notes whether a pair of trust domains agreed. Once every pair has
+// been audited, the faulty trust domain is returned if one can be named. If
+// not, but pairs disagreed, the suspects are then read alone, and done is
+// false until they have been.
+func (a *auditor) record(pair [2]int, agreed bool) (faulty int, done bool) {
+	if !agreed {
+		a.disagreed = append(a.disagreed, pair)
+	}
+	a.reads = a.reads[1:]
+	if len(a.reads) > 0 {
+		return -1, false
+	}
+	if faulty = a.faulty(); faulty >= 0 || len(a.disagreed) == 0 || !a.readAlone {
+		a.reads = nil
+		return faulty, true
+	}
+	for _, td := range a.suspects() {
+		a.reads = append(a.reads, auditRead{alone: td})
+	}
+	return -1, false
+}
+
+// recordAlone notes the trust domain shown to be faulty by reading a trust
+// domain alone, if any. The audit ends as soon as one is found.
+func (a *auditor) recordAlone(faulty int) (int, bool) {
+	a.reads = a.reads[1:]
+	if faulty < 0 && len(a.reads) > 0 {
+		return -1, false
+	}
+	a.reads = nil
+	return faulty, true
+}
+
+func (a *auditor) faulty() int {
+	if a.trustDomains == 1 {
+		// There is no one else to blame.
+		return 0
+	}
+	if suspects := a.suspects(); len(suspects) == 1 {
+		return suspects[0]
+	}
+	return -1
+}
+
+// suspects returns the trust domains in every pair which disagreed.
+func (a *auditor) suspects() []int {
+	if len(a.disagreed) == 0 {
+		return nil
+	}
+	suspects := a.disagreed[0][:]
+	for _, pair := range a.disagreed[1:] {
+		remaining := make([]int, 0, 2)
+		for _, td := range suspects {
+			if td == pair[0] || td == pair[1] {
+				remaining = append(remaining, td)
+			}
+		}
+		suspects = remaining
+	}
+	return suspects
+}
+
+// generateAuditRead makes a read for an audit. A pair of trust domains is
+// given the same request and pad, so that their responses should be
+// identical. A trust domain read alone is asked for a single random bucket,
+// while the others are given empty requests, so that they answer with only
+// their pads.
+func (c *Client) generateAuditRead(config *ClientConfig, read auditRead) *common.ReadArgs {
+	args := c.generateRandomRead(config)
+	if read.alone < 0 {
+		args.TD[read.pair[1]] = args.TD[read.pair[0]]
+		return args
+	}
+	for i := range args.TD {
+		for j := range args.TD[i].RequestVector {
+			args.TD[i].RequestVector[j] = 0
+		}
+	}
+	var random [8]byte
+	c.Rand.Read(random[:])
+	bucket := binary.LittleEndian.Uint64(random[:]) % config.Config.NumBuckets
+	args.TD[read.alone].RequestVector[bucket/8] = 1 << (bucket % 8)
+	return args
+}
+
+// onAuditReply checks the signed responses of the trust domains audited by a
+// read.
+func (c *Client) onAuditReply(config *ClientConfig, read auditRead, args *common.ReadArgs, encArgs *common.EncodedReadArgs, reply *common.ReadReply) {
+	if reply.Err != "" || len(reply.Digests) != len(config.TrustDomains) {
+		// Try the read again next time.
+		return
+	}
+	audited := read.pair[:]
+	if read.alone >= 0 {
+		audited = make([]int, len(config.TrustDomains))
+		for i := range audited {
+			audited[i] = i
+		}
+	}
+	for _, i := range audited {
+		td := config.TrustDomains[i]
+		if !reply.Digests[i].Verify(td, reply.Epoch, encArgs.PirArgs[i]) {
+			c.log.Warn.Printf("Audit response from trust domain %s is not signed.\n", td.Name)
+			return
+		}
+	}
+	if read.alone >= 0 {
+		if faulty, done := c.audits.recordAlone(c.checkAlone(config, read.alone, args, reply)); done {
+			c.reportFault(config, faulty)
+		}
+		return
+	}
+
+	pair := read.pair
+	agreed := reply.Digests[pair[0]].Digest == reply.Digests[pair[1]].Digest
+	if !agreed {
+		c.log.Warn.Printf("Trust domains %s and %s answered an audit differently.\n", config.TrustDomains[pair[0]].Name, config.TrustDomains[pair[1]].Name)
+	}
+	if faulty, done := c.audits.record(pair, agreed); done {
+		c.reportFault(config, faulty)
+	}
+}
+
+// checkAlone returns the trust domain shown to be faulty by a read of one
+// trust domain alone, or -1. Each other trust domain must have signed a
+// response of only its pad. What remains of the combined response must then
+// be what the trust domain read alone signed, and hold a bucket matching its
+// tag.
+func (c *Client) checkAlone(config *ClientConfig, alone int, args *common.ReadArgs, reply *common.ReadReply) int {
+	response := append([]byte{}, reply.Data...)
+	for i := range args.TD {
+		if i == alone {
+			continue
+		}
+		pad := make([]byte, len(reply.Data))
+		if err := drbg.Overlay(args.TD[i].PadSeed, pad); err != nil {
+			return -1
+		}
+		if common.NewReadDigest(pad).Digest != reply.Digests[i].Digest {
+			c.log.Warn.Printf("Trust domain %s answered an empty request with more than its pad.\n", config.TrustDomains[i].Name)
+			return i
+		}
+		for j := range response {
+			response[j] ^= pad[j]
+		}
+	}
+	if common.NewReadDigest(response).Digest != reply.Digests[alone].Digest {
+		// The response was altered after the trust domains signed it.
+		c.log.Warn.Printf("Audit response does not match what trust domains signed.\n")
+		return -1
+	}
+	if !checkRead(args, reply.Data) {
+		c.log.Warn.Printf("Trust domain %s read a bucket incorrectly.\n", config.TrustDomains[alone].Name)
+		return alone
+	}
+	return -1
+}
+
+// startAudit begins looking for the trust domain responsible for a corrupted
+// read.
+func (c *Client) startAudit(config *ClientConfig) {
+	if !c.audits.start(config.TrustDomains) {
+		c.reportFault(config, c.audits.faulty())
+	}
+}
+
+func (c *Client) reportFault(config *ClientConfig, faulty int) {
+	if faulty < 0 {
+		c.log.Warn.Printf("Audit could not find the trust domain which corrupted a read.\n")
+		c.emit(Event{Type: EventUnattributedFault})
+		return
+	}
+	name := config.TrustDomains[faulty].Name
+	c.log.Warn.Printf("Trust domain %s corrupted a read.\n", name)
+	c.emit(Event{Type: EventFaultyTrustDomain, TrustDomain: name})
+}
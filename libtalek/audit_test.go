@@ -0,0 +1,225 @@
+package libtalek
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/merkle"
+)
+
+// pirLeader answers reads by computing the response of each trust domain over
+// a database of random buckets. The faulty trust domain, if any, corrupts its
+// responses. A faulty index of the number of trust domains instead corrupts
+// the combined response, as a faulty frontend would.
+type pirLeader struct {
+	mockLeader
+	config ClientConfig
+	db     [][]byte // Each bucket, followed by its tag
+	faulty int
+}
+
+func newPIRLeader(config ClientConfig, faulty int) *pirLeader {
+	m := &pirLeader{config: config, faulty: faulty}
+	for b := uint64(0); b < config.NumBuckets; b++ {
+		bucket := make([]byte, config.BucketDepth*config.DataSize)
+		rand.Read(bucket)
+		tag := merkle.Leaf(bucket)
+		m.db = append(m.db, append(bucket, tag[:]...))
+	}
+	return m
+}
+
+func (m *pirLeader) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	reply.Data = make([]byte, len(m.db[0]))
+	for i, td := range m.config.TrustDomains {
+		pir, err := args.Decode(i, td)
+		if err != nil {
+			return err
+		}
+		response := make([]byte, len(m.db[0]))
+		for b := range m.db {
+			if pir.RequestVector[b/8]&(1<<uint(b%8)) != 0 {
+				for j := range response {
+					response[j] ^= m.db[b][j]
+				}
+			}
+		}
+		if i == m.faulty {
+			response[0] ^= 1
+		}
+		drbg.Overlay(pir.PadSeed, response)
+		reply.Combine(response)
+
+		root, _ := common.NewDBRoot(td, reply.Epoch, reply.GlobalSeqNo, [32]byte{})
+		reply.Roots = append(reply.Roots, root)
+		digest := common.NewReadDigest(response)
+		digest.Sign(td, reply.Epoch, args.PirArgs[i])
+		reply.Digests = append(reply.Digests, digest)
+	}
+	if m.faulty == len(m.config.TrustDomains) {
+		reply.Data[0] ^= 1
+	}
+	return nil
+}
+
+// auditObserver collects the trust domains named by audits, and an empty
+// name for each audit which could not name one.
+type auditObserver chan string
+
+func (o auditObserver) OnEvent(event Event) {
+	if event.Type == EventFaultyTrustDomain || event.Type == EventUnattributedFault {
+		select {
+		case o <- event.TrustDomain:
+		default:
+		}
+	}
+}
+
+func auditConfig(trustDomains int) ClientConfig {
+	config := ClientConfig{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 2, DataSize: 256, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Millisecond,
+	}
+	for i := 0; i < trustDomains; i++ {
+		config.TrustDomains = append(config.TrustDomains, common.NewTrustDomainConfig(string('A'+rune(i)), "127.0.0.1", true, false))
+	}
+	return config
+}
+
+func TestCorruptReads(t *testing.T) {
+	config := auditConfig(3)
+	topic, _ := NewTopic()
+
+	// Reads answered correctly do not yield messages, but are neither corrupt
+	// nor failures to decrypt.
+	c := NewClient("TestCorruptReads", config, newPIRLeader(config, -1))
+	c.Poll(&topic.Handle)
+	for i := 0; c.Stats().RealReads < 5; i++ {
+		if i > 500 {
+			t.Fatalf("Reads should have been made")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Kill()
+	if c.Stats().CorruptReads != 0 || c.Stats().DecryptFailures != 0 {
+		t.Fatalf("Correct reads should not be considered corrupt or failed")
+	}
+
+	// With three trust domains, audits name the one corrupting reads.
+	faults := make(auditObserver, 1)
+	c = NewClient("TestCorruptReads", config, newPIRLeader(config, 1))
+	c.SetObserver(faults)
+	c.Poll(&topic.Handle)
+	select {
+	case name := <-faults:
+		if name != config.TrustDomains[1].Name {
+			t.Fatalf("Audit blamed %s rather than %s", name, config.TrustDomains[1].Name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Audit should have named the faulty trust domain")
+	}
+	c.Kill()
+	if c.Stats().CorruptReads == 0 || c.Stats().DecryptFailures != 0 {
+		t.Fatalf("Reads should be considered corrupt, rather than missing")
+	}
+}
+
+func TestAuditTwoTrustDomains(t *testing.T) {
+	config := auditConfig(2)
+	topic, _ := NewTopic()
+
+	// Reading each trust domain alone names the faulty one.
+	for faulty := 0; faulty < 2; faulty++ {
+		faults := make(auditObserver, 1)
+		c := NewClient("TestAuditTwoTrustDomains", config, newPIRLeader(config, faulty))
+		c.SetObserver(faults)
+		c.Poll(&topic.Handle)
+		select {
+		case name := <-faults:
+			if name != config.TrustDomains[faulty].Name {
+				t.Fatalf("Audit blamed %q rather than %s", name, config.TrustDomains[faulty].Name)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Audit should have named the faulty trust domain")
+		}
+		c.Kill()
+	}
+
+	// Corruption after the trust domains answer is reported, but not blamed
+	// on either.
+	faults := make(auditObserver, 1)
+	c := NewClient("TestAuditTwoTrustDomains", config, newPIRLeader(config, 2))
+	c.SetObserver(faults)
+	c.Poll(&topic.Handle)
+	select {
+	case name := <-faults:
+		if name != "" {
+			t.Fatalf("Audit blamed %s for a fault of neither trust domain", name)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Audit should have reported the fault")
+	}
+	c.Kill()
+	if c.Stats().UnattributedFaults == 0 {
+		t.Fatalf("Unattributed faults should be counted")
+	}
+}
+
+func TestAuditor(t *testing.T) {
+	cases := []struct {
+		trustDomains int
+		disagree     map[[2]int]bool
+		alone        int // The trust domain found faulty when read alone
+		faulty       int
+	}{
+		{1, nil, -1, 0},
+		{2, map[[2]int]bool{{0, 1}: true}, 1, 1},
+		{2, map[[2]int]bool{{0, 1}: true}, -1, -1},
+		{3, nil, -1, -1},
+		{3, map[[2]int]bool{{0, 2}: true, {1, 2}: true}, -1, 2},
+		{3, map[[2]int]bool{{0, 1}: true}, 0, 0},
+		{4, map[[2]int]bool{{0, 1}: true, {1, 2}: true, {1, 3}: true}, -1, 1},
+	}
+	for _, c := range cases {
+		a := auditor{}
+		if !a.start(auditConfig(c.trustDomains).TrustDomains) {
+			if faulty := a.faulty(); faulty != c.faulty {
+				t.Fatalf("With a single trust domain, %d was named", faulty)
+			}
+			continue
+		}
+		var faulty int
+		for done := false; !done; {
+			read := *a.next()
+			if read.alone < 0 {
+				faulty, done = a.record(read.pair, !c.disagree[read.pair])
+			} else if read.alone == c.alone {
+				faulty, done = a.recordAlone(read.alone)
+			} else {
+				faulty, done = a.recordAlone(-1)
+			}
+		}
+		if faulty != c.faulty || a.next() != nil {
+			t.Fatalf("Audit of %d trust domains disagreeing at %v named %d rather than %d", c.trustDomains, c.disagree, faulty, c.faulty)
+		}
+	}
+
+	// Distributed trust domains are left out of audits.
+	tds := auditConfig(3).TrustDomains
+	tds[1].IsDistributed = true
+	a := auditor{}
+	if !a.start(tds) || a.next().pair != [2]int{0, 2} {
+		t.Fatalf("Only the pair of centralized trust domains should be audited")
+	}
+	if faulty, done := a.record([2]int{0, 2}, false); !done || faulty != -1 {
+		t.Fatalf("Suspects should not be read alone beside a distributed trust domain")
+	}
+	tds[0].IsDistributed = true
+	if a = (auditor{}); a.start(tds) || a.faulty() != -1 {
+		t.Fatalf("A single centralized trust domain should not be blamed")
+	}
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/merkle"
 	"github.com/willscott/bloom"
 )
 
@@ -37,8 +38,18 @@ type Client struct {
 	pendingReads chan request
 	handleMutex  sync.Mutex
 
+	// Audits of trust domains after a corrupted read, owned by the read thread.
+	audits auditor
+
+	// Consumed seqnos waiting to be acknowledged, by handle.
+	receipts map[*Handle]*receiptBatch
+
 	interestVector *bloom.Filter
 
+	stats    clientStats
+	observer atomic.Value //observerBox
+
+	// Highest global seqno seen by reads and writes; accessed atomically.
 	lastSeqNo uint64
 	// Used to synchronize fetches of global interest vector.
 	lastInterestSN uint64
@@ -68,6 +79,7 @@ func NewClient(name string, config ClientConfig, leader common.FrontendInterface
 	c.pendingReads = make(chan request, 5)
 	c.pendingWrites = make(chan *common.WriteArgs, 5)
 	c.pendingUpdates = make(chan bool, 5)
+	c.receipts = make(map[*Handle]*receiptBatch)
 
 	bfSize := math.Ceil(math.Log2(float64(config.NumBuckets)))
 	iv, err := bloom.New(rand.Reader, int(bfSize), config.BloomFalsePositive)
@@ -80,9 +92,10 @@ func NewClient(name string, config ClientConfig, leader common.FrontendInterface
 	c.writeWaiters = sync.NewCond(&c.writeMutex)
 	c.Rand = rand.Reader
 
-	go c.readPeriodic()
-	go c.writePeriodic()
-	go c.updatePeriodic()
+	clock := config.clock()
+	clock.Go(c.readPeriodic)
+	clock.Go(c.writePeriodic)
+	clock.Go(c.updatePeriodic)
 
 	return c
 }
@@ -134,6 +147,9 @@ func (c *Client) Publish(handle *Topic, data []byte) error {
 		if err != nil {
 			return err
 		}
+		if handle.Receipts != nil {
+			c.followReceipts(handle)
+		}
 
 		c.writeMutex.Lock()
 		c.writeCount++
@@ -155,40 +171,110 @@ func (c *Client) Flush() {
 
 // Poll handles to updates on a given log.
 // When done reading messages, the channel can be closed via the Done
-// method.
+// method. Poll uses PollSubscriptionConfig, so every message is delivered,
+// but reads of every handle wait while the channel is not consumed;
+// Subscribe allows control over buffering. If the handle can not be
+// polled, e.g. because it already is, the returned channel is closed.
 func (c *Client) Poll(handle *Handle) chan []byte {
-	// Check if already polling.
-	c.handleMutex.Lock()
-	for x := range c.handles {
-		if c.handles[x] == handle {
-			c.handleMutex.Unlock()
-			if c.Verbose {
-				c.log.Info.Println("Ignoring request to poll, because already polling.")
-			}
-			return nil
-		}
+	sub, err := c.Subscribe(handle, PollSubscriptionConfig)
+	if err != nil {
+		c.log.Warn.Printf("Failed to poll handle: %v\n", err)
+		closed := make(chan []byte)
+		close(closed)
+		return closed
 	}
-	if c.Verbose {
-		handle.log = c.log
+	return sub.messages
+}
+
+// Subscribe begins polling a handle for new messages, which are buffered in
+// the returned Subscription. Delivery never blocks reads of other handles.
+func (c *Client) Subscribe(handle *Handle, config SubscriptionConfig) (*Subscription, error) {
+	sub := newSubscription(c, handle, config)
+	if err := c.poll(handle, sub); err != nil {
+		return nil, err
 	}
-	if handle.updates == nil {
-		if err := initHandle(handle); err != nil {
-			return nil
-		}
+	return sub, nil
+}
+
+// SubscribeFunc begins polling a handle, calling fn with each new message on
+// a dedicated goroutine until the returned Subscription is closed.
+func (c *Client) SubscribeFunc(handle *Handle, config SubscriptionConfig, fn func([]byte)) (*Subscription, error) {
+	sub, err := c.Subscribe(handle, config)
+	if err != nil {
+		return nil, err
 	}
-	c.handles = append(c.handles, handle)
-	c.handleMutex.Unlock()
+	go func() {
+		for msg := range sub.messages {
+			fn(msg)
+		}
+	}()
+	return sub, nil
+}
 
-	return handle.updates
+// PollReceipts follows the read receipts sent back by readers of a topic,
+// as Publish does, and returns the topic's ReceiptEvents. Receipts must have
+// been enabled with Topic.EnableReceipts before the topic's handle was
+// shared. When done, polling can be stopped by calling Done on
+// topic.Receipts.Handle.
+func (c *Client) PollReceipts(topic *Topic) <-chan *Receipt {
+	if topic.Receipts == nil {
+		return nil
+	}
+	c.followReceipts(topic)
+	return topic.ReceiptEvents()
 }
 
-// Done unsubscribes a Handle from being Polled for new items.
+// Done unsubscribes a Handle from being Polled for new items, and closes
+// its subscription.
 func (c *Client) Done(handle *Handle) bool {
+	if !c.unsubscribe(handle) {
+		return false
+	}
+	if handle.subscription != nil {
+		handle.subscription.close()
+	}
+	return true
+}
+
+// Stats returns a snapshot of the client's activity so far.
+func (c *Client) Stats() Stats {
+	stats := c.stats.snapshot()
+	c.writeMutex.Lock()
+	stats.PendingWrites = c.writeCount
+	c.writeMutex.Unlock()
+	stats.PendingReads = len(c.pendingReads)
+	return stats
+}
+
+// SetObserver registers an Observer to be notified of each read, write and
+// interest vector refresh made by the client. Passing nil removes it.
+// Events are only delivered locally, and are never sent by the client.
+func (c *Client) SetObserver(observer Observer) {
+	c.observer.Store(observerBox{observer})
+}
+
+/** Private methods **/
+
+// observerBox allows a nil Observer to be held in an atomic.Value.
+type observerBox struct {
+	Observer
+}
+
+func (c *Client) emit(event Event) {
+	c.stats.record(event)
+	if box, ok := c.observer.Load().(observerBox); ok && box.Observer != nil {
+		box.OnEvent(event)
+	}
+}
+
+func (c *Client) unsubscribe(handle *Handle) bool {
 	c.handleMutex.Lock()
 	for i := 0; i < len(c.handles); i++ {
 		if c.handles[i] == handle {
 			c.handles[i] = c.handles[len(c.handles)-1]
 			c.handles = c.handles[:len(c.handles)-1]
+			// Receipts not yet sent for the handle are dropped.
+			delete(c.receipts, handle)
 			c.handleMutex.Unlock()
 			return true
 		}
@@ -197,7 +283,33 @@ func (c *Client) Done(handle *Handle) bool {
 	return false
 }
 
-/** Private methods **/
+func (c *Client) poll(handle *Handle, sub *Subscription) error {
+	// Check if already polling.
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	for x := range c.handles {
+		if c.handles[x] == handle {
+			if c.Verbose {
+				c.log.Info.Println("Ignoring request to poll, because already polling.")
+			}
+			return errors.New("already polling handle")
+		}
+	}
+	if c.Verbose {
+		handle.log = c.log
+	}
+	if handle.drbg == nil {
+		if err := initHandle(handle); err != nil {
+			return err
+		}
+	}
+	if sub != nil {
+		handle.subscription = sub
+	}
+	c.handles = append(c.handles, handle)
+	return nil
+}
+
 func (c *Client) getConfig() error {
 	reply := new(common.Config)
 	if err := c.leader.GetConfig(nil, reply); err != nil {
@@ -213,8 +325,16 @@ func (c *Client) writePeriodic() {
 	var req *common.WriteArgs
 
 	for atomic.LoadInt32(&c.dead) == 0 {
-		reply := common.WriteReply{}
 		conf := c.config.Load().(ClientConfig)
+		clock := conf.clock()
+		//TODO: switch to poisson
+		clock.Sleep(conf.WriteInterval)
+		if atomic.LoadInt32(&c.dead) != 0 {
+			return
+		}
+
+		reply := common.WriteReply{}
+		event := Event{Type: EventWrite}
 		select {
 		case req = <-c.pendingWrites:
 			c.writeMutex.Lock()
@@ -225,20 +345,37 @@ func (c *Client) writePeriodic() {
 			c.writeMutex.Unlock()
 			break
 		default:
-			req = c.generateRandomWrite(conf)
+			// Pending receipts take the place of a cover write.
+			event.Cover = true
+			if req = c.generateReceiptWrite(conf); req == nil {
+				req = c.generateRandomWrite(conf)
+			} else {
+				event.Receipt = true
+			}
 		}
+		start := clock.Now()
 		err := c.leader.Write(req, &reply)
+		event.Latency = clock.Now().Sub(start)
 		if err != nil {
 			reply.Err = err.Error()
+			event.Err = err
 		}
-		if reply.GlobalSeqNo > c.lastSeqNo {
-			c.lastSeqNo = reply.GlobalSeqNo
-		}
+		c.emit(event)
+		c.observeSeqNo(reply.GlobalSeqNo)
 		if req.ReplyChan != nil {
 			req.ReplyChan <- &reply
 		}
-		//TODO: switch to poisson
-		time.Sleep(conf.WriteInterval)
+	}
+}
+
+// observeSeqNo raises lastSeqNo to seqNo, if it is higher. It is called by
+// both the read and write threads.
+func (c *Client) observeSeqNo(seqNo uint64) {
+	for {
+		last := atomic.LoadUint64(&c.lastSeqNo)
+		if seqNo <= last || atomic.CompareAndSwapUint64(&c.lastSeqNo, last, seqNo) {
+			return
+		}
 	}
 }
 
@@ -246,13 +383,25 @@ func (c *Client) readPeriodic() {
 	var req request
 
 	for atomic.LoadInt32(&c.dead) == 0 {
-		reply := common.ReadReply{}
 		conf := c.config.Load().(ClientConfig)
+		clock := conf.clock()
+		clock.Sleep(conf.ReadInterval)
+		if atomic.LoadInt32(&c.dead) != 0 {
+			return
+		}
+
+		reply := common.ReadReply{}
+		// Audits take the place of the next read made.
+		audit := c.audits.next()
 		select {
 		case req = <-c.pendingReads:
-			break
+			audit = nil
 		default:
-			req = c.nextRequest(&conf)
+			if audit != nil {
+				req = request{c.generateAuditRead(&conf, *audit), nil}
+			} else {
+				req = c.nextRequest(&conf)
+			}
 		}
 		if c.Verbose {
 			c.log.Info.Printf("Reading bucket %d\n", req.Bucket())
@@ -261,42 +410,80 @@ func (c *Client) readPeriodic() {
 		if err != nil {
 			reply.Err = err.Error()
 		} else {
+			start := clock.Now()
 			err := c.leader.Read(&encreq, &reply)
+			if err == nil && reply.Err == "" {
+				// Data combined from trust domains which served different
+				// databases can not be trusted.
+				if err = reply.VerifyRoots(conf.TrustDomains); err != nil {
+					c.log.Warn.Printf("Read could not be verified: %v\n", err)
+					reply = common.ReadReply{}
+				}
+			}
 			if err != nil {
 				reply.Err = err.Error()
 			}
+			c.emit(Event{Type: EventRead, Cover: req.Handle == nil, Latency: clock.Now().Sub(start), Err: err})
 		}
-		if reply.GlobalSeqNo.End > c.lastSeqNo {
-			c.lastSeqNo = reply.GlobalSeqNo.End
+		c.observeSeqNo(reply.GlobalSeqNo.End)
+		corrupt := false
+		if audit != nil {
+			c.onAuditReply(&conf, *audit, req.ReadArgs, &encreq, &reply)
+		} else if reply.Err == "" && req.Bucket() >= 0 && !checkRead(req.ReadArgs, reply.Data) {
+			// Unlike a missing message, a corrupted read is not tried again.
+			c.log.Warn.Printf("Read of bucket %d was corrupted.\n", req.Bucket())
+			c.emit(Event{Type: EventCorruptRead, Cover: req.Handle == nil})
+			c.startAudit(&conf)
+			corrupt = true
 		}
-		if req.Handle != nil {
-			req.Handle.OnResponse(req.ReadArgs, &reply, uint(conf.DataSize))
+		// Remove the check tag which follows the bucket.
+		if len(reply.Data) >= merkle.Size {
+			reply.Data = reply.Data[:len(reply.Data)-merkle.Size]
+		}
+		if req.Handle != nil && !corrupt {
+			seqno := req.Handle.Seqno
+			if req.Handle.OnResponse(req.ReadArgs, &reply, uint(conf.DataSize)) == readFailed {
+				c.emit(Event{Type: EventDecryptFailure})
+			} else if req.Handle.Seqno != seqno && req.Handle.Receipts != nil {
+				c.acknowledge(req.Handle, seqno, req.Handle.Seqno)
+			}
 		}
 		if reply.LastInterestSN != c.lastInterestSN {
 			c.pendingUpdates <- true
 		}
-		time.Sleep(conf.ReadInterval)
 	}
 }
 
 func (c *Client) updatePeriodic() {
 	var req common.GetUpdatesArgs
+	var tick <-chan time.Time
 
 	for atomic.LoadInt32(&c.dead) == 0 {
 		// every multiple * writeInterval unless
 		// triggered early to synchronize.
 		conf := c.config.Load().(ClientConfig)
+		clock := conf.clock()
+		// The timer is kept across early updates, so only one is outstanding.
+		if tick == nil {
+			tick = clock.After(time.Duration(conf.WriteInterval.Nanoseconds() * int64(conf.InterestMultiple)))
+		}
 
 		select {
 		case <-c.pendingUpdates:
-		case <-time.After(time.Duration(conf.WriteInterval.Nanoseconds() * int64(conf.InterestMultiple))):
+		case <-tick:
+			tick = nil
 			if c.Verbose {
 				c.log.Info.Printf("Fetching Global Interest Vector")
 			}
 		}
+		if atomic.LoadInt32(&c.dead) != 0 {
+			return
+		}
 
 		reply := common.GetUpdatesReply{}
-		c.leader.GetUpdates(&req, &reply)
+		start := clock.Now()
+		err := c.leader.GetUpdates(&req, &reply)
+		c.emit(Event{Type: EventInterestRefresh, Latency: clock.Now().Sub(start), Err: err})
 
 		// Decompress.
 		var decompressedInterest bytes.Buffer
@@ -332,6 +519,71 @@ func (c *Client) generateRandomWrite(config ClientConfig) *common.WriteArgs {
 	return args
 }
 
+// acknowledge queues receipts for the seqnos [start, end) consumed from handle.
+func (c *Client) acknowledge(handle *Handle, start uint64, end uint64) {
+	c.handleMutex.Lock()
+	batch, ok := c.receipts[handle]
+	if !ok {
+		batch = &receiptBatch{}
+		c.receipts[handle] = batch
+	}
+	for seqno := start; seqno < end; seqno++ {
+		batch.Add(seqno)
+	}
+	c.handleMutex.Unlock()
+}
+
+// followReceipts polls the receipt topic of a topic, delivering receipts to
+// its ReceiptEvents, unless it is already polled.
+func (c *Client) followReceipts(topic *Topic) {
+	handle := &topic.Receipts.Handle
+	c.handleMutex.Lock()
+	for _, h := range c.handles {
+		if h == handle {
+			c.handleMutex.Unlock()
+			return
+		}
+	}
+	if topic.receiptEvents == nil {
+		topic.receiptEvents = make(chan *Receipt, receiptEventsCapacity)
+	}
+	handle.receipts = topic.receiptEvents
+	c.handleMutex.Unlock()
+	c.poll(handle, nil)
+}
+
+// generateReceiptWrite publishes a batch of pending receipts to the receipt
+// topic of a handle, or returns nil if there are none.
+func (c *Client) generateReceiptWrite(config ClientConfig) *common.WriteArgs {
+	c.handleMutex.Lock()
+	defer c.handleMutex.Unlock()
+	// Receipts are sent in a single part of a message.
+	maxLength := int(config.DataSize) - PublishingOverhead - fragmentHeaderLength
+	for handle, batch := range c.receipts {
+		if maxLength < maxReceiptLength {
+			c.log.Warn.Printf("Items of %d bytes are too small to carry receipts.\n", config.DataSize)
+			delete(c.receipts, handle)
+			continue
+		}
+		data := batch.Take(maxLength)
+		if data == nil {
+			delete(c.receipts, handle)
+			continue
+		}
+		partSize := maxLength + fragmentHeaderLength
+		args, err := handle.Receipts.GeneratePublish(config.Config, newMessage(data).Split(partSize)[0])
+		if err != nil {
+			c.log.Warn.Printf("Failed to publish receipts: %v\n", err)
+			return nil
+		}
+		if c.Verbose {
+			c.log.Info.Printf("Sent receipts in place of a cover write.")
+		}
+		return args
+	}
+	return nil
+}
+
 func (c *Client) generateRandomRead(config *ClientConfig) *common.ReadArgs {
 	args := &common.ReadArgs{}
 	vectorSize := uint32((config.Config.NumBuckets+7)/8 + 1)
@@ -24,6 +24,16 @@ type ClientConfig struct {
 
 	// Where should the client connect?
 	FrontendAddr string
+
+	// Source of time for reads and writes. Defaults to common.SystemClock.
+	Clock common.Clock `json:"-"`
+}
+
+func (cc *ClientConfig) clock() common.Clock {
+	if cc.Clock == nil {
+		return common.SystemClock
+	}
+	return cc.Clock
 }
 
 // ClientConfigFromFile restores a client configuration from on-disk form.
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/merkle"
 	"github.com/privacylab/talek/pir/xor"
 )
 
@@ -39,11 +41,12 @@ func (m *mockLeader) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUp
 
 func TestWrite(t *testing.T) {
 	config := ClientConfig{
-		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
 		time.Second,
 		time.Second,
 		[]*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
 		"",
+		nil,
 	}
 
 	writes := make(chan *common.WriteArgs, 1)
@@ -75,7 +78,7 @@ func TestWrite(t *testing.T) {
 
 func TestRead(t *testing.T) {
 	config := ClientConfig{
-		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, LoadFactorStep: 0.05},
+		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
 		time.Second,
 		time.Second,
 		[]*common.TrustDomainConfig{
@@ -83,6 +86,7 @@ func TestRead(t *testing.T) {
 			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
 		},
 		"",
+		nil,
 	}
 
 	reads := make(chan *common.EncodedReadArgs, 1)
@@ -126,3 +130,173 @@ func TestRead(t *testing.T) {
 		t.Fatalf("Read wasn't for the enqueued subscription. %v / %v / %d", rv1, rv2, bucket)
 	}
 }
+
+// publishingLeader answers every read with a bucket holding a single message.
+// If equivocating, the last trust domain signs a different database root.
+type publishingLeader struct {
+	mockLeader
+	config     ClientConfig
+	message    []byte
+	equivocate bool
+}
+
+func (m *publishingLeader) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	bucket := make([]byte, m.config.BucketDepth*m.config.DataSize)
+	copy(bucket, m.message)
+	tag := merkle.Leaf(bucket)
+	reply.Data = append(bucket, tag[:]...)
+	for i, td := range m.config.TrustDomains {
+		pir, err := args.Decode(i, td)
+		if err != nil {
+			return err
+		}
+		drbg.Overlay(pir.PadSeed, reply.Data)
+		root := [32]byte{1}
+		if m.equivocate && i == len(m.config.TrustDomains)-1 {
+			root[0] = 2
+		}
+		signed, err := common.NewDBRoot(td, reply.Epoch, reply.GlobalSeqNo, root)
+		if err != nil {
+			return err
+		}
+		reply.Roots = append(reply.Roots, signed)
+	}
+	return nil
+}
+
+func TestReceipts(t *testing.T) {
+	config := ClientConfig{
+		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
+		time.Millisecond * 10,
+		time.Millisecond * 10,
+		[]*common.TrustDomainConfig{
+			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+		},
+		"",
+		nil,
+	}
+
+	topic, _ := NewTopic()
+	if err := topic.EnableReceipts(); err != nil {
+		t.Fatal(err)
+	}
+	txt, _ := topic.Handle.MarshalText()
+	handle, _ := NewHandle()
+	if err := handle.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	receiptBucket, _ := topic.Receipts.nextBuckets(config.Config)
+
+	// Prepare the message the reader will find.
+	part := newMessage([]byte("hello")).Split(int(config.DataSize - PublishingOverhead))[0]
+	published, err := topic.GeneratePublish(config.Config, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writes := make(chan *common.WriteArgs, 1)
+	leader := &publishingLeader{mockLeader{writes, nil}, config, published.Data, false}
+	c := NewClient("TestReceipts", config, leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	updates := c.Poll(handle)
+	if msg := <-updates; string(msg) != "hello" {
+		t.Fatalf("Read the wrong message: %v", msg)
+	}
+
+	// The acknowledgement replaces one of the following cover writes.
+	var receiptWrite *common.WriteArgs
+	for i := 0; i < 10 && receiptWrite == nil; i++ {
+		if w := <-writes; w.Bucket1 == receiptBucket {
+			receiptWrite = w
+		}
+	}
+	c.Kill()
+	if receiptWrite == nil {
+		t.Fatalf("Receipt was never written")
+	}
+	if len(receiptWrite.Data) != int(config.DataSize) {
+		t.Fatalf("Receipt write should look like a cover write")
+	}
+
+	var nonce [24]byte
+	plaintext, err := topic.Receipts.Decrypt(receiptWrite.Data, &nonce)
+	if err != nil {
+		t.Fatalf("Author could not decrypt receipt: %v", err)
+	}
+	receipt := message{}
+	if !receipt.Join(plaintext) {
+		t.Fatalf("Receipt did not fit in a single write")
+	}
+	receipts, err := decodeReceipts(receipt.Retrieve())
+	if err != nil || len(receipts) != 1 || receipts[0] != (Receipt{0, 1}) {
+		t.Fatalf("Unexpected receipts: %v %v", receipts, err)
+	}
+
+	// The author's client delivers the receipt as an event on the topic.
+	authorLeader := &publishingLeader{mockLeader{make(chan *common.WriteArgs, 16), nil}, config, receiptWrite.Data, false}
+	author := NewClient("TestReceiptsAuthor", config, authorLeader)
+	if author == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer author.Kill()
+	if events := author.PollReceipts(topic); events != topic.ReceiptEvents() {
+		t.Fatalf("Receipts should be delivered on the topic")
+	}
+	select {
+	case r := <-topic.ReceiptEvents():
+		if *r != (Receipt{0, 1}) {
+			t.Fatalf("Unexpected receipt event: %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Receipt event was never delivered")
+	}
+}
+
+func TestReadEquivocation(t *testing.T) {
+	config := ClientConfig{
+		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95},
+		time.Minute,
+		time.Millisecond * 10,
+		[]*common.TrustDomainConfig{
+			common.NewTrustDomainConfig("TestTrustDomain0", "127.0.0.1", true, false),
+			common.NewTrustDomainConfig("TestTrustDomain1", "127.0.0.1", true, false),
+		},
+		"",
+		nil,
+	}
+
+	topic, _ := NewTopic()
+	txt, _ := topic.Handle.MarshalText()
+	handle, _ := NewHandle()
+	if err := handle.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	part := newMessage([]byte("hello")).Split(int(config.DataSize - PublishingOverhead))[0]
+	published, err := topic.GeneratePublish(config.Config, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leader := &publishingLeader{mockLeader{}, config, published.Data, true}
+	c := NewClient("TestReadEquivocation", config, leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	defer c.Kill()
+	updates := c.Poll(handle)
+
+	for i := 0; c.Stats().RealReads < 3; i++ {
+		if i > 100 {
+			t.Fatalf("Reads should have been made")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	select {
+	case msg := <-updates:
+		t.Fatalf("A read from trust domains serving different databases was delivered: %v", msg)
+	default:
+	}
+}
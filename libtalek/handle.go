@@ -20,8 +20,8 @@ import (
 // Handle is the readable component of a Talek Log.
 // Handles are created by making a NewTopic, but can be independently
 // shared, and restored from a serialized state. A Handle is read
-// by calling Client.Poll(handle) to receive a channel with new messages
-// read from the Handle.
+// by calling Client.Subscribe(handle) to receive a Subscription with new
+// messages read from the Handle.
 type Handle struct {
 	// for random looking pir requests
 	drbg *drbg.HashDrbg
@@ -37,11 +37,18 @@ type Handle struct {
 	// Current log position
 	Seqno uint64
 
+	// Reverse topic on which consumed messages are acknowledged, if the
+	// author has asked for read receipts.
+	Receipts *Topic `json:",omitempty"`
+
 	// partially read message
 	partialMessage message
 
 	// Notifications of new messages
-	updates chan []byte
+	subscription *Subscription
+
+	// Notifications of receipts, when this handle reads a receipt topic
+	receipts chan *Receipt
 
 	// Hash function for interest vectors.
 	hasher hash.Hash
@@ -59,7 +66,6 @@ func NewHandle() (h *Handle, err error) {
 }
 
 func initHandle(h *Handle) (err error) {
-	h.updates = make(chan []byte)
 	h.hasher = sha256.New()
 
 	h.drbg, err = drbg.NewHashDrbg(nil)
@@ -145,35 +151,75 @@ func (h *Handle) Decrypt(cyphertext []byte, nonce *[24]byte) ([]byte, error) {
 	var sig [ed25519.SignatureSize]byte
 	copy(sig[:], cyphertext[cypherlen-ed25519.SignatureSize:])
 	if !ed25519.Verify(h.SigningPublicKey, message, &sig) {
-		return nil, errors.New("Invalid Signature")
+		return nil, errInvalidSignature
 	}
 
 	//decrypt
 	plaintext := make([]byte, 0, cypherlen-box.Overhead-ed25519.SignatureSize)
 	_, ok := box.OpenAfterPrecomputation(plaintext, message, nonce, h.SharedSecret)
 	if !ok {
-		return nil, errors.New("Failed to decrypt")
+		return nil, errDecryptFailed
 	}
 	return plaintext[0:cap(plaintext)], nil
 }
 
+var errInvalidSignature = errors.New("Invalid Signature")
+var errDecryptFailed = errors.New("Failed to decrypt")
+
+// readOutcome is what a read found of the next message of a handle.
+type readOutcome int
+
+const (
+	// readMissing is a read which did not find the message, as when it has
+	// not been written yet.
+	readMissing readOutcome = iota
+	// readFound is a read which yielded the message.
+	readFound
+	// readFailed is a read which found an item signed for the handle, but
+	// which could not be decrypted.
+	readFailed
+)
+
 // OnResponse processes a response for a request generated by generatePoll,
-// sending it to the handle's updates channel if valid.
-func (h *Handle) OnResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) {
-	msg := h.retrieveResponse(args, reply, dataSize)
+// delivering it to the handle's subscription if valid.
+func (h *Handle) OnResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) readOutcome {
+	msg, outcome := h.retrieveResponse(args, reply, dataSize)
 	if msg != nil {
 		h.Seqno++
 
 		if h.partialMessage.Join(msg) {
-			if h.updates != nil {
-				h.updates <- h.partialMessage.Retrieve()
+			if h.receipts != nil {
+				h.onReceipts(h.partialMessage.Retrieve())
+			} else if h.subscription != nil {
+				h.subscription.deliver(h.partialMessage.Retrieve())
 			}
 			h.partialMessage = message{}
 		}
 	}
+	return outcome
+}
+
+// onReceipts delivers a batch of receipts read from a receipt topic.
+func (h *Handle) onReceipts(msg []byte) {
+	receipts, err := decodeReceipts(msg)
+	if err != nil {
+		if h.log != nil {
+			h.log.Info.Printf("Failed to parse receipts: %v\n", err)
+		}
+		return
+	}
+	for i := range receipts {
+		select {
+		case h.receipts <- &receipts[i]:
+		default:
+			if h.log != nil {
+				h.log.Info.Printf("Dropped receipt, because receipts are not being consumed.\n")
+			}
+		}
+	}
 }
 
-func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) []byte {
+func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply, dataSize uint) ([]byte, readOutcome) {
 	data := reply.Data
 
 	// strip out the padding injected by trust domains.
@@ -182,10 +228,14 @@ func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply
 			if h.log != nil {
 				h.log.Info.Printf("Failed to remove pad on returned read: %v\n", err)
 			}
-			return nil
+			return nil, readFailed
 		}
 	}
 
+	// Items of other topics fail their signature check, and only a
+	// failure to decrypt an item signed for the handle is a failed read.
+	outcome := readMissing
+
 	var seqNoBytes [24]byte
 	_ = binary.PutUvarint(seqNoBytes[:], h.Seqno)
 
@@ -196,7 +246,9 @@ func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply
 			if h.log != nil {
 				h.log.Trace.Printf("Successful Decryption.\n")
 			}
-			return plaintext
+			return plaintext, readFound
+		} else if err == errDecryptFailed {
+			outcome = readFailed
 		}
 
 		if h.log != nil {
@@ -208,7 +260,7 @@ func (h *Handle) retrieveResponse(args *common.ReadArgs, reply *common.ReadReply
 				err)
 		}
 	}
-	return nil
+	return nil, outcome
 }
 
 // MarshalText is a compact textual representation of a handle
@@ -222,6 +274,13 @@ func (h *Handle) MarshalText() ([]byte, error) {
 		return nil, err
 	}
 	txt := fmt.Sprintf("%x.%x.%x.%x.%d", s1, s2, *h.SharedSecret, *h.SigningPublicKey, h.Seqno)
+	if h.Receipts != nil {
+		receipts, err := h.Receipts.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(txt+"."), receipts...), nil
+	}
 	return []byte(txt), nil
 }
 
@@ -240,12 +299,22 @@ func (h *Handle) UnmarshalText(text []byte) error {
 	copy(h.SigningPublicKey[:], pk)
 	h.Seed1 = &drbg.Seed{}
 	h.Seed2 = &drbg.Seed{}
+	if h.hasher == nil {
+		h.hasher = sha256.New()
+	}
 	if err := h.Seed1.UnmarshalBinary(s1); err != nil {
 		return err
 	}
 	if err := h.Seed2.UnmarshalBinary(s2); err != nil {
 		return err
 	}
+	// A receipt topic credential may follow the handle itself.
+	if parts := bytes.SplitN(text, []byte("."), 6); len(parts) == 6 {
+		h.Receipts = &Topic{}
+		if err := h.Receipts.UnmarshalText(parts[5]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -258,6 +327,13 @@ func Equal(a, b *Handle) bool {
 		!bytes.Equal(a.SigningPublicKey[:], b.SigningPublicKey[:]) {
 		return false
 	}
+	if (a.Receipts == nil) != (b.Receipts == nil) {
+		return false
+	}
+	if a.Receipts != nil && (!bytes.Equal(a.Receipts.SigningPrivateKey[:], b.Receipts.SigningPrivateKey[:]) ||
+		!Equal(&a.Receipts.Handle, &b.Receipts.Handle)) {
+		return false
+	}
 	if (drbg.Equal(a.Seed1, b.Seed1) && drbg.Equal(a.Seed2, b.Seed2)) || (drbg.Equal(a.Seed1, b.Seed2) && drbg.Equal(a.Seed2, b.Seed1)) {
 		return true
 	}
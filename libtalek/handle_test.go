@@ -10,7 +10,7 @@ import (
 
 func TestGeneratePoll(t *testing.T) {
 	fmt.Printf("TestGeneratePoll:\n")
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{&common.Config{}, 0, 0, nil, "", nil}
 	config.Config.NumBuckets = 1000000
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 
@@ -59,6 +59,39 @@ func TestSerialization(t *testing.T) {
 	}
 }
 
+func TestOnResponse(t *testing.T) {
+	config := &common.Config{NumBuckets: 64, BucketDepth: 2, DataSize: 256}
+	topic, _ := NewTopic()
+	txt, _ := topic.Handle.MarshalText()
+	h, _ := NewHandle()
+	if err := h.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	part := newMessage([]byte("hello")).Split(int(config.DataSize - PublishingOverhead))[0]
+	published, err := topic.GeneratePublish(config, part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := &common.ReadArgs{}
+	bucket := func(item []byte) *common.ReadReply {
+		data := make([]byte, config.BucketDepth*config.DataSize)
+		rand.Read(data)
+		copy(data[config.DataSize:], item)
+		return &common.ReadReply{Data: data}
+	}
+
+	if outcome := h.OnResponse(args, bucket(nil), uint(config.DataSize)); outcome != readMissing || h.Seqno != 0 {
+		t.Fatalf("A bucket without the message should be a miss, got %v", outcome)
+	}
+	if outcome := h.OnResponse(args, bucket(published.Data), uint(config.DataSize)); outcome != readFound || h.Seqno != 1 {
+		t.Fatalf("The message should be found, got %v", outcome)
+	}
+	// The item is signed for the handle, but not encrypted for its next seqno.
+	if outcome := h.OnResponse(args, bucket(published.Data), uint(config.DataSize)); outcome != readFailed || h.Seqno != 1 {
+		t.Fatalf("An item which fails to decrypt should be a failure, got %v", outcome)
+	}
+}
+
 func BenchmarkGeneratePollN10K(b *testing.B) {
 	HelperBenchmarkGeneratePoll(b, 10000/4)
 }
@@ -70,7 +103,7 @@ func BenchmarkGeneratePollN1M(b *testing.B) {
 }
 
 func HelperBenchmarkGeneratePoll(b *testing.B, NumBuckets uint64) {
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{&common.Config{}, 0, 0, nil, "", nil}
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 	config.Config.NumBuckets = NumBuckets
 
@@ -88,7 +121,7 @@ func HelperBenchmarkGeneratePoll(b *testing.B, NumBuckets uint64) {
 }
 
 func BenchmarkRetrieveResponse(b *testing.B) {
-	config := &ClientConfig{&common.Config{}, 0, 0, nil, ""}
+	config := &ClientConfig{&common.Config{}, 0, 0, nil, "", nil}
 	config.TrustDomains = make([]*common.TrustDomainConfig, 3)
 	config.Config.NumBuckets = 10
 
@@ -106,7 +139,7 @@ func BenchmarkRetrieveResponse(b *testing.B) {
 	// Start timing
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_ = h.retrieveResponse(args, reply, 1024)
+		_, _ = h.retrieveResponse(args, reply, 1024)
 	}
 
 }
@@ -0,0 +1,273 @@
+// Package loopback runs a complete Talek deployment inside the current process.
+//
+// A Loopback wires a server.Frontend directly to a set of server.Replicas,
+// without any RPC, and itself implements common.FrontendInterface. It is
+// intended for testing applications built on libtalek:
+//
+//	lb := loopback.New("test", loopback.DefaultConfig())
+//	defer lb.Close()
+//	client := libtalek.NewClient("client", lb.ClientConfig(), lb)
+package loopback
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/server"
+)
+
+// ErrClosed is returned by calls made to a Loopback after it has been closed.
+var ErrClosed = errors.New("loopback closed")
+
+// Config describes the shape and speed of a Loopback deployment.
+type Config struct {
+	*common.Config
+
+	// How many replicas (each in its own trust domain) to run
+	NumReplicas int
+	// PIR backing used by the replicas. A comma separated list partitions
+	// each replica's database across several backings.
+	Backing string
+	// How often the frontend advances the database epoch and flushes reads
+	ServerInterval time.Duration
+	// How often clients configured by ClientConfig read and write
+	ClientInterval time.Duration
+	// Source of time for the frontend, replicas and clients. Defaults to a
+	// common.VirtualClock which the Loopback advances as fast as it can.
+	Clock common.Clock
+}
+
+// DriveInterval is the real time the Loopback waits between firing timers
+// of its own VirtualClock, letting the woken goroutine run before the next.
+var DriveInterval = 100 * time.Microsecond
+
+// DefaultConfig provides a small, fast deployment with two trust domains,
+// where a published message can be read back within tens of virtual
+// milliseconds.
+func DefaultConfig() Config {
+	return Config{
+		Config: &common.Config{
+			NumBuckets:         64,
+			BucketDepth:        4,
+			DataSize:           256,
+			BloomFalsePositive: 0.05,
+			WriteInterval:      time.Millisecond * 5,
+			ReadInterval:       time.Millisecond * 5,
+			InterestMultiple:   10,
+			MaxLoadFactor:      0.95,
+		},
+		NumReplicas:    2,
+		Backing:        "cpu.0",
+		ServerInterval: time.Millisecond * 5,
+		ClientInterval: time.Millisecond * 5,
+	}
+}
+
+// Loopback is an in-process frontend and set of replicas.
+type Loopback struct {
+	name         string
+	config       Config
+	frontend     *server.Frontend
+	replicas     []*replica
+	trustDomains []*common.TrustDomainConfig
+
+	// The clock driven by the Loopback itself, if one was not configured.
+	clock *common.VirtualClock
+	done  chan struct{}
+
+	lock   sync.RWMutex
+	closed bool
+}
+
+// replica guards a server.Replica so that calls from the frontend's
+// background threads after Close are refused rather than left blocked.
+type replica struct {
+	*server.Replica
+	lock   sync.RWMutex
+	closed bool
+}
+
+// New starts a Loopback deployment. It returns nil if config is invalid.
+func New(name string, config Config) *Loopback {
+	if config.Config == nil || config.NumReplicas < 1 {
+		return nil
+	}
+	l := &Loopback{}
+	l.name = name
+	if config.Clock == nil {
+		l.clock = common.NewVirtualClock(time.Now())
+		l.done = make(chan struct{})
+		config.Clock = l.clock
+		go l.drive()
+	}
+	l.config = config
+
+	l.trustDomains = make([]*common.TrustDomainConfig, config.NumReplicas)
+	l.replicas = make([]*replica, config.NumReplicas)
+	replicas := make([]common.ReplicaInterface, config.NumReplicas)
+	for i := 0; i < config.NumReplicas; i++ {
+		replicaName := fmt.Sprintf("%s-t%d", name, i)
+		l.trustDomains[i] = common.NewTrustDomainConfig(replicaName, "loopback", true, false)
+		replicaConfig := server.Config{
+			Config:           config.Config,
+			ReadBatch:        1,
+			WriteInterval:    config.ServerInterval,
+			ReadInterval:     config.ServerInterval,
+			TrustDomain:      l.trustDomains[i],
+			TrustDomainIndex: i,
+			Clock:            config.Clock,
+		}
+		r := server.NewReplica(replicaName, config.Backing, replicaConfig)
+		if r == nil {
+			l.Close()
+			return nil
+		}
+		l.replicas[i] = &replica{Replica: r}
+		replicas[i] = l.replicas[i]
+	}
+
+	frontendConfig := &server.Config{
+		Config:        config.Config,
+		ReadBatch:     1,
+		WriteInterval: config.ServerInterval,
+		ReadInterval:  config.ServerInterval,
+		TrustDomain:   common.NewTrustDomainConfig(name+"-f0", "loopback", true, false),
+		Clock:         config.Clock,
+	}
+	l.frontend = server.NewFrontend(name+"-f0", frontendConfig, replicas)
+	return l
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// ClientConfig returns a configuration for libtalek clients of this Loopback.
+func (l *Loopback) ClientConfig() libtalek.ClientConfig {
+	return libtalek.ClientConfig{
+		Config:        l.config.Config,
+		WriteInterval: l.config.ClientInterval,
+		ReadInterval:  l.config.ClientInterval,
+		TrustDomains:  l.trustDomains,
+		Clock:         l.config.Clock,
+	}
+}
+
+// Close stops the frontend and replicas. Clients using the Loopback should
+// be killed first; any further calls will return ErrClosed.
+func (l *Loopback) Close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	if l.frontend != nil {
+		l.frontend.Close()
+	}
+	for _, r := range l.replicas {
+		if r != nil {
+			r.close()
+		}
+	}
+	if l.clock != nil {
+		// Let any remaining waiters on the clock run to completion.
+		close(l.done)
+		l.clock.Stop()
+	}
+}
+
+// GetName returns the name of the Loopback.
+func (l *Loopback) GetName(args *interface{}, reply *string) error {
+	*reply = l.name
+	return nil
+}
+
+// GetConfig returns the common configuration of the deployment.
+func (l *Loopback) GetConfig(args *interface{}, reply *common.Config) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.frontend.GetConfig(args, reply)
+}
+
+// Write serializes a client write to the replicas.
+func (l *Loopback) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.frontend.Write(args, reply)
+}
+
+// Read performs a PIR read against the replicas.
+func (l *Loopback) Read(args *common.EncodedReadArgs, reply *common.ReadReply) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.frontend.Read(args, reply)
+}
+
+// GetUpdates provides the current global interest vector.
+func (l *Loopback) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpdatesReply) error {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.frontend.GetUpdates(args, reply)
+}
+
+/** Private methods **/
+
+// drive advances the Loopback's own clock one timer at a time until closed.
+func (l *Loopback) drive() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-time.After(DriveInterval):
+			l.clock.Step()
+		}
+	}
+}
+
+func (r *replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		reply.Err = ErrClosed.Error()
+		return nil
+	}
+	return r.Replica.Write(args, reply)
+}
+
+func (r *replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		// The frontend treats errors as fatal, so answer with empty replies.
+		reply.Replies = make([]common.ReadReply, len(args.Args))
+		for i := range reply.Replies {
+			reply.Replies[i].Err = ErrClosed.Error()
+		}
+		return nil
+	}
+	return r.Replica.BatchRead(args, reply)
+}
+
+func (r *replica) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.closed {
+		r.closed = true
+		r.Replica.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package loopback
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+)
+
+func TestPublishPoll(t *testing.T) {
+	lb := New("TestPublishPoll", DefaultConfig())
+	if lb == nil {
+		t.Fatalf("Error creating loopback")
+	}
+	defer lb.Close()
+
+	writer := libtalek.NewClient("writer", lb.ClientConfig(), lb)
+	reader := libtalek.NewClient("reader", lb.ClientConfig(), lb)
+	if writer == nil || reader == nil {
+		t.Fatalf("Error creating clients")
+	}
+	defer writer.Kill()
+	defer reader.Kill()
+
+	topic, err := libtalek.NewTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+	handle := topic.Handle
+
+	if err := writer.Publish(topic, []byte("hello world")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	messages := reader.Poll(&handle)
+	select {
+	case msg := <-messages:
+		if !bytes.Equal(msg, []byte("hello world")) {
+			t.Fatalf("Read unexpected message: %v", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Message was not delivered.")
+	}
+}
+
+func TestClose(t *testing.T) {
+	lb := New("TestClose", DefaultConfig())
+	if lb == nil {
+		t.Fatalf("Error creating loopback")
+	}
+	var config common.Config
+	if err := lb.GetConfig(nil, &config); err != nil || config.NumBuckets != DefaultConfig().NumBuckets {
+		t.Fatalf("Unexpected config %v: %v", config, err)
+	}
+	lb.Close()
+	lb.Close()
+
+	if err := lb.Write(&common.WriteArgs{}, &common.WriteReply{}); err != ErrClosed {
+		t.Fatalf("Write after close should fail, got %v", err)
+	}
+}
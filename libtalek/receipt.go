@@ -0,0 +1,89 @@
+package libtalek
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Receipt acknowledges that a reader of a topic has consumed a contiguous
+// run of its messages. Receipts are delivered to topic authors as events on
+// the topic, through Topic.ReceiptEvents.
+type Receipt struct {
+	Start uint64 // inclusive
+	End   uint64 // exclusive
+}
+
+// receiptFlag prefixes the wire form of a batch of receipts.
+const receiptFlag = byte('R')
+
+// maxReceiptLength is the most bytes needed to send a single receipt.
+const maxReceiptLength = 1 + 2*binary.MaxVarintLen64
+
+// receiptBatch accumulates seqnos consumed by a reader until they can be
+// folded into a cover write.
+type receiptBatch struct {
+	pending []Receipt
+}
+
+// Add records that seqno has been consumed, extending the last pending run
+// where possible.
+func (b *receiptBatch) Add(seqno uint64) {
+	if n := len(b.pending); n > 0 && b.pending[n-1].End == seqno {
+		b.pending[n-1].End++
+		return
+	}
+	b.pending = append(b.pending, Receipt{Start: seqno, End: seqno + 1})
+}
+
+// Empty indicates if there are receipts waiting to be sent.
+func (b *receiptBatch) Empty() bool {
+	return len(b.pending) == 0
+}
+
+// Take encodes as many pending receipts as fit in maxLength bytes, and
+// removes them from the batch. It returns nil if none fit.
+func (b *receiptBatch) Take(maxLength int) []byte {
+	if maxLength < 1 {
+		return nil
+	}
+	buf := make([]byte, 1, maxLength)
+	buf[0] = receiptFlag
+	var scratch [2 * binary.MaxVarintLen64]byte
+	taken := 0
+	for _, r := range b.pending {
+		n := binary.PutUvarint(scratch[:], r.Start)
+		n += binary.PutUvarint(scratch[n:], r.End-r.Start)
+		if len(buf)+n > maxLength {
+			break
+		}
+		buf = append(buf, scratch[:n]...)
+		taken++
+	}
+	if taken == 0 {
+		return nil
+	}
+	b.pending = b.pending[taken:]
+	return buf
+}
+
+// decodeReceipts parses the wire form of a batch of receipts.
+func decodeReceipts(msg []byte) ([]Receipt, error) {
+	if len(msg) < 1 || msg[0] != receiptFlag {
+		return nil, errors.New("not a receipt message")
+	}
+	receipts := make([]Receipt, 0)
+	for rest := msg[1:]; len(rest) > 0; {
+		start, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, errors.New("malformed receipt")
+		}
+		rest = rest[n:]
+		count, n := binary.Uvarint(rest)
+		if n <= 0 || count == 0 {
+			return nil, errors.New("malformed receipt")
+		}
+		rest = rest[n:]
+		receipts = append(receipts, Receipt{Start: start, End: start + count})
+	}
+	return receipts, nil
+}
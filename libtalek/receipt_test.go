@@ -0,0 +1,88 @@
+package libtalek
+
+import (
+	"testing"
+)
+
+func TestReceiptBatch(t *testing.T) {
+	batch := receiptBatch{}
+	if !batch.Empty() {
+		t.Fatalf("new batch should be empty")
+	}
+	for _, seqno := range []uint64{0, 1, 2, 5, 6, 9} {
+		batch.Add(seqno)
+	}
+	if len(batch.pending) != 3 {
+		t.Fatalf("consecutive seqnos should be coalesced: %v", batch.pending)
+	}
+
+	msg := batch.Take(64)
+	if !batch.Empty() {
+		t.Fatalf("all receipts should fit in a single message")
+	}
+	receipts, err := decodeReceipts(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Receipt{{0, 3}, {5, 7}, {9, 10}}
+	if len(receipts) != len(expected) {
+		t.Fatalf("wrong number of receipts decoded: %v", receipts)
+	}
+	for i := range expected {
+		if receipts[i] != expected[i] {
+			t.Fatalf("receipt %d decoded as %v, expected %v", i, receipts[i], expected[i])
+		}
+	}
+}
+
+func TestReceiptBatchOverflow(t *testing.T) {
+	batch := receiptBatch{}
+	for seqno := uint64(0); seqno < 100; seqno += 2 {
+		batch.Add(seqno)
+	}
+	msg := batch.Take(11)
+	receipts, err := decodeReceipts(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 5 || batch.Empty() {
+		t.Fatalf("receipts that don't fit should remain pending")
+	}
+	if batch.pending[0].Start != 10 {
+		t.Fatalf("pending receipts should resume after those taken: %v", batch.pending[0])
+	}
+	if batch.Take(2) != nil || batch.pending[0].Start != 10 {
+		t.Fatalf("nothing should be taken when no receipt fits")
+	}
+}
+
+func TestReceiptSerialization(t *testing.T) {
+	topic, _ := NewTopic()
+	if err := topic.EnableReceipts(); err != nil {
+		t.Fatal(err)
+	}
+
+	txt, err := topic.Handle.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := NewHandle()
+	if err = h.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	if h.Receipts == nil || !Equal(&topic.Handle, h) {
+		t.Fatalf("serialization lost the receipt topic")
+	}
+
+	txt, err = topic.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := Topic{}
+	if err = clone.UnmarshalText(txt); err != nil {
+		t.Fatal(err)
+	}
+	if clone.Receipts == nil || !Equal(&topic.Handle, &clone.Handle) {
+		t.Fatalf("topic serialization lost the receipt topic")
+	}
+}
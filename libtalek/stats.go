@@ -0,0 +1,136 @@
+package libtalek
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats is a snapshot of the activity of a Client.
+// Stats are kept only in memory. The client never sends them to the
+// frontend or anywhere else, since they describe which reads and writes
+// were real.
+type Stats struct {
+	RealReads          uint64 // Reads made for a polled handle
+	CoverReads         uint64 // Random reads made when no handle was polled
+	RealWrites         uint64 // Writes of published messages
+	ReceiptWrites      uint64 // Writes of receipts in place of cover writes
+	CoverWrites        uint64 // Random writes
+	DecryptFailures    uint64 // Real reads that found a message which failed to decrypt
+	CorruptReads       uint64 // Reads answered incorrectly by a trust domain
+	UnattributedFaults uint64 // Audits which could not name the trust domain at fault
+	InterestRefreshes  uint64 // Global interest vectors fetched
+	PendingWrites      int    // Published message parts waiting to be written
+	PendingReads       int    // Reads waiting to be made
+
+	ReadLatency   LatencyStats
+	WriteLatency  LatencyStats
+	UpdateLatency LatencyStats
+}
+
+// LatencyStats summarizes the latency of a kind of RPC to the frontend.
+type LatencyStats struct {
+	Count uint64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean returns the average latency of the observed RPCs.
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+func (l *LatencyStats) add(latency time.Duration) {
+	l.Count++
+	l.Total += latency
+	if latency > l.Max {
+		l.Max = latency
+	}
+}
+
+// EventType identifies what a client did in an Event.
+type EventType int
+
+const (
+	// EventRead is a completed read RPC.
+	EventRead EventType = iota
+	// EventWrite is a completed write RPC.
+	EventWrite
+	// EventDecryptFailure is a real read that found an item signed for the
+	// handle, which could not be decrypted.
+	EventDecryptFailure
+	// EventInterestRefresh is a completed fetch of the global interest vector.
+	EventInterestRefresh
+	// EventCorruptRead is a read whose response failed its check.
+	EventCorruptRead
+	// EventFaultyTrustDomain names the trust domain found by audits to have
+	// corrupted a read.
+	EventFaultyTrustDomain
+	// EventUnattributedFault is an audit, begun after a corrupted read, which
+	// could not name the trust domain responsible.
+	EventUnattributedFault
+)
+
+// Event describes a single action taken by a Client.
+type Event struct {
+	Type    EventType
+	Cover   bool          // The read or write was cover traffic
+	Receipt bool          // The cover write carried read receipts
+	Latency time.Duration // Time taken by the RPC, if any
+	Err     error
+	// The faulty trust domain, for EventFaultyTrustDomain
+	TrustDomain string
+}
+
+// Observer receives events as a Client performs them. Observers are called
+// synchronously from the client's internal goroutines, and so should return
+// quickly to avoid changing the timing of reads and writes.
+type Observer interface {
+	OnEvent(event Event)
+}
+
+// clientStats is the mutable form of Stats held by a Client.
+type clientStats struct {
+	lock  sync.Mutex
+	stats Stats
+}
+
+func (s *clientStats) record(event Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch event.Type {
+	case EventRead:
+		if event.Cover {
+			s.stats.CoverReads++
+		} else {
+			s.stats.RealReads++
+		}
+		s.stats.ReadLatency.add(event.Latency)
+	case EventWrite:
+		if event.Receipt {
+			s.stats.ReceiptWrites++
+		} else if event.Cover {
+			s.stats.CoverWrites++
+		} else {
+			s.stats.RealWrites++
+		}
+		s.stats.WriteLatency.add(event.Latency)
+	case EventDecryptFailure:
+		s.stats.DecryptFailures++
+	case EventCorruptRead:
+		s.stats.CorruptReads++
+	case EventUnattributedFault:
+		s.stats.UnattributedFaults++
+	case EventInterestRefresh:
+		s.stats.InterestRefreshes++
+		s.stats.UpdateLatency.add(event.Latency)
+	}
+}
+
+func (s *clientStats) snapshot() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
+}
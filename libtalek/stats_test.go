@@ -0,0 +1,78 @@
+package libtalek
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+type eventRecorder struct {
+	events chan Event
+}
+
+func (r *eventRecorder) OnEvent(event Event) {
+	select {
+	case r.events <- event:
+	default:
+	}
+}
+
+func TestStats(t *testing.T) {
+	config := ClientConfig{
+		&common.Config{NumBuckets: 64, BucketDepth: 4, DataSize: 1024, BloomFalsePositive: 0.05, MaxLoadFactor: 0.95, InterestMultiple: 10},
+		time.Millisecond * 10,
+		time.Millisecond * 10,
+		[]*common.TrustDomainConfig{common.NewTrustDomainConfig("TestTrustDomain", "127.0.0.1", true, false)},
+		"",
+		nil,
+	}
+
+	leader := mockLeader{}
+	c := NewClient("TestStats", config, &leader)
+	if c == nil {
+		t.Fatalf("Error creating client")
+	}
+	recorder := &eventRecorder{make(chan Event, 100)}
+	c.SetObserver(recorder)
+
+	sawRead, sawWrite := false, false
+	for !sawRead || !sawWrite {
+		select {
+		case e := <-recorder.events:
+			if e.Type == EventRead && e.Cover {
+				sawRead = true
+			} else if e.Type == EventWrite && e.Cover {
+				sawWrite = true
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Observer was not notified of cover traffic.")
+		}
+	}
+
+	topic, _ := NewTopic()
+	if err := c.Publish(topic, []byte("hello world")); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+	c.Flush()
+	// The write is dequeued before it is made, so wait for it to be recorded.
+	for i := 0; c.Stats().RealWrites == 0; i++ {
+		if i > 100 {
+			t.Fatalf("Real write was not counted.")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.SetObserver(nil)
+	c.Kill()
+
+	stats := c.Stats()
+	if stats.CoverReads == 0 || stats.CoverWrites == 0 {
+		t.Fatalf("Cover traffic was not counted: %+v", stats)
+	}
+	if stats.RealReads != 0 || stats.DecryptFailures != 0 {
+		t.Fatalf("Reads counted as real without a polled handle: %+v", stats)
+	}
+	if stats.ReadLatency.Count != stats.CoverReads {
+		t.Fatalf("Latency not recorded for each read: %+v", stats)
+	}
+}
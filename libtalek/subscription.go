@@ -0,0 +1,158 @@
+package libtalek
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSubscriptionClosed is returned by Subscription.Next once a subscription
+// has been closed and all buffered messages have been consumed.
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// OverflowPolicy determines what a Subscription does with a new message when
+// its buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the newly read message.
+	DropNewest
+	// Block waits for room in the buffer, so no message is lost, but reads
+	// of every handle are delayed while the subscription is not consumed.
+	Block
+)
+
+// SubscriptionConfig controls buffering of a Subscription.
+type SubscriptionConfig struct {
+	// How many messages can be buffered before Overflow applies
+	Capacity int
+	// What to do with messages that arrive when the buffer is full
+	Overflow OverflowPolicy
+}
+
+// DefaultSubscriptionConfig buffers recent messages without ever delaying
+// the client's reads.
+var DefaultSubscriptionConfig = SubscriptionConfig{
+	Capacity: 16,
+	Overflow: DropOldest,
+}
+
+// PollSubscriptionConfig is used by Client.Poll, which loses no messages.
+var PollSubscriptionConfig = SubscriptionConfig{
+	Capacity: 1,
+	Overflow: Block,
+}
+
+// Subscription delivers the messages read from a Handle.
+// Unless its OverflowPolicy is Block, delivery never blocks the client:
+// reads continue on schedule regardless of how quickly messages are
+// consumed, and messages that don't fit in the buffer are handled by the
+// configured OverflowPolicy.
+type Subscription struct {
+	client   *Client
+	handle   *Handle
+	overflow OverflowPolicy
+
+	lock      sync.Mutex
+	closed    bool
+	done      chan struct{} // Closed first on close, releasing a blocked deliver
+	closeOnce sync.Once
+	messages  chan []byte
+	dropped   uint64 // Use atomic.AddUint64, atomic.LoadUint64
+}
+
+func newSubscription(c *Client, handle *Handle, config SubscriptionConfig) *Subscription {
+	s := &Subscription{}
+	s.client = c
+	s.handle = handle
+	s.overflow = config.Overflow
+	capacity := config.Capacity
+	if capacity < 1 {
+		capacity = 1
+	}
+	s.done = make(chan struct{})
+	s.messages = make(chan []byte, capacity)
+	return s
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// Next blocks until a message is available, the context is done, or the
+// subscription is closed.
+func (s *Subscription) Next(ctx context.Context) ([]byte, error) {
+	select {
+	case msg, ok := <-s.messages:
+		if !ok {
+			return nil, ErrSubscriptionClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Messages provides the buffered messages as a channel, which is closed
+// when the subscription is closed.
+func (s *Subscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+// Dropped returns how many messages have been discarded due to overflow.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops polling the handle. Messages already buffered remain
+// available to Next and Messages.
+func (s *Subscription) Close() {
+	s.client.unsubscribe(s.handle)
+	s.close()
+}
+
+/** Private methods **/
+
+// deliver buffers a message, blocking only with the Block policy.
+func (s *Subscription) deliver(msg []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.messages <- msg:
+		return
+	default:
+	}
+	if s.overflow == Block {
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+		}
+		return
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+	if s.overflow == DropNewest {
+		return
+	}
+	// Only deliver holds the send side, so after removing the oldest message
+	// there is guaranteed to be room.
+	select {
+	case <-s.messages:
+	default:
+	}
+	s.messages <- msg
+}
+
+func (s *Subscription) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.messages)
+	}
+}
@@ -0,0 +1,126 @@
+package libtalek
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+func TestSubscriptionOverflow(t *testing.T) {
+	c := &Client{}
+	handle, _ := NewHandle()
+
+	oldest := newSubscription(c, handle, SubscriptionConfig{Capacity: 2, Overflow: DropOldest})
+	newest := newSubscription(c, handle, SubscriptionConfig{Capacity: 2, Overflow: DropNewest})
+	for _, msg := range []string{"a", "b", "c"} {
+		oldest.deliver([]byte(msg))
+		newest.deliver([]byte(msg))
+	}
+	if oldest.Dropped() != 1 || newest.Dropped() != 1 {
+		t.Fatalf("overflow should be counted")
+	}
+
+	ctx := context.Background()
+	if msg, _ := oldest.Next(ctx); string(msg) != "b" {
+		t.Fatalf("DropOldest should discard the first message, got %s", msg)
+	}
+	if msg, _ := newest.Next(ctx); string(msg) != "a" {
+		t.Fatalf("DropNewest should keep the first message, got %s", msg)
+	}
+	if msg, _ := newest.Next(ctx); string(msg) != "b" {
+		t.Fatalf("DropNewest should keep the second message, got %s", msg)
+	}
+}
+
+func TestSubscriptionBlock(t *testing.T) {
+	c := &Client{}
+	handle, _ := NewHandle()
+	sub := newSubscription(c, handle, PollSubscriptionConfig)
+
+	sub.deliver([]byte("a"))
+	delivered := make(chan bool)
+	go func() {
+		sub.deliver([]byte("b"))
+		delivered <- true
+	}()
+	select {
+	case <-delivered:
+		t.Fatalf("Block should wait for room in the buffer")
+	case <-time.After(10 * time.Millisecond):
+	}
+	ctx := context.Background()
+	if msg, _ := sub.Next(ctx); string(msg) != "a" {
+		t.Fatalf("Block should keep the first message, got %s", msg)
+	}
+	<-delivered
+	if msg, _ := sub.Next(ctx); string(msg) != "b" || sub.Dropped() != 0 {
+		t.Fatalf("Block should keep the second message, got %s", msg)
+	}
+
+	// Closing releases a blocked delivery.
+	sub.deliver([]byte("c"))
+	go func() {
+		sub.deliver([]byte("d"))
+		delivered <- true
+	}()
+	sub.close()
+	<-delivered
+}
+
+func TestSubscriptionNext(t *testing.T) {
+	c := &Client{}
+	handle, _ := NewHandle()
+	sub := newSubscription(c, handle, DefaultSubscriptionConfig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := sub.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Next should respect the context: %v", err)
+	}
+
+	sub.deliver([]byte("hello"))
+	sub.close()
+	sub.deliver([]byte("ignored"))
+	if msg, err := sub.Next(context.Background()); err != nil || string(msg) != "hello" {
+		t.Fatalf("buffered messages should survive close: %s %v", msg, err)
+	}
+	if _, err := sub.Next(context.Background()); err != ErrSubscriptionClosed {
+		t.Fatalf("Next should report the closed subscription: %v", err)
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	c := &Client{receipts: make(map[*Handle]*receiptBatch)}
+	handle, _ := NewTopic()
+	sub, err := c.Subscribe(&handle.Handle, SubscriptionConfig{Capacity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Subscribe(&handle.Handle, DefaultSubscriptionConfig); err == nil {
+		t.Fatalf("a handle should only be subscribed once")
+	}
+	c.receipts[&handle.Handle] = &receiptBatch{}
+	sub.Close()
+	if len(c.handles) != 0 {
+		t.Fatalf("closing a subscription should stop polling")
+	}
+	if len(c.receipts) != 0 {
+		t.Fatalf("closing a subscription should drop pending receipts")
+	}
+	if _, ok := <-sub.Messages(); ok {
+		t.Fatalf("messages channel should be closed")
+	}
+	if c.Done(&handle.Handle) {
+		t.Fatalf("handle should no longer be polled")
+	}
+
+	c.log = common.NewLogger("TestSubscriptionClose")
+	if c.Poll(&handle.Handle) == nil {
+		t.Fatalf("Poll should return a channel")
+	}
+	if _, ok := <-c.Poll(&handle.Handle); ok {
+		t.Fatalf("polling a handle twice should return a closed channel")
+	}
+}
@@ -3,9 +3,11 @@ package libtalek
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/agl/ed25519"
 	"github.com/privacylab/talek/common"
@@ -27,39 +29,57 @@ type Topic struct {
 	SigningPrivateKey *[64]byte `json:",omitempty"`
 
 	Handle
+
+	// Receipts read back from readers, when receipts are enabled
+	receiptEvents chan *Receipt
 }
 
+// receiptEventsCapacity is how many receipts wait for the author to consume
+// them before further receipts are dropped.
+const receiptEventsCapacity = 16
+
 // PublishingOverhead represents the number of additional bytes used by encryption and signing.
 const PublishingOverhead = box.Overhead + ed25519.SignatureSize
 
 // NewTopic creates a new Topic, or fails if the system randomness isn't
 // appropriately configured.
 func NewTopic() (t *Topic, err error) {
+	return NewTopicFrom(rand.Reader)
+}
+
+// NewTopicFrom creates a new Topic using randomness from rand. The Topic is
+// only as secret as the source, so this is intended for reproducible
+// testing; applications should use NewTopic.
+func NewTopicFrom(rand io.Reader) (t *Topic, err error) {
 	t = &Topic{}
 
 	// Random values
 	id := make([]byte, 8)
-	if _, err = rand.Read(id); err != nil {
-		return
-	}
-	seed1, err := drbg.NewSeed()
-	if err != nil {
+	if _, err = io.ReadFull(rand, id); err != nil {
 		return
 	}
-	seed2, err := drbg.NewSeed()
-	if err != nil {
-		return
+	seeds := make([]*drbg.Seed, 3)
+	for i := range seeds {
+		seedBytes := make([]byte, drbg.SeedLength)
+		if _, err = io.ReadFull(rand, seedBytes); err != nil {
+			return
+		}
+		seeds[i] = &drbg.Seed{}
+		if err = seeds[i].UnmarshalBinary(seedBytes); err != nil {
+			return
+		}
 	}
 
 	t.ID, _ = binary.Uvarint(id[0:8])
-	t.Handle.Seed1 = seed1
-	t.Handle.Seed2 = seed2
-	if err = initHandle(&t.Handle); err != nil {
+	t.Handle.Seed1 = seeds[0]
+	t.Handle.Seed2 = seeds[1]
+	t.Handle.hasher = sha256.New()
+	if t.Handle.drbg, err = drbg.NewHashDrbg(seeds[2]); err != nil {
 		return
 	}
 
 	// Create shared secret
-	pub, priv, err := box.GenerateKey(rand.Reader)
+	pub, priv, err := box.GenerateKey(rand)
 	if err != nil {
 		return
 	}
@@ -69,11 +89,34 @@ func NewTopic() (t *Topic, err error) {
 	t.Handle.SharedSecret = &sharedKey
 
 	// Create signing secrets
-	t.Handle.SigningPublicKey, t.SigningPrivateKey, err = ed25519.GenerateKey(rand.Reader)
+	t.Handle.SigningPublicKey, t.SigningPrivateKey, err = ed25519.GenerateKey(rand)
 
 	return
 }
 
+// EnableReceipts attaches a fresh reverse topic to the handle of this topic.
+// Readers given the handle afterwards will acknowledge the messages they
+// consume. A client which publishes to the topic follows those
+// acknowledgements, and delivers them through ReceiptEvents. Receipts from
+// different readers share the sequence
+// numbers of the reverse topic, so they are only reliable when the handle is
+// shared with a single reader.
+func (t *Topic) EnableReceipts() error {
+	receipts, err := NewTopic()
+	if err != nil {
+		return err
+	}
+	t.Handle.Receipts = receipts
+	t.receiptEvents = make(chan *Receipt, receiptEventsCapacity)
+	return nil
+}
+
+// ReceiptEvents returns the channel on which receipts for the topic are
+// delivered, or nil if receipts are not enabled.
+func (t *Topic) ReceiptEvents() <-chan *Receipt {
+	return t.receiptEvents
+}
+
 // GeneratePublish creates a set of write args for writing message as the next
 // entry in this topic log.
 func (t *Topic) GeneratePublish(commonConfig *common.Config, message []byte) (*common.WriteArgs, error) {
@@ -141,5 +184,11 @@ func (t *Topic) UnmarshalText(text []byte) error {
 		return err
 	}
 	copy(t.SigningPrivateKey[:], spk)
-	return t.Handle.UnmarshalText(parts[1])
+	if err := t.Handle.UnmarshalText(parts[1]); err != nil {
+		return err
+	}
+	if t.Receipts != nil && t.receiptEvents == nil {
+		t.receiptEvents = make(chan *Receipt, receiptEventsCapacity)
+	}
+	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	mrand "math/rand"
 	"testing"
 
 	"github.com/privacylab/talek/common"
@@ -196,3 +197,26 @@ func HelperBenchmarkGeneratePublish(b *testing.B, BucketDepth int) {
 		_, _ = th.GeneratePublish(config, plaintext)
 	}
 }
+
+func TestNewTopicFrom(t *testing.T) {
+	fmt.Printf("TestNewTopicFrom:\n")
+	a, err := NewTopicFrom(mrand.New(mrand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	b, err := NewTopicFrom(mrand.New(mrand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("Error creating topic: %v\n", err)
+	}
+	if a.ID != b.ID || !Equal(&a.Handle, &b.Handle) || *a.SigningPrivateKey != *b.SigningPrivateKey {
+		t.Fatalf("Topics from the same seed should match")
+	}
+
+	args, err := a.GeneratePublish(&common.Config{NumBuckets: 64, DataSize: 256}, []byte("hello world"))
+	if err != nil {
+		t.Fatalf("Error publishing to seeded topic: %v\n", err)
+	}
+	if args.Bucket1 >= 64 || args.Bucket2 >= 64 {
+		t.Fatalf("Publish to invalid bucket")
+	}
+}
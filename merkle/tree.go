@@ -0,0 +1,175 @@
+// Package merkle computes merkle roots over a byte array divided into fixed
+// size leaves, such as the buckets of the talek database.
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// Size is the length of a node hash.
+const Size = sha256.Size
+
+// Leaves and interior nodes are hashed with distinct prefixes, so that a leaf
+// cannot be passed off as an interior node.
+const (
+	leafPrefix     = 0
+	interiorPrefix = 1
+)
+
+// Tree maintains the hashes of a merkle tree, so that the root can be
+// recomputed as individual leaves change.
+type Tree struct {
+	// Nodes in heap order: the root is at 1, and the children of node i are
+	// at 2i and 2i+1. Leaves begin at width, padded to a power of two with
+	// zero hashes.
+	nodes  [][Size]byte
+	width  int
+	leaves int
+}
+
+// NewTree builds a tree over data, divided into leaves of leafSize bytes.
+func NewTree(data []byte, leafSize int) *Tree {
+	leaves := len(data) / leafSize
+	t := &Tree{width: 1, leaves: leaves}
+	for t.width < leaves {
+		t.width *= 2
+	}
+	t.nodes = make([][Size]byte, 2*t.width)
+	for i := 0; i < leaves; i++ {
+		t.nodes[t.width+i] = Leaf(data[i*leafSize : (i+1)*leafSize])
+	}
+	for i := t.width - 1; i > 0; i-- {
+		t.nodes[i] = hashInterior(&t.nodes[2*i], &t.nodes[2*i+1])
+	}
+	return t
+}
+
+// Set replaces the contents of leaf i, and updates the hashes above it.
+func (t *Tree) Set(i int, leaf []byte) {
+	node := t.width + i
+	t.nodes[node] = Leaf(leaf)
+	for node /= 2; node > 0; node /= 2 {
+		t.nodes[node] = hashInterior(&t.nodes[2*node], &t.nodes[2*node+1])
+	}
+}
+
+// Root returns the hash at the root of the tree.
+func (t *Tree) Root() [Size]byte {
+	return t.nodes[1]
+}
+
+// Leaves returns a copy of the hashes of the leaves of the tree.
+func (t *Tree) Leaves() [][Size]byte {
+	leaves := make([][Size]byte, t.leaves)
+	copy(leaves, t.nodes[t.width:t.width+t.leaves])
+	return leaves
+}
+
+// Proof returns the hashes of the nodes which, together with the leaves from
+// lo up to hi, determine the root. They are ordered from the leaves upwards,
+// and at each level the node to the left of the range precedes that to its
+// right.
+func (t *Tree) Proof(lo, hi int) [][Size]byte {
+	proof := make([][Size]byte, 0)
+	for width := t.width; width > 1; width /= 2 {
+		if lo%2 == 1 {
+			lo--
+			proof = append(proof, t.nodes[width+lo])
+		}
+		if hi%2 == 1 {
+			proof = append(proof, t.nodes[width+hi])
+			hi++
+		}
+		lo, hi = lo/2, hi/2
+	}
+	return proof
+}
+
+// RootFromProof computes the root of a tree of n leaves, given the hashes of
+// the leaves from lo onwards and their proof from Proof. It returns false if
+// the leaves and proof do not fit such a tree.
+func RootFromProof(leaves [][Size]byte, lo int, n int, proof [][Size]byte) ([Size]byte, bool) {
+	hi := lo + len(leaves)
+	if lo < 0 || len(leaves) == 0 || hi > n {
+		return [Size]byte{}, false
+	}
+	width := 1
+	for width < n {
+		width *= 2
+	}
+	level := append([][Size]byte{}, leaves...)
+	for ; width > 1; width /= 2 {
+		if lo%2 == 1 {
+			if len(proof) == 0 {
+				return [Size]byte{}, false
+			}
+			lo--
+			level = append([][Size]byte{proof[0]}, level...)
+			proof = proof[1:]
+		}
+		if hi%2 == 1 {
+			if len(proof) == 0 {
+				return [Size]byte{}, false
+			}
+			level = append(level, proof[0])
+			proof = proof[1:]
+			hi++
+		}
+		for i := 0; i < len(level)/2; i++ {
+			level[i] = hashInterior(&level[2*i], &level[2*i+1])
+		}
+		level = level[:len(level)/2]
+		lo, hi = lo/2, hi/2
+	}
+	return level[0], len(proof) == 0
+}
+
+// Combine computes the root of a tree from the roots of its leading subtrees,
+// each over n leaves, where n is a power of two. The remaining subtrees hold
+// only the padding beyond the last leaf.
+func Combine(roots [][Size]byte, n int) [Size]byte {
+	var pad [Size]byte
+	for width := 1; width < n; width *= 2 {
+		pad = hashInterior(&pad, &pad)
+	}
+	level := append([][Size]byte{}, roots...)
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, pad)
+		}
+		for i := 0; i < len(level)/2; i++ {
+			level[i] = hashInterior(&level[2*i], &level[2*i+1])
+		}
+		level = level[:len(level)/2]
+		pad = hashInterior(&pad, &pad)
+	}
+	if len(level) == 0 {
+		return pad
+	}
+	return level[0]
+}
+
+// Root computes the merkle root of data divided into leaves of leafSize bytes.
+func Root(data []byte, leafSize int) [Size]byte {
+	return NewTree(data, leafSize).Root()
+}
+
+// Leaf computes the hash of a leaf, which checks its contents.
+func Leaf(leaf []byte) [Size]byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(leaf)
+	var out [Size]byte
+	h.Sum(out[:0])
+	return out
+}
+
+func hashInterior(left, right *[Size]byte) [Size]byte {
+	h := sha256.New()
+	h.Write([]byte{interiorPrefix})
+	h.Write(left[:])
+	h.Write(right[:])
+	var out [Size]byte
+	h.Sum(out[:0])
+	return out
+}
@@ -0,0 +1,99 @@
+package merkle
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	data := make([]byte, 64*16)
+	rand.Read(data)
+	root := Root(data, 64)
+	if root != Root(data, 64) {
+		t.Fatalf("Root should be deterministic")
+	}
+
+	for _, leafSize := range []int{16, 128} {
+		if Root(data, leafSize) == root {
+			t.Fatalf("Roots over different leaves should differ")
+		}
+	}
+
+	altered := append([]byte{}, data...)
+	altered[5*64+3] ^= 1
+	if Root(altered, 64) == root {
+		t.Fatalf("Root should change with any leaf")
+	}
+}
+
+func TestSet(t *testing.T) {
+	// A number of leaves which is not a power of two.
+	data := make([]byte, 32*13)
+	rand.Read(data)
+	tree := NewTree(data, 32)
+
+	for _, leaf := range []int{0, 7, 12} {
+		copy(data[leaf*32:(leaf+1)*32], bytes.Repeat([]byte{byte(leaf)}, 32))
+		tree.Set(leaf, data[leaf*32:(leaf+1)*32])
+		if tree.Root() != Root(data, 32) {
+			t.Fatalf("Root after setting leaf %d differs from that of a new tree", leaf)
+		}
+		if leaves := tree.Leaves(); len(leaves) != 13 || leaves[leaf] != Leaf(data[leaf*32:(leaf+1)*32]) {
+			t.Fatalf("Leaves should hold the hash of leaf %d", leaf)
+		}
+	}
+}
+
+func TestProof(t *testing.T) {
+	data := make([]byte, 32*13)
+	rand.Read(data)
+	tree := NewTree(data, 32)
+	leaves := tree.Leaves()
+
+	for _, r := range [][2]int{{0, 13}, {0, 1}, {3, 4}, {4, 8}, {5, 12}, {12, 13}} {
+		lo, hi := r[0], r[1]
+		proof := tree.Proof(lo, hi)
+		if root, ok := RootFromProof(leaves[lo:hi], lo, 13, proof); !ok || root != tree.Root() {
+			t.Fatalf("Proof of leaves %d to %d should give the root", lo, hi)
+		}
+		if lo > 0 {
+			if root, ok := RootFromProof(leaves[lo:hi], lo-1, 13, proof); ok && root == tree.Root() {
+				t.Fatalf("Proof of leaves %d to %d should not hold at another offset", lo, hi)
+			}
+		}
+		altered := append([][Size]byte{}, leaves[lo:hi]...)
+		altered[0][0] ^= 1
+		if root, _ := RootFromProof(altered, lo, 13, proof); root == tree.Root() {
+			t.Fatalf("Proof of leaves %d to %d should not hold for other leaves", lo, hi)
+		}
+	}
+}
+
+func TestCombine(t *testing.T) {
+	// Three subtrees of four leaves, and some padding.
+	data := make([]byte, 32*12)
+	rand.Read(data)
+	roots := make([][Size]byte, 3)
+	for i := range roots {
+		roots[i] = Root(data[i*4*32:(i+1)*4*32], 32)
+	}
+	if Combine(roots, 4) != Root(data, 32) {
+		t.Fatalf("Combined roots of subtrees should be the root of the tree")
+	}
+	if Combine(roots[:1], 4) != roots[0] {
+		t.Fatalf("The root of a single subtree should be unchanged")
+	}
+	if Combine(roots, 4) == Combine(roots, 2) {
+		t.Fatalf("Padding should depend on the size of subtrees")
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	data := make([]byte, 4096*1024)
+	tree := NewTree(data, 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Set(i%1024, data[:4096])
+	}
+}
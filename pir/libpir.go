@@ -2,14 +2,18 @@ package pir
 
 import (
 	"errors"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/privacylab/talek/pir/pirinterface"
+	"github.com/privacylab/talek/pir/xor"
 )
 
 // DB is a memory area for PIR computations shared with a PIR daemon.
 type DB struct {
-	DB    []byte
-	shard pirinterface.Shard
+	DB       []byte
+	snapshot *Snapshot
 }
 
 type pirReq struct {
@@ -18,26 +22,59 @@ type pirReq struct {
 }
 
 // Server is a connection and state for a running PIR Server.
+// The database is range partitioned by bucket across one or more backings,
+// which are read in parallel and their responses combined.
 type Server struct {
-	newshard   func(int, []byte, string) pirinterface.Shard
-	backing    string
+	partitions []partition
 	CellLength int
 	CellCount  int
 	BatchSize  int
 	DB         *DB
+
+	// Buffers of freed snapshots are kept for reuse, along with the cells
+	// changed by recent snapshots, so that reuse only copies changed cells.
+	poolLock   sync.Mutex
+	pool       []*buffer
+	generation uint64
+	changes    map[uint64][]uint64 // By generation. Nil when every cell changed.
+}
+
+// buffer is snapshot memory holding the DB as of a generation.
+type buffer struct {
+	data       []byte
+	generation uint64
+}
+
+const (
+	// maxPooledBuffers bounds the memory held by unused snapshot buffers.
+	maxPooledBuffers = 2
+	// maxChangeHistory bounds the generations a reused buffer can catch up.
+	maxChangeHistory = 8
+)
+
+// partition is the range of buckets [start, end) served by one backing.
+type partition struct {
+	newshard func(int, []byte, string) pirinterface.Shard
+	backing  string
+	start    int
+	end      int
 }
 
-// NewServer creates a Server for communication
+// NewServer creates a Server for communication. backing is a comma
+// separated list of PIR implementations, each serving a range of buckets.
 func NewServer(backing string) (*Server, error) {
 	server := new(Server)
-	server.backing = backing
+	server.changes = make(map[uint64][]uint64)
 
-	if cons := pirinterface.GetBacking(backing); cons != nil {
-		server.newshard = cons
-		return server, nil
+	for _, b := range strings.Split(backing, ",") {
+		cons := pirinterface.GetBacking(b)
+		if cons == nil {
+			return nil, errors.New("Backing " + b + " is not known")
+		}
+		server.partitions = append(server.partitions, partition{newshard: cons, backing: b})
 	}
 
-	return nil, errors.New("Backing " + backing + " is not known")
+	return server, nil
 }
 
 // Disconnect closes a Server connection
@@ -49,6 +86,7 @@ func (s *Server) Disconnect() error {
 }
 
 // Configure sets the size of the DB and operational parameters.
+// Buckets are divided evenly across backings, in whole bytes of request.
 func (s *Server) Configure(celllength int, cellcount int, batchsize int) error {
 	s.BatchSize = batchsize
 	s.CellCount = cellcount
@@ -57,6 +95,20 @@ func (s *Server) Configure(celllength int, cellcount int, batchsize int) error {
 	if s.CellCount%8 != 0 || s.CellLength%8 != 0 {
 		return errors.New("invalid sizing of database; everything needs to be multiples of 8 bytes")
 	}
+	if s.CellCount/8 < len(s.partitions) {
+		return errors.New("invalid sizing of database; too few cells to partition")
+	}
+
+	start := 0
+	for i := range s.partitions {
+		length := (s.CellCount / 8 / len(s.partitions)) * 8
+		if i < (s.CellCount/8)%len(s.partitions) {
+			length += 8
+		}
+		s.partitions[i].start = start
+		s.partitions[i].end = start + length
+		start += length
+	}
 
 	return nil
 }
@@ -79,21 +131,20 @@ func (s *Server) SetDB(db *DB) error {
 		s.DB.Free()
 	}
 
-	shardMemory := make([]byte, len(db.DB))
-	copy(shardMemory[:], db.DB[:])
-	db.shard = s.newshard(s.CellLength, shardMemory, s.backing)
-	if db.shard == nil {
+	snap, err := s.Snapshot(db)
+	if err != nil {
 		return errors.New("Couldn't set DB")
 	}
+	db.snapshot = snap
 	s.DB = db
 	return nil
 }
 
 // Free releases memory for a DB instance
 func (db *DB) Free() error {
-	if db.shard != nil {
-		db.shard.Free()
-		db.shard = nil
+	if db.snapshot != nil {
+		db.snapshot.Free()
+		db.snapshot = nil
 	}
 	return nil
 }
@@ -103,16 +154,163 @@ func (s *Server) Read(masks []byte, responseChan chan []byte) error {
 	if s.DB == nil || s.CellCount == 0 {
 		return errors.New("db not configured")
 	}
+	return s.ReadSnapshot(s.DB.snapshot, masks, responseChan)
+}
+
+// Snapshot is a copy of a DB loaded into the PIR back end. It can be read
+// while the DB it was taken from continues to change.
+type Snapshot struct {
+	shards []pirinterface.Shard
+	buffer *buffer
+	server *Server
+}
+
+// Snapshot copies the current contents of db into the PIR back end.
+func (s *Server) Snapshot(db *DB) (*Snapshot, error) {
+	return s.snapshot(db, nil)
+}
+
+// SnapshotChanges copies the contents of db into the PIR back end, given the
+// cells changed since the previous snapshot of db. When the memory of a freed
+// snapshot is reused, only the cells changed since it was taken are copied.
+func (s *Server) SnapshotChanges(db *DB, changed []uint64) (*Snapshot, error) {
+	if changed == nil {
+		changed = []uint64{}
+	}
+	return s.snapshot(db, changed)
+}
+
+func (s *Server) snapshot(db *DB, changed []uint64) (*Snapshot, error) {
+	buf, generation, stale := s.takeBuffer(changed)
+	if buf == nil {
+		buf = &buffer{data: make([]byte, len(db.DB))}
+		copy(buf.data, db.DB)
+	} else if stale == nil {
+		copy(buf.data, db.DB)
+	} else {
+		for _, cell := range stale {
+			start := int(cell) * s.CellLength
+			copy(buf.data[start:start+s.CellLength], db.DB[start:start+s.CellLength])
+		}
+	}
+	buf.generation = generation
+
+	snap := &Snapshot{make([]pirinterface.Shard, 0, len(s.partitions)), buf, s}
+	for _, p := range s.partitions {
+		shardMemory := buf.data[p.start*s.CellLength : p.end*s.CellLength]
+		shard := p.newshard(s.CellLength, shardMemory, p.backing)
+		if shard == nil {
+			snap.Free()
+			return nil, errors.New("Couldn't snapshot DB")
+		}
+		snap.shards = append(snap.shards, shard)
+	}
+	return snap, nil
+}
+
+// takeBuffer records the cells changed by a new generation, and returns a
+// pooled buffer along with the cells it must update. The cells are nil if the
+// whole buffer must be copied.
+func (s *Server) takeBuffer(changed []uint64) (*buffer, uint64, []uint64) {
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+
+	s.generation++
+	s.changes[s.generation] = changed
+	delete(s.changes, s.generation-maxChangeHistory)
+
+	if len(s.pool) == 0 {
+		return nil, s.generation, nil
+	}
+	// The most recent buffer has the fewest changes to catch up.
+	buf := s.pool[len(s.pool)-1]
+	s.pool = s.pool[:len(s.pool)-1]
+	stale := make([]uint64, 0)
+	for g := buf.generation + 1; g <= s.generation; g++ {
+		cells, ok := s.changes[g]
+		if !ok || cells == nil {
+			return buf, s.generation, nil
+		}
+		stale = append(stale, cells...)
+	}
+	return buf, s.generation, stale
+}
+
+// returnBuffer makes the memory of a freed snapshot available for reuse.
+func (s *Server) returnBuffer(buf *buffer) {
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+	// Keep the most recent buffers, ordered by generation.
+	s.pool = append(s.pool, buf)
+	sort.Slice(s.pool, func(i, j int) bool { return s.pool[i].generation < s.pool[j].generation })
+	if len(s.pool) > maxPooledBuffers {
+		s.pool = s.pool[1:]
+	}
+}
+
+// ReadSnapshot makes a PIR request against a snapshot. Each partition reads
+// its range of every request in parallel, and the responses are combined.
+func (s *Server) ReadSnapshot(snap *Snapshot, masks []byte, responseChan chan []byte) error {
+	if snap == nil || len(snap.shards) == 0 || s.CellCount == 0 {
+		return errors.New("snapshot not available")
+	}
 
-	if len(masks) != (s.CellCount*s.BatchSize)/8 {
+	reqLength := s.CellCount / 8
+	if len(masks) != reqLength*s.BatchSize {
 		return errors.New("wrong mask length")
 	}
 
-	responses, err := s.DB.shard.Read(masks, s.CellCount/8)
-	if err != nil {
-		return err
+	if len(snap.shards) == 1 {
+		responses, err := snap.shards[0].Read(masks, reqLength)
+		if err != nil {
+			return err
+		}
+		responseChan <- responses
+		return nil
+	}
+
+	responses := make([][]byte, len(snap.shards))
+	errs := make([]error, len(snap.shards))
+	var wg sync.WaitGroup
+	for i, p := range s.partitions {
+		wg.Add(1)
+		go func(i int, p partition) {
+			defer wg.Done()
+			partLength := (p.end - p.start) / 8
+			partMasks := make([]byte, 0, partLength*s.BatchSize)
+			for b := 0; b < s.BatchSize; b++ {
+				offset := b*reqLength + p.start/8
+				partMasks = append(partMasks, masks[offset:offset+partLength]...)
+			}
+			responses[i], errs[i] = snap.shards[i].Read(partMasks, partLength)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	combined := responses[0]
+	for _, response := range responses[1:] {
+		xor.Bytes(combined, combined, response)
 	}
-	responseChan <- responses
+	responseChan <- combined
 
 	return nil
 }
+
+// Free releases the back end memory of a snapshot. Its memory may be reused
+// by later snapshots.
+func (snap *Snapshot) Free() error {
+	for _, shard := range snap.shards {
+		shard.Free()
+	}
+	snap.shards = nil
+	if snap.buffer != nil {
+		snap.server.returnBuffer(snap.buffer)
+		snap.buffer = nil
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package pir
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"math/rand"
 	"strconv"
 
@@ -67,6 +69,179 @@ func TestPir(t *testing.T) {
 	pirServer.Disconnect()
 }
 
+func TestSnapshot(t *testing.T) {
+	pirServer, err := NewServer("cpu.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pirServer.Configure(512, 512, 8)
+	db, err := pirServer.GetDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB[0] = 1
+	first, err := pirServer.Snapshot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB[0] = 2
+	second, err := pirServer.Snapshot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responseChan := make(chan []byte, 1)
+	masks := make([]byte, 512)
+	masks[0] = 0x01
+	for i, snap := range []*Snapshot{first, second} {
+		if err := pirServer.ReadSnapshot(snap, masks, responseChan); err != nil {
+			t.Fatal(err)
+		}
+		if response := <-responseChan; response[0] != byte(i+1) {
+			t.Fatalf("Snapshot %d read %d, not %d", i, response[0], i+1)
+		}
+	}
+
+	first.Free()
+	if err := pirServer.ReadSnapshot(first, masks, responseChan); err == nil {
+		t.Fatalf("Freed snapshot should not be readable")
+	}
+	second.Free()
+	pirServer.Disconnect()
+}
+
+func TestPartitions(t *testing.T) {
+	single, err := NewServer("cpu.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitioned, err := NewServer("cpu.0,cpu.1,cpu.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer("cpu.0,nonexistent"); err == nil {
+		t.Fatalf("Unknown backings should be rejected")
+	}
+
+	responses := make([][]byte, 0, 2)
+	masks := make([]byte, 512/8*4)
+	rand.Read(masks)
+	for _, server := range []*Server{single, partitioned} {
+		if err := server.Configure(64, 512, 4); err != nil {
+			t.Fatal(err)
+		}
+		db, err := server.GetDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x := range db.DB {
+			db.DB[x] = byte(x * 7)
+		}
+		server.SetDB(db)
+		responseChan := make(chan []byte, 1)
+		if err := server.Read(masks, responseChan); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, <-responseChan)
+		server.Disconnect()
+	}
+	if !bytes.Equal(responses[0], responses[1]) {
+		t.Fatalf("Partitioned server read differently from a single backing")
+	}
+}
+
+func TestSnapshotChanges(t *testing.T) {
+	pirServer, err := NewServer("cpu.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pirServer.Configure(64, 512, 1)
+	db, _ := pirServer.GetDB()
+	rand.Read(db.DB)
+	setCell := func(cell int, val byte) {
+		for i := cell * 64; i < (cell+1)*64; i++ {
+			db.DB[i] = val
+		}
+	}
+
+	first, _ := pirServer.SnapshotChanges(db, nil)
+	setCell(3, 1)
+	setCell(10, 1)
+	second, _ := pirServer.SnapshotChanges(db, []uint64{3, 10})
+	if second.buffer == first.buffer || !bytes.Equal(second.buffer.data, db.DB) {
+		t.Fatalf("Snapshot with no free buffers should copy the DB")
+	}
+
+	reused := first.buffer
+	first.Free()
+	setCell(5, 2)
+	third, _ := pirServer.SnapshotChanges(db, []uint64{5})
+	if third.buffer != reused {
+		t.Fatalf("Freed snapshot memory should be reused")
+	}
+	if !bytes.Equal(third.buffer.data, db.DB) {
+		t.Fatalf("Reused memory should catch up on every change since it was taken")
+	}
+	if second.buffer.data[5*64] == 2 {
+		t.Fatalf("Live snapshots should not change")
+	}
+
+	// Unknown changes force a full copy.
+	second.Free()
+	rand.Read(db.DB)
+	fourth, _ := pirServer.Snapshot(db)
+	third.Free()
+	fifth, _ := pirServer.SnapshotChanges(db, []uint64{})
+	if !bytes.Equal(fourth.buffer.data, db.DB) || !bytes.Equal(fifth.buffer.data, db.DB) {
+		t.Fatalf("Snapshots after unknown changes should match the DB")
+	}
+	pirServer.Disconnect()
+}
+
+// benchmarkSnapshot flips between snapshots of a DB of cellCount 1KB cells
+// while writing to 1% of cells, copying all of the DB or only changed cells.
+func benchmarkSnapshot(b *testing.B, cellCount int, changesOnly bool) {
+	pirServer, err := NewServer("cpu.0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	pirServer.Configure(1024, cellCount, 1)
+	db, _ := pirServer.GetDB()
+	changed := make([]uint64, cellCount/100)
+
+	snaps := make([]*Snapshot, 0, 3)
+	b.SetBytes(int64(len(db.DB)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range changed {
+			changed[j] = uint64(rand.Intn(cellCount))
+			db.DB[int(changed[j])*1024] = byte(i)
+		}
+		var snap *Snapshot
+		if changesOnly {
+			snap, err = pirServer.SnapshotChanges(db, changed)
+		} else {
+			snap, err = pirServer.Snapshot(db)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		// Keep prepared, current, and previous epochs live.
+		snaps = append(snaps, snap)
+		if len(snaps) == 3 {
+			snaps[0].Free()
+			snaps = snaps[1:]
+		}
+	}
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	for _, cells := range []int{1 << 10, 1 << 14, 1 << 17} {
+		b.Run(fmt.Sprintf("full-%dMB", cells>>10), func(b *testing.B) { benchmarkSnapshot(b, cells, false) })
+		b.Run(fmt.Sprintf("changes-%dMB", cells>>10), func(b *testing.B) { benchmarkSnapshot(b, cells, true) })
+	}
+}
+
 func BenchmarkPir(b *testing.B) {
 	cellLength := 1024
 	cellCount := 2048
@@ -1,21 +1,48 @@
 package coordinator
 
-import "github.com/privacylab/talek/common"
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// A client of a replicated coordinator tries each of its servers in turn
+// until one replies as leader, backing off between rounds of the servers
+// while a leader is elected.
+var (
+	leaderRounds  = 5
+	leaderBackoff = 100 * time.Millisecond
+)
 
 // Client is a stub for RPCs to the central coordinator server.
 type Client struct {
-	log     *common.Logger
-	name    string
-	address string
+	log       *common.Logger
+	name      string
+	addresses []string
+	key       *[32]byte // Verifies snapshots, when set
+
+	lock    sync.Mutex
+	leader  int // Index of the address which last replied as leader
 	lastErr error
 }
 
-// NewClient instantiates a client stub
+// NewClient instantiates a client stub. The address may list the servers of
+// a replicated coordinator, separated by commas.
 func NewClient(name string, address string) *Client {
 	c := &Client{}
 	c.log = common.NewLogger(name)
 	c.name = name
-	c.address = address
+	c.addresses = strings.Split(address, ",")
+	return c
+}
+
+// NewVerifyingClient instantiates a client stub which checks that layouts
+// and interest vectors are signed by the coordinator's signing key.
+func NewVerifyingClient(name string, address string, key [32]byte) *Client {
+	c := NewClient(name, address)
+	c.key = &key
 	return c
 }
 
@@ -27,31 +54,107 @@ func (c *Client) Close() error {
 // GetInfo returns info about this server
 func (c *Client) GetInfo(_ *interface{}, reply *GetInfoReply) error {
 	var args interface{}
-	c.lastErr = common.RPCCall(c.address, "Coordinator.GetInfo", &args, reply)
-	return c.lastErr
+	return c.call("Coordinator.GetInfo", &args, reply, &reply.Err)
 }
 
 // GetCommonConfig returns the current config.
 func (c *Client) GetCommonConfig(_ *interface{}, reply *common.Config) error {
 	var args interface{}
-	c.lastErr = common.RPCCall(c.address, "Coordinator.GetCommonConfig", &args, reply)
-	return c.lastErr
+	return c.call("Coordinator.GetCommonConfig", &args, reply, nil)
 }
 
 // GetLayout provides the layout for a shard
 func (c *Client) GetLayout(args *GetLayoutArgs, reply *GetLayoutReply) error {
-	c.lastErr = common.RPCCall(c.address, "Coordinator.GetLayout", args, reply)
-	return c.lastErr
+	err := c.call("Coordinator.GetLayout", args, reply, &reply.Err)
+	if err != nil || reply.Err != "" || c.key == nil {
+		return err
+	}
+	if !c.verify(&reply.Signature, reply.SnapshotID) ||
+		!reply.Signature.VerifyLayout(reply.Layout, args.ShardID, args.NumShards, reply.Proof) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// GetLayoutDelta provides the changes to the layout for a shard between
+// snapshots. The layout it produces can be checked with VerifyLayout of its
+// signature.
+func (c *Client) GetLayoutDelta(args *GetLayoutDeltaArgs, reply *GetLayoutDeltaReply) error {
+	err := c.call("Coordinator.GetLayoutDelta", args, reply, &reply.Err)
+	if err != nil || reply.Err != "" || c.key == nil {
+		return err
+	}
+	if !c.verify(&reply.Signature, args.ToSnapshotID) {
+		return ErrInvalidSignature
+	}
+	return nil
 }
 
 // GetIntVec provides the global interest vector
 func (c *Client) GetIntVec(args *GetIntVecArgs, reply *GetIntVecReply) error {
-	c.lastErr = common.RPCCall(c.address, "Coordinator.GetIntVec", args, reply)
-	return c.lastErr
+	err := c.call("Coordinator.GetIntVec", args, reply, &reply.Err)
+	if err != nil || reply.Err != "" || c.key == nil {
+		return err
+	}
+	if !c.verify(&reply.Signature, reply.SnapshotID) || Digest(reply.IntVec) != reply.Signature.IntVecDigest {
+		return ErrInvalidSignature
+	}
+	return nil
 }
 
-// Commit a set of Writes
+// Commit a single Write
 func (c *Client) Commit(args *CommitArgs, reply *CommitReply) error {
-	c.lastErr = common.RPCCall(c.address, "Coordinator.Commit", args, reply)
-	return c.lastErr
+	return c.call("Coordinator.Commit", args, reply, &reply.Err)
+}
+
+// BatchCommit commits a set of Writes together
+func (c *Client) BatchCommit(args *BatchCommitArgs, reply *BatchCommitReply) error {
+	return c.call("Coordinator.BatchCommit", args, reply, &reply.Err)
+}
+
+// Register subscribes a server to snapshot notifications
+func (c *Client) Register(args *RegisterArgs, reply *RegisterReply) error {
+	return c.call("Coordinator.Register", args, reply, &reply.Err)
+}
+
+// Unregister unsubscribes a server from snapshot notifications
+func (c *Client) Unregister(args *UnregisterArgs, reply *UnregisterReply) error {
+	return c.call("Coordinator.Unregister", args, reply, &reply.Err)
+}
+
+// verify checks the signature of a snapshot against the coordinator's key
+func (c *Client) verify(signature *SnapshotSignature, snapshotID uint64) bool {
+	return signature.SnapshotID == snapshotID && signature.Verify(*c.key)
+}
+
+// call makes an RPC to the leader, given the Err of its reply if any
+func (c *Client) call(method string, args interface{}, reply interface{}, replyErr *string) error {
+	c.lock.Lock()
+	start := c.leader
+	c.lock.Unlock()
+
+	var err error
+	backoff := leaderBackoff
+	for attempt := 0; attempt < len(c.addresses)*leaderRounds; attempt++ {
+		if attempt > 0 && attempt%len(c.addresses) == 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		i := (start + attempt) % len(c.addresses)
+		err = common.RPCCall(c.addresses[i], method, args, reply)
+		if err == nil && (replyErr == nil || *replyErr != ErrNotLeader) {
+			c.lock.Lock()
+			c.leader = i
+			c.lastErr = nil
+			c.lock.Unlock()
+			return nil
+		}
+		if len(c.addresses) == 1 {
+			break
+		}
+	}
+	c.lock.Lock()
+	c.lastErr = err
+	c.lock.Unlock()
+	return err
 }
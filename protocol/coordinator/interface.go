@@ -9,6 +9,10 @@ type Interface interface {
 	GetInfo(args *interface{}, reply *GetInfoReply) error
 	GetCommonConfig(args *interface{}, reply *common.Config) error
 	GetLayout(args *GetLayoutArgs, reply *GetLayoutReply) error
+	GetLayoutDelta(args *GetLayoutDeltaArgs, reply *GetLayoutDeltaReply) error
 	GetIntVec(args *GetIntVecArgs, reply *GetIntVecReply) error
 	Commit(args *CommitArgs, reply *CommitReply) error
+	BatchCommit(args *BatchCommitArgs, reply *BatchCommitReply) error
+	Register(args *RegisterArgs, reply *RegisterReply) error
+	Unregister(args *UnregisterArgs, reply *UnregisterReply) error
 }
@@ -8,11 +8,38 @@ package coordinator
 // @todo for some reason uint64's require 10 bytes?
 const IDSize = 10
 
+// ErrNotLeader is the Err of replies from a server of a replicated
+// coordinator which is not its leader, and so does not serve requests.
+const ErrNotLeader = "Not the leader"
+
+// ErrCommitRejected is the status of a commit which is not in the window once
+// applied: it could not be placed in the cuckoo table, or was given up early
+// to place others.
+const ErrCommitRejected = "Commit could not be placed"
+
 // GetInfoReply contains general state about the server
 type GetInfoReply struct {
 	Err        string
 	Name       string
 	SnapshotID uint64
+	Servers    []ServerStatus // Servers registered for notifications
+	Commits    CommitStats
+}
+
+// CommitStats counts how commits were placed in the cuckoo table
+type CommitStats struct {
+	Placed         uint64 // Inserted without overflowing the table
+	Overflowed     uint64 // Placed by evicting the oldest commits early
+	EarlyEvictions uint64 // Commits evicted before leaving the window
+	Rejected       uint64 // Not placed, with ErrCommitRejected
+}
+
+// ServerStatus describes a server registered for snapshot notifications
+type ServerStatus struct {
+	Name    string
+	Address string
+	Alive   bool   // Whether the last notification was delivered
+	Acked   uint64 // The latest SnapshotID delivered
 }
 
 // GetLayoutArgs requests the layout for a shard
@@ -27,6 +54,28 @@ type GetLayoutReply struct {
 	Err        string
 	SnapshotID uint64
 	Layout     []uint64
+	Signature  SnapshotSignature
+	Proof      [][32]byte // Of the shard's buckets, against the signed digest
+}
+
+// GetLayoutDeltaArgs requests the changes to the layout for a shard between
+// two snapshots
+type GetLayoutDeltaArgs struct {
+	FromSnapshotID uint64
+	ToSnapshotID   uint64
+	ShardID        uint64
+	NumShards      uint64
+}
+
+// GetLayoutDeltaReply returns the slots of the layout for a shard which
+// changed between two snapshots
+type GetLayoutDeltaReply struct {
+	Err        string
+	SnapshotID uint64            // The current snapshot
+	Slots      []uint64          // Indices into the layout for the shard, in increasing order
+	Layout     []uint64          // The ID in each slot as of ToSnapshotID
+	Signature  SnapshotSignature // Of ToSnapshotID
+	Proof      [][32]byte        // Of the shard's buckets, if ToSnapshotID is current
 }
 
 // GetIntVecArgs requests the global interest vector
@@ -39,13 +88,15 @@ type GetIntVecReply struct {
 	Err        string
 	SnapshotID uint64
 	IntVec     []uint64 // Serialization of bloom filter
+	Signature  SnapshotSignature
 }
 
-// CommitArgs contains a set of Writes to be committed
+// CommitArgs contains a single Write to be committed
 type CommitArgs struct {
 	ID        uint64
 	Bucket1   uint64
 	Bucket2   uint64
+	Time      int64    // When the Write was serialized, in Unix nanoseconds
 	IntVecLoc []uint64 // Represents the hash locations
 }
 
@@ -53,3 +104,40 @@ type CommitArgs struct {
 type CommitReply struct {
 	Err string
 }
+
+// ErrAlreadyCommitted is the status of an item of a batch whose ID is
+// already in the window, so a batch may be retried when its reply is lost.
+const ErrAlreadyCommitted = "Already committed"
+
+// BatchCommitArgs contains Writes to be committed together
+type BatchCommitArgs struct {
+	Commits []CommitArgs
+}
+
+// BatchCommitReply acknowledges a batch of commits
+type BatchCommitReply struct {
+	Err  string   // Set if no commit of the batch was applied
+	Errs []string // The status of each commit, empty if committed
+}
+
+// RegisterArgs subscribes a server to snapshot notifications
+type RegisterArgs struct {
+	Name    string
+	Address string // Where the server receives notify RPCs
+}
+
+// RegisterReply acknowledges a registration
+type RegisterReply struct {
+	Err        string
+	SnapshotID uint64 // The current snapshot, which is not notified
+}
+
+// UnregisterArgs unsubscribes a server from snapshot notifications
+type UnregisterArgs struct {
+	Address string
+}
+
+// UnregisterReply acknowledges an unregistration
+type UnregisterReply struct {
+	Err string
+}
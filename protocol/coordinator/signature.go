@@ -0,0 +1,91 @@
+package coordinator
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/agl/ed25519"
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/merkle"
+)
+
+// ErrInvalidSignature is returned by a Client when a reply is not signed by
+// the key of the coordinator, or does not match the digests signed.
+var ErrInvalidSignature = errors.New("invalid coordinator signature")
+
+// SnapshotSignature is the coordinator's signature over the layout and
+// interest vector of a snapshot. The layout is digested as a merkle tree with
+// a leaf for each bucket, so that the layout of any shard can be checked.
+// The commits laid out are those from FirstID through LastID which are still
+// placed, so that a shard can tell whether the layout reflects its writes.
+type SnapshotSignature struct {
+	SnapshotID   uint64
+	NumBuckets   uint64
+	BucketDepth  uint64
+	FirstID      uint64
+	LastID       uint64
+	LayoutDigest [32]byte // The root of the LayoutTree
+	IntVecDigest [32]byte
+	Signature    [64]byte
+}
+
+// Digest hashes an interest vector.
+func Digest(words []uint64) [32]byte {
+	return sha256.Sum256(encodeWords(words))
+}
+
+// LayoutTree hashes a layout with a leaf holding the slots of each bucket.
+func LayoutTree(layout []uint64, depth uint64) *merkle.Tree {
+	return merkle.NewTree(encodeWords(layout), int(8*depth))
+}
+
+// ShardBuckets is the range of buckets, from start up to end, held by a shard
+// of a database divided among numShards. It returns false if the buckets can
+// not be divided evenly, or there is no such shard.
+func ShardBuckets(numBuckets, shardID, numShards uint64) (start uint64, end uint64, ok bool) {
+	if numShards == 0 || numBuckets%numShards != 0 || shardID >= numShards {
+		return 0, 0, false
+	}
+	size := numBuckets / numShards
+	return shardID * size, (shardID + 1) * size, true
+}
+
+// Sign signs the snapshot with the key of a coordinator.
+func (s *SnapshotSignature) Sign(identity *common.TrustDomainConfig) error {
+	var err error
+	s.Signature, err = identity.Sign(s.message())
+	return err
+}
+
+// Verify checks that a coordinator with the public signing key signed the
+// snapshot.
+func (s *SnapshotSignature) Verify(key [32]byte) bool {
+	return ed25519.Verify(&key, s.message(), &s.Signature)
+}
+
+// VerifyLayout checks the layout of a shard against the digest of the
+// snapshot, given the proof of the shard's buckets from the LayoutTree.
+func (s *SnapshotSignature) VerifyLayout(layout []uint64, shardID, numShards uint64, proof [][32]byte) bool {
+	start, end, ok := ShardBuckets(s.NumBuckets, shardID, numShards)
+	if !ok || s.BucketDepth == 0 || uint64(len(layout)) != (end-start)*s.BucketDepth {
+		return false
+	}
+	leaves := LayoutTree(layout, s.BucketDepth).Leaves()
+	root, ok := merkle.RootFromProof(leaves, int(start), int(s.NumBuckets), proof)
+	return ok && root == s.LayoutDigest
+}
+
+func (s *SnapshotSignature) message() []byte {
+	msg := encodeWords([]uint64{s.SnapshotID, s.NumBuckets, s.BucketDepth, s.FirstID, s.LastID})
+	msg = append(msg, s.LayoutDigest[:]...)
+	return append(msg, s.IntVecDigest[:]...)
+}
+
+func encodeWords(words []uint64) []byte {
+	data := make([]byte, 8*len(words))
+	for i, word := range words {
+		binary.LittleEndian.PutUint64(data[8*i:], word)
+	}
+	return data
+}
@@ -0,0 +1,31 @@
+package notify
+
+import "github.com/privacylab/talek/common"
+
+// Client is a stub for RPCs to a server receiving snapshot notifications.
+type Client struct {
+	log     *common.Logger
+	name    string
+	address string
+	lastErr error
+}
+
+// NewClient instantiates a client stub
+func NewClient(name string, address string) *Client {
+	c := &Client{}
+	c.log = common.NewLogger(name)
+	c.name = name
+	c.address = address
+	return c
+}
+
+// Close will close the RPC client
+func (c *Client) Close() error {
+	return nil
+}
+
+// Notify tells the server of a new snapshot
+func (c *Client) Notify(args *Args, reply *Reply) error {
+	c.lastErr = common.RPCCall(c.address, "Notify.Notify", args, reply)
+	return c.lastErr
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"github.com/gorilla/rpc"
+	"github.com/gorilla/rpc/json"
+	"github.com/privacylab/talek/common"
+)
+
+// Service delivers notifications received over RPC to a local Interface.
+// It is registered with an RPC server as the "Notify" service.
+type Service struct {
+	Interface
+}
+
+// Server receives snapshot notifications over HTTP/JSON-RPC
+type Server struct {
+	log  *common.Logger
+	name string
+
+	// RPC Interface
+	*rpc.Server
+}
+
+// NewServer creates a Server passing notifications to handler
+func NewServer(name string, handler Interface) *Server {
+	s := &Server{}
+	s.log = common.NewLogger(name)
+	s.name = name
+
+	// Set up the RPC server component.
+	s.Server = rpc.NewServer()
+	s.Server.RegisterCodec(json.NewCodec(), "application/json")
+	s.Server.RegisterTCPService(&Service{handler}, "Notify")
+
+	s.log.Info.Printf("notify.NewServer(%v) success\n", name)
+	return s
+}
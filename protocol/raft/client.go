@@ -0,0 +1,43 @@
+package raft
+
+import "github.com/privacylab/talek/common"
+
+// Client is a stub for RPCs to a raft node.
+type Client struct {
+	log     *common.Logger
+	name    string
+	address string
+	lastErr error
+}
+
+// NewClient instantiates a client stub
+func NewClient(name string, address string) *Client {
+	c := &Client{}
+	c.log = common.NewLogger(name)
+	c.name = name
+	c.address = address
+	return c
+}
+
+// Close will close the RPC client
+func (c *Client) Close() error {
+	return nil
+}
+
+// RequestVote asks the node for its vote
+func (c *Client) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	c.lastErr = common.RPCCall(c.address, "Raft.RequestVote", args, reply)
+	return c.lastErr
+}
+
+// AppendEntries replicates entries to the node
+func (c *Client) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	c.lastErr = common.RPCCall(c.address, "Raft.AppendEntries", args, reply)
+	return c.lastErr
+}
+
+// InstallSnapshot replaces the log of the node with a snapshot
+func (c *Client) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	c.lastErr = common.RPCCall(c.address, "Raft.InstallSnapshot", args, reply)
+	return c.lastErr
+}
@@ -0,0 +1,8 @@
+package raft
+
+// Interface is the interface for replicating a log between raft nodes
+type Interface interface {
+	RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
@@ -0,0 +1,56 @@
+package raft
+
+// Entry is a command in the replicated log
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Data  []byte // Empty for the entry a new leader appends to its term
+}
+
+// RequestVoteArgs asks for a vote in an election
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteReply grants or refuses a vote
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesArgs replicates entries following PrevLogIndex, or is a
+// heartbeat if there are none
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesReply acknowledges entries. On failure, LastIndex is the
+// latest entry the leader might next try to match.
+type AppendEntriesReply struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64
+}
+
+// InstallSnapshotArgs replaces the log through LastIndex with the state
+// it produced
+type InstallSnapshotArgs struct {
+	Term      uint64
+	LeaderID  string
+	LastIndex uint64
+	LastTerm  uint64
+	Data      []byte
+}
+
+// InstallSnapshotReply acknowledges a snapshot
+type InstallSnapshotReply struct {
+	Term uint64
+}
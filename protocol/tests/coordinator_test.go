@@ -3,6 +3,7 @@ package tests
 import (
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -49,14 +50,97 @@ func TestRPCBasic(t *testing.T) {
 	if err = cc.GetLayout(&protocol.GetLayoutArgs{}, &protocol.GetLayoutReply{}); err != nil {
 		t.Errorf("Error calling GetLayout: %v", err)
 	}
+	if err = cc.GetLayoutDelta(&protocol.GetLayoutDeltaArgs{}, &protocol.GetLayoutDeltaReply{}); err != nil {
+		t.Errorf("Error calling GetLayoutDelta: %v", err)
+	}
 	if err = cc.GetIntVec(&protocol.GetIntVecArgs{}, &protocol.GetIntVecReply{}); err != nil {
 		t.Errorf("Error calling GetIntVec: %v", err)
 	}
 	if err = cc.Commit(&protocol.CommitArgs{}, &protocol.CommitReply{}); err != nil {
 		t.Errorf("Error calling Commit: %v", err)
 	}
+	if err = cc.BatchCommit(&protocol.BatchCommitArgs{}, &protocol.BatchCommitReply{}); err != nil {
+		t.Errorf("Error calling BatchCommit: %v", err)
+	}
 
 	c.Close()
 	s.Close()
 	l.Close()
 }
+
+func TestRPCSignedSnapshots(t *testing.T) {
+	identity := common.NewTrustDomainConfig("coordinator", "", true, false)
+	s, err := server.NewServer("test", "", testConfig(), nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	defer s.Close()
+	s.SetIdentity(identity)
+	h := httptest.NewServer(s)
+	defer h.Close()
+	for i := uint64(0); i < 3; i++ {
+		s.Commit(&protocol.CommitArgs{ID: i, Bucket1: i, Bucket2: i + 1}, &protocol.CommitReply{})
+	}
+	s.NotifySnapshot(true)
+
+	c := protocol.NewVerifyingClient("test", h.URL, identity.SignPublicKey)
+	layout := &protocol.GetLayoutReply{}
+	if err := c.GetLayout(&protocol.GetLayoutArgs{SnapshotID: 1, NumShards: 1}, layout); err != nil || layout.Err != "" {
+		t.Fatalf("Error calling GetLayout: %v %v", err, layout.Err)
+	}
+	if err := c.GetLayout(&protocol.GetLayoutArgs{SnapshotID: 1, ShardID: 1, NumShards: 2}, &protocol.GetLayoutReply{}); err != nil {
+		t.Fatalf("Error calling GetLayout for a shard: %v", err)
+	}
+	if err := c.GetIntVec(&protocol.GetIntVecArgs{SnapshotID: 1}, &protocol.GetIntVecReply{}); err != nil {
+		t.Fatalf("Error calling GetIntVec: %v", err)
+	}
+	delta := &protocol.GetLayoutDeltaReply{}
+	if err := c.GetLayoutDelta(&protocol.GetLayoutDeltaArgs{FromSnapshotID: 0, ToSnapshotID: 1, NumShards: 1}, delta); err != nil {
+		t.Fatalf("Error calling GetLayoutDelta: %v", err)
+	}
+	if delta.Signature != layout.Signature {
+		t.Fatalf("A delta should carry the signature of the snapshot it leads to")
+	}
+
+	// Snapshots signed by another key, or unsigned, are rejected.
+	other := protocol.NewVerifyingClient("test", h.URL, common.NewTrustDomainConfig("other", "", true, false).SignPublicKey)
+	if err := other.GetLayout(&protocol.GetLayoutArgs{SnapshotID: 1, NumShards: 1}, &protocol.GetLayoutReply{}); err != protocol.ErrInvalidSignature {
+		t.Fatalf("A layout signed by another key should be rejected, got %v", err)
+	}
+	if err := other.GetIntVec(&protocol.GetIntVecArgs{SnapshotID: 1}, &protocol.GetIntVecReply{}); err != protocol.ErrInvalidSignature {
+		t.Fatalf("An interest vector signed by another key should be rejected, got %v", err)
+	}
+	unsigned, err := server.NewServer("unsigned", "", testConfig(), nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	defer unsigned.Close()
+	h2 := httptest.NewServer(unsigned)
+	defer h2.Close()
+	c = protocol.NewVerifyingClient("test", h2.URL, identity.SignPublicKey)
+	if err := c.GetLayout(&protocol.GetLayoutArgs{NumShards: 1}, &protocol.GetLayoutReply{}); err != protocol.ErrInvalidSignature {
+		t.Fatalf("An unsigned layout should be rejected, got %v", err)
+	}
+
+	// The digest of a layout binds it to the signature, and the layout of
+	// each shard is proved against it.
+	if !layout.Signature.VerifyLayout(layout.Layout, 0, 1, layout.Proof) {
+		t.Fatalf("A layout should match the signed digest")
+	}
+	shard := &protocol.GetLayoutReply{}
+	c = protocol.NewVerifyingClient("test", h.URL, identity.SignPublicKey)
+	if err := c.GetLayout(&protocol.GetLayoutArgs{SnapshotID: 1, ShardID: 2, NumShards: 4}, shard); err != nil {
+		t.Fatalf("Error calling GetLayout for a shard: %v", err)
+	}
+	if shard.Signature.VerifyLayout(shard.Layout, 1, 4, shard.Proof) {
+		t.Fatalf("The layout of a shard should not be accepted for another shard")
+	}
+	layout.Layout[0]++
+	if layout.Signature.VerifyLayout(layout.Layout, 0, 1, layout.Proof) {
+		t.Fatalf("A changed layout should not match the signed digest")
+	}
+	shard.Layout[0]++
+	if shard.Signature.VerifyLayout(shard.Layout, 2, 4, shard.Proof) {
+		t.Fatalf("A changed layout of a shard should not match the signed digest")
+	}
+}
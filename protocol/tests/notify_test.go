@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	protocol "github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/protocol/notify"
+	server "github.com/privacylab/talek/server/coordinator"
+)
+
+type mockReceiver struct {
+	Done chan *notify.Args
+}
+
+func (m *mockReceiver) Notify(args *notify.Args, reply *notify.Reply) error {
+	m.Done <- args
+	return nil
+}
+
+func TestRPCNotify(t *testing.T) {
+	receiver := &mockReceiver{Done: make(chan *notify.Args, 1)}
+	n := httptest.NewServer(notify.NewServer("test", receiver))
+	defer n.Close()
+
+	var nc notify.Interface
+	nc = notify.NewClient("test", n.URL)
+	if err := nc.Notify(&notify.Args{SnapshotID: 3}, &notify.Reply{}); err != nil {
+		t.Errorf("Error calling Notify: %v", err)
+	}
+	select {
+	case args := <-receiver.Done:
+		if args.SnapshotID != 3 {
+			t.Errorf("Wrong SnapshotID in notify: %v", args)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timed out waiting for notification")
+	}
+}
+
+func TestRPCRegister(t *testing.T) {
+	receiver := &mockReceiver{Done: make(chan *notify.Args, 1)}
+	n := httptest.NewServer(notify.NewServer("test", receiver))
+	defer n.Close()
+
+	s, err := server.NewServer("test", "", testConfig(), nil, 5, time.Hour)
+	if err != nil {
+		t.Errorf("Error creating new server")
+	}
+	defer s.Close()
+	coord := httptest.NewServer(s)
+	defer coord.Close()
+	c := protocol.NewClient("test", coord.URL)
+
+	registerReply := &protocol.RegisterReply{}
+	if err = c.Register(&protocol.RegisterArgs{Name: "test", Address: n.URL}, registerReply); err != nil || registerReply.Err != "" {
+		t.Errorf("Error calling Register: %v %v", err, registerReply.Err)
+	}
+	s.NotifySnapshot(true)
+	select {
+	case args := <-receiver.Done:
+		if args.SnapshotID != 1 {
+			t.Errorf("Wrong SnapshotID in notify: %v", args)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Registered server was not notified")
+	}
+
+	unregisterReply := &protocol.UnregisterReply{}
+	if err = c.Unregister(&protocol.UnregisterArgs{Address: n.URL}, unregisterReply); err != nil || unregisterReply.Err != "" {
+		t.Errorf("Error calling Unregister: %v %v", err, unregisterReply.Err)
+	}
+	infoReply := &protocol.GetInfoReply{}
+	if err = c.GetInfo(nil, infoReply); err != nil || len(infoReply.Servers) != 0 {
+		t.Errorf("No servers should remain registered: %v %v", err, infoReply)
+	}
+	c.Close()
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/protocol/coordinator"
 )
 
 // Config represents the configuration needed to start a Talek server.
@@ -25,6 +26,48 @@ type Config struct {
 	TrustDomain *common.TrustDomainConfig
 	// In client read requests, which index is relevant for this server.
 	TrustDomainIndex int
+
+	// Directory where the replica database is persisted across restarts.
+	// Persistence is disabled when empty.
+	PersistPath string
+	// How many writes are logged between snapshots of the database.
+	SnapshotInterval int
+
+	// In a distributed trust domain, the shard of the database held by this
+	// server, and the number of servers holding a shard.
+	ShardID   uint64
+	NumShards uint64
+	// Address of the coordinator laying out a distributed trust domain.
+	CoordinatorAddress string
+	// Public signing key of the coordinator, against which its layouts are
+	// checked. Layouts are not checked when empty.
+	CoordinatorKey [32]byte
+	// Coordinator to use in place of one at CoordinatorAddress.
+	Coordinator coordinator.Interface `json:"-"`
+
+	// Source of time for periodic work. Defaults to common.SystemClock.
+	Clock common.Clock `json:"-"`
+}
+
+func (c *Config) clock() common.Clock {
+	if c.Clock == nil {
+		return common.SystemClock
+	}
+	return c.Clock
+}
+
+// distributed is whether the server holds one shard of a distributed trust
+// domain, placing items as laid out by its coordinator.
+func (c *Config) distributed() bool {
+	return c.TrustDomain != nil && c.TrustDomain.IsDistributed
+}
+
+// numShards is the number of servers among which the database is divided.
+func (c *Config) numShards() uint64 {
+	if !c.distributed() || c.NumShards == 0 {
+		return 1
+	}
+	return c.NumShards
 }
 
 // ConfigFromFile restores a json cofig. returns the config on success or nil if
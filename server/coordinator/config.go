@@ -0,0 +1,54 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/privacylab/talek/common"
+)
+
+// Config represents the configuration needed to start a coordinator server.
+// configurations can be generated through util/talekutil
+type Config struct {
+	*common.Config `json:"-"`
+
+	// How many commits trigger a snapshot?
+	SnapshotThreshold uint64
+	// What's the longest time between snapshots?
+	SnapshotInterval time.Duration `json:",string"`
+
+	// Addresses of servers notified of every snapshot, in addition to those
+	// which register.
+	NotifyAddresses []string
+
+	// Directory where commits and snapshots are persisted across restarts,
+	// or the raft state of a replicated coordinator. Persistence is disabled
+	// when empty.
+	PersistPath string
+
+	// Keys with which snapshots are signed, including the private key.
+	// Snapshots are unsigned when nil.
+	Identity *common.TrustDomainConfig
+
+	// In a replicated coordinator, the id of this server, and the address of
+	// every server of the cluster by id. The coordinator is not replicated
+	// when Peers is empty.
+	ID    string
+	Peers map[string]string
+}
+
+// ConfigFromFile restores a json config. returns the config on success or nil
+// if loading or parsing the file fails.
+func ConfigFromFile(file string, commonBase *common.Config) *Config {
+	configString, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	config := new(Config)
+	if err := json.Unmarshal(configString, config); err != nil {
+		return nil
+	}
+	config.Config = commonBase
+	return config
+}
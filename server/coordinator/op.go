@@ -0,0 +1,140 @@
+package coordinator
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/privacylab/talek/protocol/coordinator"
+)
+
+// An op is a change to the state of the coordinator. Ops are logged when
+// the coordinator is persisted, and replicated when it is replicated, and
+// make the same choices wherever they are applied.
+type op struct {
+	kind    byte
+	commit  *coordinator.CommitArgs   // Of a commit
+	commits []*coordinator.CommitArgs // Of a batch
+	name    string                    // Of a registration
+	address string                    // Of a registration or unregistration
+}
+
+const (
+	commitOp     byte = 'c'
+	batchOp      byte = 'b'
+	snapshotOp   byte = 's'
+	registerOp   byte = 'r'
+	unregisterOp byte = 'u'
+)
+
+var errNotRegistered = errors.New("Address not registered")
+var errCommitRejected = errors.New(coordinator.ErrCommitRejected)
+
+// applyOp applies an op to the state of the coordinator. Must hold the lock.
+func (s *Server) applyOp(o *op) error {
+	switch o.kind {
+	case commitOp:
+		// Every shard of a trust domain commits each write, so those
+		// already applied are ignored.
+		if o.commit.ID <= s.latestCommit {
+			return nil
+		} else if !s.applyCommit(o.commit) {
+			return errCommitRejected
+		}
+	case batchOp:
+		s.applyBatch(o.commits)
+	case snapshotOp:
+		s.takeSnapshot()
+	case registerOp:
+		s.logIndex++
+		s.addRegistration(o.name, o.address)
+	case unregisterOp:
+		s.logIndex++
+		if !s.removeServer(o.address) {
+			return errNotRegistered
+		}
+	}
+	return nil
+}
+
+// An op is encoded as its kind, followed by the fields of a commit, the
+// fields of each commit of a batch prefixed by their count of locations, or
+// the name and address of a registration.
+func encodeOp(o *op) []byte {
+	switch o.kind {
+	case commitOp:
+		return appendCommit([]byte{commitOp}, o.commit)
+	case batchOp:
+		data := []byte{batchOp}
+		var length [binary.MaxVarintLen64]byte
+		for _, args := range o.commits {
+			data = append(data, length[:binary.PutUvarint(length[:], uint64(len(args.IntVecLoc)))]...)
+			data = appendCommit(data, args)
+		}
+		return data
+	case registerOp, unregisterOp:
+		data := make([]byte, 1+binary.MaxVarintLen64)
+		data[0] = o.kind
+		n := binary.PutUvarint(data[1:], uint64(len(o.name)))
+		data = append(data[:1+n], o.name...)
+		return append(data, o.address...)
+	}
+	return []byte{o.kind}
+}
+
+func decodeOp(data []byte) (*op, error) {
+	if len(data) < 1 {
+		return nil, errors.New("empty op")
+	}
+	o := &op{kind: data[0]}
+	switch o.kind {
+	case snapshotOp:
+	case commitOp:
+		if len(data) < 33 || (len(data)-33)%8 != 0 {
+			return nil, errors.New("malformed commit op")
+		}
+		o.commit = readCommit(data[1:], (len(data)-33)/8)
+	case batchOp:
+		o.commits = make([]*coordinator.CommitArgs, 0)
+		for data = data[1:]; len(data) > 0; {
+			locs, n := binary.Uvarint(data)
+			if n <= 0 || locs > uint64(len(data)-n)/8 || len(data)-n < 32+8*int(locs) {
+				return nil, errors.New("malformed batch op")
+			}
+			o.commits = append(o.commits, readCommit(data[n:], int(locs)))
+			data = data[n+32+8*int(locs):]
+		}
+	case registerOp, unregisterOp:
+		length, n := binary.Uvarint(data[1:])
+		if n <= 0 || length > uint64(len(data)-1-n) {
+			return nil, errors.New("malformed registration op")
+		}
+		o.name = string(data[1+n : 1+n+int(length)])
+		o.address = string(data[1+n+int(length):])
+	default:
+		return nil, errors.New("unknown op")
+	}
+	return o, nil
+}
+
+func appendCommit(data []byte, args *coordinator.CommitArgs) []byte {
+	var field [8]byte
+	for _, value := range append([]uint64{args.ID, args.Bucket1, args.Bucket2, uint64(args.Time)}, args.IntVecLoc...) {
+		binary.LittleEndian.PutUint64(field[:], value)
+		data = append(data, field[:]...)
+	}
+	return data
+}
+
+// readCommit decodes a commit with locs locations from the front of data
+func readCommit(data []byte, locs int) *coordinator.CommitArgs {
+	args := &coordinator.CommitArgs{}
+	args.ID = binary.LittleEndian.Uint64(data[0:])
+	args.Bucket1 = binary.LittleEndian.Uint64(data[8:])
+	args.Bucket2 = binary.LittleEndian.Uint64(data[16:])
+	args.Time = int64(binary.LittleEndian.Uint64(data[24:]))
+	args.IntVecLoc = make([]uint64, locs)
+	for i := range args.IntVecLoc {
+		args.IntVecLoc[i] = binary.LittleEndian.Uint64(data[32+8*i:])
+	}
+	return args
+}
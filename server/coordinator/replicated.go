@@ -0,0 +1,95 @@
+package coordinator
+
+import (
+	"github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/server/raft"
+)
+
+// A replicated coordinator applies each op once it is committed by a quorum
+// of its servers, so every server holds the same window of commits, cuckoo
+// table, and registrations. The cuckoo table is seeded by the common
+// CuckooSeed, so servers make the same choices. Only the leader sends
+// notifications, and so only it drops servers which miss them.
+
+// machine is the state replicated between the servers of a coordinator
+type machine struct {
+	s *Server
+}
+
+// Apply applies a committed op, returning the status of each commit of a
+// batch
+func (m *machine) Apply(command []byte) (interface{}, error) {
+	s := m.s
+	o, err := decodeOp(command)
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	s.lock.Lock()
+	if o.kind == batchOp {
+		errs = s.applyBatch(o.commits)
+	} else {
+		err = s.applyOp(o)
+	}
+	var servers []*registration
+	if o.kind == snapshotOp {
+		servers = append(servers, s.servers...)
+	}
+	snapshotID := s.snapshotCount
+	s.lock.Unlock()
+
+	if len(servers) > 0 && s.node.IsLeader() {
+		go s.sendNotification(servers, snapshotID)
+	}
+	if o.kind == batchOp {
+		return errs, err
+	}
+	return nil, err
+}
+
+// Snapshot serializes the registrations and state of the coordinator
+func (m *machine) Snapshot() ([]byte, error) {
+	m.s.lock.RLock()
+	defer m.s.lock.RUnlock()
+	return m.s.marshalState()
+}
+
+// Restore replaces the registrations and state of the coordinator
+func (m *machine) Restore(snapshot []byte) error {
+	m.s.lock.Lock()
+	defer m.s.lock.Unlock()
+	return m.s.unmarshalState(snapshot)
+}
+
+// leads returns whether the server serves requests, which only the leader of
+// a replicated coordinator does. Must not hold the lock.
+func (s *Server) leads() bool {
+	return s.node == nil || s.node.IsLeader()
+}
+
+// proposeSnapshot replicates a snapshot, if this server leads and it is due
+func (s *Server) proposeSnapshot(force bool) bool {
+	if !s.node.IsLeader() {
+		return false
+	}
+	s.lock.RLock()
+	due := force || s.numNewCommits >= s.snapshotThreshold
+	s.lock.RUnlock()
+	if !due {
+		return false
+	}
+	if _, err := s.node.Propose(encodeOp(&op{kind: snapshotOp})); err != nil {
+		s.log.Warn.Printf("%v.NotifySnapshot failed to replicate snapshot: %v", s.name, err)
+		return false
+	}
+	s.log.Info.Printf("%v.NotifySnapshot() success\n", s.name)
+	return true
+}
+
+// proposeError converts the error of an op to the Err of a reply
+func proposeError(err error) string {
+	if err == raft.ErrNotLeader {
+		return coordinator.ErrNotLeader
+	}
+	return err.Error()
+}
@@ -0,0 +1,302 @@
+package coordinator
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/protocol/notify"
+	raftprotocol "github.com/privacylab/talek/protocol/raft"
+)
+
+// cluster connects the servers of a replicated coordinator in process
+type cluster struct {
+	lock    sync.Mutex
+	servers map[string]*Server
+	https   map[string]*httptest.Server
+	down    map[string]bool
+}
+
+// peer is the connection from one server of a cluster to another
+type peer struct {
+	c        *cluster
+	from, to string
+}
+
+func (p *peer) server() (*Server, error) {
+	p.c.lock.Lock()
+	defer p.c.lock.Unlock()
+	if p.c.down[p.from] || p.c.down[p.to] {
+		return nil, errors.New("unreachable")
+	}
+	return p.c.servers[p.to], nil
+}
+
+func (p *peer) RequestVote(args *raftprotocol.RequestVoteArgs, reply *raftprotocol.RequestVoteReply) error {
+	s, err := p.server()
+	if err != nil {
+		return err
+	}
+	return s.node.RequestVote(args, reply)
+}
+
+func (p *peer) AppendEntries(args *raftprotocol.AppendEntriesArgs, reply *raftprotocol.AppendEntriesReply) error {
+	s, err := p.server()
+	if err != nil {
+		return err
+	}
+	return s.node.AppendEntries(args, reply)
+}
+
+func (p *peer) InstallSnapshot(args *raftprotocol.InstallSnapshotArgs, reply *raftprotocol.InstallSnapshotReply) error {
+	s, err := p.server()
+	if err != nil {
+		return err
+	}
+	return s.node.InstallSnapshot(args, reply)
+}
+
+// discardNotifications acknowledges notifications without delivering them
+type discardNotifications struct{}
+
+func (discardNotifications) Notify(args *notify.Args, reply *notify.Reply) error {
+	return nil
+}
+
+func newCluster(t *testing.T, ids []string) (*cluster, string) {
+	c := &cluster{
+		servers: make(map[string]*Server),
+		https:   make(map[string]*httptest.Server),
+		down:    make(map[string]bool),
+	}
+	config := windowConfig()
+	config.CuckooSeed = 5
+	urls := make([]string, 0, len(ids))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, id := range ids {
+		peers := make(map[string]raftprotocol.Interface)
+		for _, other := range ids {
+			if other != id {
+				peers[other] = &peer{c, id, other}
+			}
+		}
+		s, err := NewReplicatedServer("test-"+id, "", config, nil, 1000, time.Hour, id, peers, "")
+		if err != nil {
+			t.Fatalf("Error creating replicated server: %v", err)
+		}
+		c.servers[id] = s
+		c.https[id] = httptest.NewServer(s)
+		urls = append(urls, c.https[id].URL)
+	}
+	return c, strings.Join(urls, ",")
+}
+
+// kill stops a server, as though it crashed
+func (c *cluster) kill(id string) {
+	c.lock.Lock()
+	c.down[id] = true
+	c.lock.Unlock()
+	c.https[id].Close()
+	c.servers[id].Close()
+}
+
+func (c *cluster) close() {
+	for id := range c.servers {
+		if !c.down[id] {
+			c.kill(id)
+		}
+	}
+}
+
+func (c *cluster) leader(t *testing.T) *Server {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c.lock.Lock()
+		for id, s := range c.servers {
+			if !c.down[id] && s.node.IsLeader() {
+				c.lock.Unlock()
+				return s
+			}
+		}
+		c.lock.Unlock()
+	}
+	t.Fatalf("Timed out waiting for a leader")
+	return nil
+}
+
+// converged waits for every live server to hold the same state as expected
+func (c *cluster) converged(t *testing.T, expected *Server) {
+	expected.lock.RLock()
+	state, err := expected.marshalState()
+	expected.lock.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		same := true
+		c.lock.Lock()
+		for id, s := range c.servers {
+			if c.down[id] {
+				continue
+			}
+			s.lock.RLock()
+			other, _ := s.marshalState()
+			s.lock.RUnlock()
+			same = same && bytes.Equal(state, other)
+		}
+		c.lock.Unlock()
+		if same {
+			return
+		}
+	}
+	t.Fatalf("Servers did not converge on the same state")
+}
+
+func TestReplicatedServer(t *testing.T) {
+	c, address := newCluster(t, []string{"a", "b", "c"})
+	defer c.close()
+	client := coordinator.NewClient("test", address)
+
+	// A reference which is not replicated sees the same commits and snapshots.
+	ref, err := NewServer("ref", testAddr, c.servers["a"].config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	commit := func(n int) {
+		for i := 0; i < n; i++ {
+			args := newCommit()
+			reply := &coordinator.CommitReply{}
+			if err := client.Commit(args, reply); err != nil || reply.Err != "" {
+				t.Fatalf("Error calling Commit: %v %v", err, reply.Err)
+			}
+			ref.Commit(args, &coordinator.CommitReply{})
+		}
+	}
+	layout := func(snapshotID uint64) {
+		info := &coordinator.GetInfoReply{}
+		if err := client.GetInfo(nil, info); err != nil || info.Err != "" || info.SnapshotID != snapshotID {
+			t.Fatalf("GetInfo should report snapshot %d: %v %v", snapshotID, err, info)
+		}
+		args := &coordinator.GetLayoutArgs{SnapshotID: snapshotID, ShardID: 0, NumShards: 1}
+		reply, expected := &coordinator.GetLayoutReply{}, &coordinator.GetLayoutReply{}
+		if err := client.GetLayout(args, reply); err != nil || reply.Err != "" {
+			t.Fatalf("Error calling GetLayout: %v %v", err, reply.Err)
+		}
+		ref.GetLayout(args, expected)
+		if !reflect.DeepEqual(reply.Layout, expected.Layout) {
+			t.Fatalf("Replicated layout differs from the reference")
+		}
+	}
+
+	// Followers refuse requests.
+	leader := c.leader(t)
+	for _, s := range c.servers {
+		if s != leader {
+			reply := &coordinator.CommitReply{}
+			if s.Commit(newCommit(), reply); reply.Err != coordinator.ErrNotLeader {
+				t.Fatalf("A follower should refuse commits: %v", reply)
+			}
+		}
+	}
+
+	mock := NewMockServer()
+	target := httptest.NewServer(notify.NewServer("target", mock))
+	defer target.Close()
+	registerReply := &coordinator.RegisterReply{}
+	if err := client.Register(&coordinator.RegisterArgs{Name: "target", Address: target.URL}, registerReply); err != nil || registerReply.Err != "" {
+		t.Fatalf("Error calling Register: %v %v", err, registerReply.Err)
+	}
+	// The reference holds the same registration, without notifying it.
+	ref.Register(&coordinator.RegisterArgs{Name: "target", Address: target.URL}, &coordinator.RegisterReply{})
+	ref.lock.Lock()
+	ref.servers[len(ref.servers)-1].notifier = discardNotifications{}
+	ref.lock.Unlock()
+
+	commit(20)
+	batch := &coordinator.BatchCommitArgs{Commits: []coordinator.CommitArgs{*newCommit(), *newCommit()}}
+	batch.Commits = append(batch.Commits, batch.Commits[1])
+	batchReply := &coordinator.BatchCommitReply{}
+	if err := client.BatchCommit(batch, batchReply); err != nil || batchReply.Err != "" {
+		t.Fatalf("Error calling BatchCommit: %v %v", err, batchReply.Err)
+	}
+	if !reflect.DeepEqual(batchReply.Errs, []string{"", "", coordinator.ErrAlreadyCommitted}) {
+		t.Fatalf("Wrong status of batched commits: %v", batchReply.Errs)
+	}
+	ref.BatchCommit(batch, &coordinator.BatchCommitReply{})
+	leader.NotifySnapshot(true)
+	ref.NotifySnapshot(true)
+	if args := <-mock.Done; args.SnapshotID != 1 {
+		t.Fatalf("Wrong SnapshotID in notify: %v", args)
+	}
+	c.converged(t, ref)
+	layout(1)
+
+	// The remaining servers elect a leader holding every commit, and the
+	// client finds it.
+	for id, s := range c.servers {
+		if s == leader {
+			c.kill(id)
+		}
+	}
+	commit(20)
+	next := c.leader(t)
+	if next == leader {
+		t.Fatalf("A failed server should not remain leader")
+	}
+	next.NotifySnapshot(true)
+	ref.NotifySnapshot(true)
+	select {
+	case args := <-mock.Done:
+		if args.SnapshotID != 2 {
+			t.Fatalf("Wrong SnapshotID in notify: %v", args)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The new leader should notify registered servers")
+	}
+	c.converged(t, ref)
+	layout(2)
+	close(mock.Done)
+}
+
+func TestReplicatedDrop(t *testing.T) {
+	defer func(backoff time.Duration) { notifyBackoff = backoff }(notifyBackoff)
+	notifyBackoff = time.Millisecond
+	c, address := newCluster(t, []string{"a", "b", "c"})
+	defer c.close()
+	client := coordinator.NewClient("test", address)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	reply := &coordinator.RegisterReply{}
+	if err := client.Register(&coordinator.RegisterArgs{Name: "unreachable", Address: unreachable.URL}, reply); err != nil || reply.Err != "" {
+		t.Fatalf("Error calling Register: %v %v", err, reply.Err)
+	}
+
+	// A server dropped by the leader is dropped by every member of the
+	// cluster, so a later leader does not notify it.
+	leader := c.leader(t)
+	for i := 0; i < maxNotifyFailures; i++ {
+		leader.NotifySnapshot(true)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		registered := 0
+		for _, s := range c.servers {
+			s.lock.RLock()
+			registered += len(s.servers)
+			s.lock.RUnlock()
+		}
+		if registered == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Every server of the cluster should drop the unreachable server")
+		}
+	}
+}
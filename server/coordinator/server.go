@@ -1,10 +1,11 @@
 package coordinator
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/rpc"
@@ -12,8 +13,12 @@ import (
 	"github.com/privacylab/talek/bloom"
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/cuckoo"
+	"github.com/privacylab/talek/merkle"
 	"github.com/privacylab/talek/protocol/coordinator"
 	"github.com/privacylab/talek/protocol/notify"
+	raftprotocol "github.com/privacylab/talek/protocol/raft"
+	"github.com/privacylab/talek/server/persist"
+	"github.com/privacylab/talek/server/raft"
 	"golang.org/x/net/trace"
 )
 
@@ -26,29 +31,117 @@ type Server struct {
 	addr              string
 	snapshotThreshold uint64
 	snapshotInterval  time.Duration
+	persistPath       string                    // Persistence is disabled when empty
+	identity          *common.TrustDomainConfig // Signs snapshots, when set
+	node              *raft.Node                // Replicates ops, when the coordinator is replicated
 
 	// Thread-safe (locked)
 	lock          *sync.RWMutex
 	config        common.Config // Config
-	servers       []notify.Interface
+	servers       []*registration
 	commitLog     []*coordinator.CommitArgs // Append and read only
 	numNewCommits uint64
+	latestCommit  uint64                  // ID of the latest commit applied, placed or not
+	stats         coordinator.CommitStats // Since the server started
 	snapshotCount uint64
+	snapshotFirst uint64 // IDs of the first and last commits laid out by
+	snapshotLast  uint64 // the last snapshot
 	lastLayout    []uint64
+	layoutTree    *merkle.Tree                  // Of lastLayout, with a leaf for each bucket
+	layoutDeltas  []*layoutDelta                // Of recent snapshots, oldest first
+	signature     coordinator.SnapshotSignature // Of the last snapshot
 	intVec        []uint64
 	cuckooData    []byte
 	cuckooTable   *cuckoo.Table
 
+	// Persistence (locked)
+	wal             *persist.Log
+	logIndex        uint64 // Count of commits and snapshots applied
+	sinceCheckpoint uint64 // Snapshots since the last checkpoint
+
 	// Channels
 	notifyChan chan bool
 	closeChan  chan bool
+	dead       int32 // Use atomic
 
 	// RPC Interface
 	*rpc.Server
 }
 
+// registration is a server notified of new snapshots, and its liveness.
+type registration struct {
+	name     string
+	address  string // Empty for servers added locally, which are never dropped
+	notifier notify.Interface
+	alive    bool   // Whether the last notification was delivered
+	failures int    // Consecutive snapshots not delivered
+	acked    uint64 // The latest snapshot delivered
+}
+
+// layoutDelta is the slots of the layout which a snapshot changed
+type layoutDelta struct {
+	slots     []uint64
+	ids       []uint64
+	signature coordinator.SnapshotSignature
+}
+
+// maxLayoutDeltas is the number of recent snapshots whose changes are kept,
+// so that shards lagging by as many snapshots can catch up with deltas.
+var maxLayoutDeltas = 16
+
+// Notifications which fail are retried with exponential backoff, until
+// delivered or superseded by a newer snapshot. A registered server which
+// misses maxNotifyFailures consecutive snapshots is dropped.
+var (
+	notifyAttempts    = 5
+	notifyBackoff     = 100 * time.Millisecond
+	maxNotifyFailures = 3
+)
+
 // NewServer creates a new Talek centralized coordinator server
 func NewServer(name string, addr string, config common.Config, servers []notify.Interface, snapshotThreshold uint64, snapshotInterval time.Duration) (*Server, error) {
+	return NewPersistentServer(name, addr, config, servers, snapshotThreshold, snapshotInterval, "")
+}
+
+// NewPersistentServer creates a coordinator server which persists its state
+// in the directory persistPath, and restores any state persisted there.
+func NewPersistentServer(name string, addr string, config common.Config, servers []notify.Interface, snapshotThreshold uint64, snapshotInterval time.Duration, persistPath string) (*Server, error) {
+	s, err := newServer(name, addr, config, servers, snapshotThreshold, snapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.persistPath = persistPath
+	if persistPath != "" {
+		if err := s.restore(); err != nil {
+			s.log.Error.Printf("coordinator.NewServer(%v) could not restore persisted state: %v", name, err)
+			return nil, err
+		}
+	}
+	s.start()
+	return s, nil
+}
+
+// NewReplicatedServer creates a coordinator server identified by id, which
+// replicates its state with peers keyed by their ids. Only the leader of the
+// servers serves requests, and notifies servers of new snapshots; the others
+// reply with coordinator.ErrNotLeader. The server's raft state is persisted
+// in the directory persistPath, unless it is empty, so that it may restart
+// and rejoin the cluster.
+func NewReplicatedServer(name string, addr string, config common.Config, servers []notify.Interface, snapshotThreshold uint64, snapshotInterval time.Duration, id string, peers map[string]raftprotocol.Interface, persistPath string) (*Server, error) {
+	s, err := newServer(name, addr, config, servers, snapshotThreshold, snapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.node, err = raft.NewPersistentNode(name, id, peers, &machine{s}, persistPath)
+	if err != nil {
+		s.log.Error.Printf("coordinator.NewReplicatedServer(%v) could not restore persisted state: %v", name, err)
+		return nil, err
+	}
+	s.start()
+	return s, nil
+}
+
+func newServer(name string, addr string, config common.Config, servers []notify.Interface, snapshotThreshold uint64, snapshotInterval time.Duration) (*Server, error) {
 	s := &Server{}
 	s.log = common.NewLogger(name)
 	s.name = name
@@ -59,27 +152,23 @@ func NewServer(name string, addr string, config common.Config, servers []notify.
 
 	s.lock = &sync.RWMutex{}
 	s.config = config
-	if servers == nil {
-		s.servers = make([]notify.Interface, 0)
-	} else {
-		s.servers = servers
+	s.servers = make([]*registration, 0, len(servers))
+	for _, server := range servers {
+		s.servers = append(s.servers, &registration{notifier: server, alive: true})
 	}
 	s.commitLog = make([]*coordinator.CommitArgs, 0)
 	s.numNewCommits = 0
 	s.snapshotCount = 0
+	s.snapshotFirst = 1
 	s.lastLayout = make([]uint64, config.NumBuckets*config.BucketDepth)
-	s.intVec = buildInterestVector(config.WindowSize(), config.BloomFalsePositive, s.commitLog[:]).Bytes()
+	s.layoutTree = coordinator.LayoutTree(s.lastLayout, config.BucketDepth)
+	s.layoutDeltas = make([]*layoutDelta, 0)
+	s.intVec = buildInterestVector(config.RetentionLimit(), config.BloomFalsePositive, s.commitLog[:]).Bytes()
 	s.cuckooData = make([]byte, config.NumBuckets*config.BucketDepth*uint64(coordinator.IDSize))
 
-	// Choose a random seed for the cuckoo table
-	seedBytes := make([]byte, 8)
-	_, err := rand.Read(seedBytes)
-	if err != nil {
-		s.log.Error.Printf("coordinator.NewServer(%v) error: %v", name, err)
-		return nil, err
-	}
-	seed, _ := binary.Varint(seedBytes)
-	s.cuckooTable = cuckoo.NewTable(name, config.NumBuckets, config.BucketDepth, uint64(coordinator.IDSize), s.cuckooData, seed)
+	// Place items as the replicas of other trust domains do, so that the
+	// layout matches their databases.
+	s.cuckooTable = cuckoo.NewTable(name, config.NumBuckets, config.BucketDepth, uint64(coordinator.IDSize), s.cuckooData, config.CuckooSeed)
 	// Should not be possible
 	if s.cuckooTable == nil {
 		err := fmt.Errorf("Invalid cuckoo table parameters")
@@ -88,16 +177,22 @@ func NewServer(name string, addr string, config common.Config, servers []notify.
 	}
 	s.notifyChan = make(chan bool)
 	s.closeChan = make(chan bool)
+	return s, nil
+}
 
+// start begins taking snapshots, and serving RPCs
+func (s *Server) start() {
 	go s.loop()
 
 	// Set up the RPC server component.
 	s.Server = rpc.NewServer()
 	s.Server.RegisterCodec(json.NewCodec(), "application/json")
 	s.Server.RegisterTCPService(s, "Coordinator")
+	if s.node != nil {
+		s.Server.RegisterTCPService(s.node, "Raft")
+	}
 
-	s.log.Info.Printf("coordinator.NewServer(%v) success\n", name)
-	return s, nil
+	s.log.Info.Printf("coordinator.NewServer(%v) success\n", s.name)
 }
 
 /**********************************
@@ -108,11 +203,23 @@ func NewServer(name string, addr string, config common.Config, servers []notify.
 func (s *Server) GetInfo(args *interface{}, reply *coordinator.GetInfoReply) error {
 	tr := trace.New("Coordinator", "GetInfo")
 	defer tr.Finish()
+	if !s.leads() {
+		reply.Err = coordinator.ErrNotLeader
+		reply.Name = s.name
+		return nil
+	}
 	s.lock.RLock()
 
 	reply.Err = ""
 	reply.Name = s.name
 	reply.SnapshotID = s.snapshotCount
+	reply.Commits = s.stats
+	reply.Servers = make([]coordinator.ServerStatus, 0, len(s.servers))
+	for _, r := range s.servers {
+		if r.address != "" {
+			reply.Servers = append(reply.Servers, coordinator.ServerStatus{Name: r.name, Address: r.address, Alive: r.alive, Acked: r.acked})
+		}
+	}
 
 	s.lock.RUnlock()
 	return nil
@@ -134,6 +241,10 @@ func (s *Server) GetCommonConfig(args *interface{}, reply *common.Config) error
 func (s *Server) GetLayout(args *coordinator.GetLayoutArgs, reply *coordinator.GetLayoutReply) error {
 	tr := trace.New("Coordinator", "GetLayout")
 	defer tr.Finish()
+	if !s.leads() {
+		reply.Err = coordinator.ErrNotLeader
+		return nil
+	}
 	s.lock.RLock()
 
 	// Check for correct snapshot ID
@@ -144,30 +255,90 @@ func (s *Server) GetLayout(args *coordinator.GetLayoutArgs, reply *coordinator.G
 		return nil
 	}
 
-	// Check non-zero NumShards
-	if args.NumShards < 1 {
-		reply.Err = "NumShards must be > 0"
-		s.lock.RUnlock()
-		return nil
-	}
-
-	shardSize := uint64(len(s.lastLayout)) / args.NumShards
-	idx := args.ShardID * shardSize
-	if idx < 0 || (idx+shardSize) > uint64(len(s.lastLayout)) {
-		reply.Err = "Out of bounds ShardID"
+	start, end, err := s.shardBuckets(args.ShardID, args.NumShards)
+	if err != "" {
+		reply.Err = err
 	} else {
 		reply.Err = ""
-		reply.Layout = s.lastLayout[idx:(idx + shardSize)]
+		// Copied, since the layout is rewritten by the next snapshot.
+		depth := s.config.BucketDepth
+		reply.Layout = append([]uint64{}, s.lastLayout[start*depth:end*depth]...)
+		reply.Signature = s.signature
+		reply.Proof = s.layoutTree.Proof(int(start), int(end))
 	}
 
 	s.lock.RUnlock()
 	return nil
 }
 
+// GetLayoutDelta returns the slots of the layout for a shard which changed
+// between two snapshots, either of which may be up to maxLayoutDeltas old.
+func (s *Server) GetLayoutDelta(args *coordinator.GetLayoutDeltaArgs, reply *coordinator.GetLayoutDeltaReply) error {
+	tr := trace.New("Coordinator", "GetLayoutDelta")
+	defer tr.Finish()
+	if !s.leads() {
+		reply.Err = coordinator.ErrNotLeader
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Check that the snapshots are retained
+	reply.SnapshotID = s.snapshotCount
+	if args.ToSnapshotID > s.snapshotCount || args.FromSnapshotID > args.ToSnapshotID {
+		reply.Err = "Invalid SnapshotID"
+		return nil
+	}
+	oldest := s.snapshotCount - uint64(len(s.layoutDeltas))
+	if args.FromSnapshotID < oldest {
+		reply.Err = "Snapshot too old for a delta"
+		return nil
+	}
+
+	first, end, err := s.shardBuckets(args.ShardID, args.NumShards)
+	if err != "" {
+		reply.Err = err
+		return nil
+	}
+	start := first * s.config.BucketDepth
+	shardSize := (end - first) * s.config.BucketDepth
+
+	// Later snapshots overwrite the changes of earlier ones
+	changes := make(map[uint64]uint64)
+	for _, delta := range s.layoutDeltas[args.FromSnapshotID-oldest : args.ToSnapshotID-oldest] {
+		for i, slot := range delta.slots {
+			if slot >= start && slot < start+shardSize {
+				changes[slot-start] = delta.ids[i]
+			}
+		}
+	}
+	reply.Err = ""
+	if args.ToSnapshotID == s.snapshotCount {
+		reply.Signature = s.signature
+		reply.Proof = s.layoutTree.Proof(int(first), int(end))
+	} else if args.ToSnapshotID > oldest {
+		reply.Signature = s.layoutDeltas[args.ToSnapshotID-oldest-1].signature
+	}
+	reply.Slots = make([]uint64, 0, len(changes))
+	for slot := range changes {
+		reply.Slots = append(reply.Slots, slot)
+	}
+	sort.Slice(reply.Slots, func(i, j int) bool { return reply.Slots[i] < reply.Slots[j] })
+	reply.Layout = make([]uint64, len(reply.Slots))
+	for i, slot := range reply.Slots {
+		reply.Layout[i] = changes[slot]
+	}
+	return nil
+}
+
 // GetIntVec returns the global interest vector
 func (s *Server) GetIntVec(args *coordinator.GetIntVecArgs, reply *coordinator.GetIntVecReply) error {
 	tr := trace.New("Coordinator", "GetIntVec")
 	defer tr.Finish()
+	if !s.leads() {
+		reply.Err = coordinator.ErrNotLeader
+		return nil
+	}
 	s.lock.RLock()
 
 	// Check for correct snapshot ID
@@ -180,6 +351,7 @@ func (s *Server) GetIntVec(args *coordinator.GetIntVecArgs, reply *coordinator.G
 
 	reply.Err = ""
 	reply.IntVec = s.intVec[:]
+	reply.Signature = s.signature
 
 	s.lock.RUnlock()
 	return nil
@@ -191,24 +363,77 @@ func (s *Server) Commit(args *coordinator.CommitArgs, reply *coordinator.CommitR
 	defer tr.Finish()
 	reply.Err = ""
 
+	if s.node != nil {
+		if _, err := s.node.Propose(encodeOp(&op{kind: commitOp, commit: args})); err != nil {
+			reply.Err = proposeError(err)
+			return nil
+		}
+		s.notifyChan <- false
+		return nil
+	}
+
 	s.lock.Lock()
 
-	windowSize := s.config.WindowSize()
-	// Garbage Collect old elements
-	for uint64(len(s.commitLog)) >= windowSize {
-		_ = s.cuckooTable.Remove(asCuckooItem(s.config.NumBuckets, s.commitLog[0]))
-		s.commitLog = s.commitLog[1:]
+	// Every shard of a trust domain commits each write, so those already
+	// applied are ignored.
+	if args.ID <= s.latestCommit {
+		s.lock.Unlock()
+		return nil
+	}
+	if err := s.logRecord(&op{kind: commitOp, commit: args}); err != nil {
+		s.log.Error.Printf("%v.Commit failed to log commit: %v", s.name, err)
+		reply.Err = "Failed to log commit"
+		s.lock.Unlock()
+		return nil
+	}
+	if !s.applyCommit(args) {
+		reply.Err = coordinator.ErrCommitRejected
 	}
 
-	// Insert new item
-	s.numNewCommits++
-	s.commitLog = append(s.commitLog, args)
-	ok, _ := s.cuckooTable.Insert(asCuckooItem(s.config.NumBuckets, args))
-	if !ok {
-		s.log.Error.Fatalf("%v.processCommit failed to insert new element", s.name)
-		return fmt.Errorf("Error inserting into cuckoo table")
+	s.lock.Unlock()
+
+	// Do notifications in loop()
+	s.notifyChan <- false
+	return nil
+}
+
+// BatchCommit accepts Writes to commit without data. The batch is applied
+// under a single lock, and checked once for a snapshot. Writes whose ID is
+// already in the window are skipped, so a batch may be retried.
+func (s *Server) BatchCommit(args *coordinator.BatchCommitArgs, reply *coordinator.BatchCommitReply) error {
+	tr := trace.New("Coordinator", "BatchCommit")
+	defer tr.Finish()
+	reply.Err = ""
+	reply.Errs = make([]string, 0)
+	if len(args.Commits) == 0 {
+		return nil
+	}
+	commits := make([]*coordinator.CommitArgs, len(args.Commits))
+	for i := range args.Commits {
+		commits[i] = &args.Commits[i]
+	}
+
+	if s.node != nil {
+		errs, err := s.node.Propose(encodeOp(&op{kind: batchOp, commits: commits}))
+		if err != nil {
+			reply.Err = proposeError(err)
+			return nil
+		}
+		reply.Errs = errs.([]string)
+		s.notifyChan <- false
+		return nil
 	}
 
+	s.lock.Lock()
+
+	if err := s.logRecord(&op{kind: batchOp, commits: commits}); err != nil {
+		s.log.Error.Printf("%v.BatchCommit failed to log commits: %v", s.name, err)
+		reply.Err = "Failed to log commits"
+		s.lock.Unlock()
+		return nil
+	}
+	reply.Errs = s.applyBatch(commits)
+
 	s.lock.Unlock()
 
 	// Do notifications in loop()
@@ -216,6 +441,68 @@ func (s *Server) Commit(args *coordinator.CommitArgs, reply *coordinator.CommitR
 	return nil
 }
 
+// Register subscribes a remote server to notifications of new snapshots.
+// Registering an address again replaces its registration.
+func (s *Server) Register(args *coordinator.RegisterArgs, reply *coordinator.RegisterReply) error {
+	tr := trace.New("Coordinator", "Register")
+	defer tr.Finish()
+	if args.Address == "" {
+		reply.Err = "Address must be set"
+		return nil
+	}
+	if s.node != nil {
+		if _, err := s.node.Propose(encodeOp(&op{kind: registerOp, name: args.Name, address: args.Address})); err != nil {
+			reply.Err = proposeError(err)
+			return nil
+		}
+	}
+	s.lock.Lock()
+
+	if s.node == nil {
+		o := &op{kind: registerOp, name: args.Name, address: args.Address}
+		if err := s.logRecord(o); err != nil {
+			s.log.Error.Printf("%v.Register failed to log registration: %v", s.name, err)
+			reply.Err = "Failed to log registration"
+			s.lock.Unlock()
+			return nil
+		}
+		s.applyOp(o)
+	}
+	reply.Err = ""
+	reply.SnapshotID = s.snapshotCount
+
+	s.log.Info.Printf("%v.Register(%v, %v) success\n", s.name, args.Name, args.Address)
+	s.lock.Unlock()
+	return nil
+}
+
+// Unregister unsubscribes a remote server from notifications
+func (s *Server) Unregister(args *coordinator.UnregisterArgs, reply *coordinator.UnregisterReply) error {
+	tr := trace.New("Coordinator", "Unregister")
+	defer tr.Finish()
+	var err error
+	if s.node != nil {
+		_, err = s.node.Propose(encodeOp(&op{kind: unregisterOp, address: args.Address}))
+	} else {
+		o := &op{kind: unregisterOp, address: args.Address}
+		s.lock.Lock()
+		if err = s.logRecord(o); err != nil {
+			s.log.Error.Printf("%v.Unregister failed to log unregistration: %v", s.name, err)
+		} else {
+			err = s.applyOp(o)
+		}
+		s.lock.Unlock()
+	}
+
+	if err != nil {
+		reply.Err = proposeError(err)
+	} else {
+		reply.Err = ""
+		s.log.Info.Printf("%v.Unregister(%v) success\n", s.name, args.Address)
+	}
+	return nil
+}
+
 /**********************************
  * PUBLIC LOCAL METHODS (threadsafe)
  **********************************/
@@ -223,13 +510,30 @@ func (s *Server) Commit(args *coordinator.CommitArgs, reply *coordinator.CommitR
 // Close shuts down the server
 func (s *Server) Close() {
 	s.log.Info.Printf("%v.Close: success", s.name)
+	atomic.StoreInt32(&s.dead, 1)
 	s.closeChan <- true
+	s.lock.Lock()
+	s.closePersistence()
+	s.lock.Unlock()
+	if s.node != nil {
+		s.node.Close()
+	}
+}
+
+// SetIdentity sets the key with which snapshots are signed, and signs the
+// current snapshot. It should be called before snapshots are taken, which are
+// otherwise left unsigned.
+func (s *Server) SetIdentity(identity *common.TrustDomainConfig) {
+	s.lock.Lock()
+	s.identity = identity
+	s.signature = s.signSnapshot()
+	s.lock.Unlock()
 }
 
 // AddServer adds a server to the list that is notified on snapshot changes
 func (s *Server) AddServer(server notify.Interface) {
 	s.lock.Lock()
-	s.servers = append(s.servers, server)
+	s.servers = append(s.servers, &registration{notifier: server, alive: true})
 	s.log.Info.Printf("%v.AddServer() success\n", s.name)
 	s.lock.Unlock()
 }
@@ -238,6 +542,9 @@ func (s *Server) AddServer(server notify.Interface) {
 // If `force` is false, ignore when under a threshold
 // Returns: true if snapshot was built, false if ignored
 func (s *Server) NotifySnapshot(force bool) bool {
+	if s.node != nil {
+		return s.proposeSnapshot(force)
+	}
 	s.lock.Lock()
 
 	// Ignore if under threshold and not forcing
@@ -248,25 +555,23 @@ func (s *Server) NotifySnapshot(force bool) bool {
 		}
 	}
 
-	// Reset state
-	s.numNewCommits = 0
-	s.snapshotCount++
-
-	// Construct global interest vector
-	s.intVec = buildInterestVector(s.config.WindowSize(), s.config.BloomFalsePositive, s.commitLog[:]).Bytes()
-
-	// Copy the layout
-	for i := 0; i < len(s.lastLayout); i++ {
-		idx := i * 8
-		s.lastLayout[i], _ = binary.Uvarint(s.cuckooData[idx:(idx + 8)])
+	if err := s.logRecord(&op{kind: snapshotOp}); err != nil {
+		s.log.Error.Printf("%v.NotifySnapshot failed to log snapshot: %v", s.name, err)
+		s.lock.Unlock()
+		return false
+	}
+	s.takeSnapshot()
+	if s.wal != nil {
+		s.sinceCheckpoint++
+		if s.sinceCheckpoint >= checkpointInterval {
+			s.checkpoint()
+		}
 	}
-
-	// Sync with buildGlobalInterestVector goroutine
-	// @todo when this happens in parallel
 
 	// Send notifications only if there are servers
-	if s.servers != nil && len(s.servers) > 0 {
-		go sendNotification(s.log, s.servers[:], s.snapshotCount)
+	if len(s.servers) > 0 {
+		servers := append([]*registration{}, s.servers...)
+		go s.sendNotification(servers, s.snapshotCount)
 	}
 
 	s.log.Info.Printf("%v.NotifySnapshot() success\n", s.name)
@@ -301,6 +606,249 @@ func (s *Server) loop() {
 	}
 }
 
+// Applies a commit to the window and cuckoo table. Must hold the lock.
+func (s *Server) applyCommit(args *coordinator.CommitArgs) bool {
+	s.logIndex++
+	if args.ID > s.latestCommit {
+		s.latestCommit = args.ID
+	}
+	// Garbage Collect elements whose retention has expired
+	for len(s.commitLog) > 0 && s.config.Expired(s.commitLog[0].ID, s.commitLog[0].Time, args.ID, args.Time) {
+		_ = s.cuckooTable.Remove(asCuckooItem(s.config.NumBuckets, s.commitLog[0]))
+		s.commitLog = s.commitLog[1:]
+	}
+
+	// Insert new item
+	s.commitLog = append(s.commitLog, args)
+	ok, evicted := s.cuckooTable.Insert(asCuckooItem(s.config.NumBuckets, args))
+	if !ok && evicted == nil {
+		s.commitLog = s.commitLog[:len(s.commitLog)-1]
+		s.stats.Rejected++
+		return false
+	}
+	s.numNewCommits++
+	if ok {
+		s.stats.Placed++
+		return true
+	}
+
+	// If the table cannot place every commit in the window, the oldest are
+	// given up early rather than losing a newer one, as replicas do.
+	s.stats.Overflowed++
+	for !ok && evicted != nil {
+		oldest := asCuckooItem(s.config.NumBuckets, s.commitLog[0])
+		s.log.Warn.Printf("%v evicting commit %d early to place commit %d.", s.name, oldest.ID, evicted.ID)
+		_ = s.cuckooTable.Remove(oldest)
+		s.commitLog = s.commitLog[1:]
+		s.stats.EarlyEvictions++
+		if len(s.commitLog) == 0 || oldest.Equals(evicted) {
+			break
+		}
+		ok, evicted = s.cuckooTable.Insert(evicted)
+	}
+	// The commit itself may have been given up, if it alone filled the window.
+	return len(s.commitLog) > 0 && s.commitLog[len(s.commitLog)-1] == args
+}
+
+// Applies the commits of a batch which are not already in the window, and
+// returns the status of each. Commits no later than the latest applied are
+// already committed, as every shard of a trust domain commits each write.
+// Must hold the lock.
+func (s *Server) applyBatch(commits []*coordinator.CommitArgs) []string {
+	errs := make([]string, len(commits))
+	for i, args := range commits {
+		if (s.latestCommit > 0 && args.ID <= s.latestCommit) || s.cuckooTable.Contains(asCuckooItem(s.config.NumBuckets, args)) {
+			errs[i] = coordinator.ErrAlreadyCommitted
+		} else if !s.applyCommit(args) {
+			errs[i] = coordinator.ErrCommitRejected
+		}
+	}
+	return errs
+}
+
+// Builds a new snapshot of the layout and interest vector. Must hold the lock.
+func (s *Server) takeSnapshot() {
+	s.logIndex++
+	// Reset state
+	s.numNewCommits = 0
+	s.snapshotCount++
+
+	// Construct global interest vector
+	s.intVec = buildInterestVector(s.config.RetentionLimit(), s.config.BloomFalsePositive, s.commitLog[:]).Bytes()
+
+	// Copy the layout, keeping the slots which changed
+	delta := &layoutDelta{slots: make([]uint64, 0), ids: make([]uint64, 0)}
+	for i := 0; i < len(s.lastLayout); i++ {
+		idx := i * coordinator.IDSize
+		id, _ := binary.Uvarint(s.cuckooData[idx:(idx + coordinator.IDSize)])
+		if id != s.lastLayout[i] {
+			delta.slots = append(delta.slots, uint64(i))
+			delta.ids = append(delta.ids, id)
+			s.lastLayout[i] = id
+		}
+	}
+	s.snapshotFirst = s.latestCommit + 1
+	if len(s.commitLog) > 0 {
+		s.snapshotFirst = s.commitLog[0].ID
+	}
+	s.snapshotLast = s.latestCommit
+	s.updateLayoutTree(delta.slots)
+	s.signature = s.signSnapshot()
+	delta.signature = s.signature
+	s.layoutDeltas = append(s.layoutDeltas, delta)
+	if len(s.layoutDeltas) > maxLayoutDeltas {
+		s.layoutDeltas = s.layoutDeltas[1:]
+	}
+}
+
+// Describes the last snapshot, signed if the coordinator has an identity.
+// Must hold the lock.
+func (s *Server) signSnapshot() coordinator.SnapshotSignature {
+	signature := coordinator.SnapshotSignature{
+		SnapshotID:   s.snapshotCount,
+		NumBuckets:   s.config.NumBuckets,
+		BucketDepth:  s.config.BucketDepth,
+		FirstID:      s.snapshotFirst,
+		LastID:       s.snapshotLast,
+		LayoutDigest: s.layoutTree.Root(),
+		IntVecDigest: coordinator.Digest(s.intVec),
+	}
+	if s.identity == nil {
+		return signature
+	}
+	if err := signature.Sign(s.identity); err != nil {
+		s.log.Error.Printf("%v failed to sign snapshot %d: %v", s.name, s.snapshotCount, err)
+	}
+	return signature
+}
+
+// Rehashes the buckets of the layout holding the changed slots, which are in
+// increasing order. Must hold the lock.
+func (s *Server) updateLayoutTree(slots []uint64) {
+	depth := s.config.BucketDepth
+	for i, slot := range slots {
+		bucket := slot / depth
+		if i > 0 && slots[i-1]/depth == bucket {
+			continue
+		}
+		leaf := make([]byte, 8*depth)
+		for j, id := range s.lastLayout[bucket*depth : (bucket+1)*depth] {
+			binary.LittleEndian.PutUint64(leaf[8*j:], id)
+		}
+		s.layoutTree.Set(int(bucket), leaf)
+	}
+}
+
+// The range of buckets held by a shard, or why the shard is invalid.
+func (s *Server) shardBuckets(shardID uint64, numShards uint64) (uint64, uint64, string) {
+	if numShards < 1 {
+		return 0, 0, "NumShards must be > 0"
+	} else if shardID >= numShards {
+		return 0, 0, "Out of bounds ShardID"
+	}
+	start, end, ok := coordinator.ShardBuckets(s.config.NumBuckets, shardID, numShards)
+	if !ok {
+		return 0, 0, "NumShards must divide NumBuckets"
+	}
+	return start, end, ""
+}
+
+// Replaces any registration of a remote server. Must hold the lock.
+func (s *Server) addRegistration(name string, address string) {
+	s.removeServer(address)
+	s.servers = append(s.servers, &registration{
+		name:     name,
+		address:  address,
+		notifier: notify.NewClient(name, address),
+		alive:    true,
+	})
+}
+
+// Removes the registration of a remote server, if any. Must hold the lock.
+func (s *Server) removeServer(address string) bool {
+	for i, r := range s.servers {
+		if r.address != "" && r.address == address {
+			s.servers = append(s.servers[:i], s.servers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) sendNotification(servers []*registration, snapshotID uint64) {
+	args := &notify.Args{
+		SnapshotID: snapshotID,
+	}
+	for _, r := range servers {
+		go s.notifyServer(r, args)
+	}
+}
+
+// Delivers a notification to a server, retrying with exponential backoff.
+// Retries stop once a newer snapshot is being notified.
+func (s *Server) notifyServer(r *registration, args *notify.Args) {
+	backoff := notifyBackoff
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if atomic.LoadInt32(&s.dead) != 0 || s.superseded(args.SnapshotID) {
+				return
+			}
+		}
+		if err = r.notifier.Notify(args, &notify.Reply{}); err == nil {
+			break
+		}
+		s.log.Warn.Printf("sendNotification to %v failed: %v", r.name, err)
+	}
+	s.recordNotification(r, args.SnapshotID, err)
+}
+
+func (s *Server) superseded(snapshotID uint64) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.snapshotCount > snapshotID
+}
+
+// Tracks the liveness of a server, dropping a registered server which has
+// missed too many snapshots. A replicated coordinator drops the server from
+// every member of its cluster, through raft.
+func (s *Server) recordNotification(r *registration, snapshotID uint64, err error) {
+	s.lock.Lock()
+	if err == nil {
+		r.alive = true
+		r.failures = 0
+		if snapshotID > r.acked {
+			r.acked = snapshotID
+		}
+		s.lock.Unlock()
+		return
+	}
+	r.alive = false
+	r.failures++
+	drop := r.address != "" && r.failures >= maxNotifyFailures
+	o := &op{kind: unregisterOp, address: r.address}
+	if drop {
+		s.log.Warn.Printf("%v dropping %v after %d missed snapshots", s.name, r.address, r.failures)
+	}
+	if drop && s.node == nil {
+		if err := s.logRecord(o); err != nil {
+			s.log.Error.Printf("%v failed to log dropping %v: %v", s.name, r.address, err)
+		} else {
+			s.applyOp(o)
+		}
+	}
+	s.lock.Unlock()
+
+	if drop && s.node != nil {
+		// Proposed without the lock, which applying the op takes.
+		if _, err := s.node.Propose(encodeOp(o)); err != nil && err != errNotRegistered {
+			s.log.Warn.Printf("%v failed to drop %v: %v", s.name, r.address, err)
+		}
+	}
+}
+
 /**********************************
  * HELPER FUNCTIONS
  **********************************/
@@ -333,18 +881,3 @@ func buildInterestVector(n uint64, fp float64, commitLog []*coordinator.CommitAr
 	}
 	return intVec
 }
-
-func sendNotification(log *common.Logger, servers []notify.Interface, snapshotID uint64) {
-	args := &notify.Args{
-		SnapshotID: snapshotID,
-	}
-	doNotify := func(l *common.Logger, s notify.Interface, args *notify.Args) {
-		err := s.Notify(args, &notify.Reply{})
-		if err != nil {
-			l.Error.Printf("sendNotification failed: %v", err)
-		}
-	}
-	for _, s := range servers {
-		go doNotify(log, s, args)
-	}
-}
@@ -1,10 +1,16 @@
 package coordinator
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +18,7 @@ import (
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/protocol/coordinator"
 	"github.com/privacylab/talek/protocol/notify"
+	"github.com/privacylab/talek/server/persist"
 )
 
 const testAddr = "localhost:9876"
@@ -32,6 +39,15 @@ func testConfig() common.Config {
 	}
 }
 
+// windowConfig has a table deep enough to hold a full window of random
+// commits, for tests which commit many
+func windowConfig() common.Config {
+	config := testConfig()
+	config.NumBuckets = 16
+	config.BucketDepth = 4
+	return config
+}
+
 func afterEach(server *Server, mockChan []chan *notify.Args) {
 	if server != nil {
 		server.Close()
@@ -55,7 +71,21 @@ func NewMockServer() *MockServer {
 
 func (s *MockServer) Notify(args *notify.Args, reply *notify.Reply) error {
 	s.Done <- args
-	return fmt.Errorf("test")
+	return nil
+}
+
+// FlakyServer fails to receive the first notifications sent to it
+type FlakyServer struct {
+	failures int32
+	Done     chan *notify.Args
+}
+
+func (s *FlakyServer) Notify(args *notify.Args, reply *notify.Reply) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return fmt.Errorf("test")
+	}
+	s.Done <- args
+	return nil
 }
 
 func setupMocks(n int) ([]notify.Interface, []chan *notify.Args) {
@@ -69,9 +99,12 @@ func setupMocks(n int) ([]notify.Interface, []chan *notify.Args) {
 	return servers, channels
 }
 
+// lastCommitID orders test commits by GlobalSeqNo, as the frontend does.
+var lastCommitID uint64
+
 func newCommit() *coordinator.CommitArgs {
 	return &coordinator.CommitArgs{
-		ID:        rand.Uint64(),
+		ID:        atomic.AddUint64(&lastCommitID, 1),
 		Bucket1:   rand.Uint64(),
 		Bucket2:   rand.Uint64(),
 		IntVecLoc: []uint64{rand.Uint64(), rand.Uint64()},
@@ -119,8 +152,11 @@ func TestBuildInterestVector(t *testing.T) {
 func TestSendNotification(t *testing.T) {
 	numServers := 3
 	mocks, channels := setupMocks(numServers)
-	log := common.NewLogger("test")
-	sendNotification(log, mocks, 10)
+	s, err := NewServer("test", testAddr, testConfig(), mocks, 5, time.Hour)
+	if err != nil {
+		t.Errorf("Error creating new server")
+	}
+	s.sendNotification(s.servers, 10)
 	// Wait for all notifications
 
 	for i := 0; i < numServers; i++ {
@@ -135,7 +171,94 @@ func TestSendNotification(t *testing.T) {
 			break
 		}
 	}
-	afterEach(nil, channels)
+	afterEach(s, channels)
+}
+
+func TestNotificationRetry(t *testing.T) {
+	defer func(backoff time.Duration) { notifyBackoff = backoff }(notifyBackoff)
+	notifyBackoff = time.Millisecond
+	flaky := &FlakyServer{failures: 2, Done: make(chan *notify.Args)}
+	s, err := NewServer("test", testAddr, testConfig(), []notify.Interface{flaky}, 5, time.Hour)
+	if err != nil {
+		t.Errorf("Error creating new server")
+	}
+	s.NotifySnapshot(true)
+	select {
+	case args := <-flaky.Done:
+		if args.SnapshotID != 1 {
+			t.Errorf("Wrong SnapshotID in notify")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Failed notification was not retried")
+	}
+	afterEach(s, []chan *notify.Args{flaky.Done})
+}
+
+func TestRegister(t *testing.T) {
+	defer func(backoff time.Duration) { notifyBackoff = backoff }(notifyBackoff)
+	notifyBackoff = time.Millisecond
+	s, err := NewServer("test", testAddr, testConfig(), nil, 5, time.Hour)
+	if err != nil {
+		t.Errorf("Error creating new server")
+	}
+	mock := NewMockServer()
+	target := httptest.NewServer(notify.NewServer("target", mock))
+	defer target.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	register := func(name string, address string) {
+		reply := &coordinator.RegisterReply{}
+		if s.Register(&coordinator.RegisterArgs{Name: name, Address: address}, reply) != nil || reply.Err != "" {
+			t.Errorf("Register should have succeeded: %v", reply)
+		}
+	}
+	servers := func() []coordinator.ServerStatus {
+		reply := &coordinator.GetInfoReply{}
+		if s.GetInfo(nil, reply) != nil {
+			t.Errorf("Error calling GetInfo")
+		}
+		return reply.Servers
+	}
+	register("target", target.URL)
+	register("unreachable", unreachable.URL)
+	// Registering again replaces the registration
+	register("target", target.URL)
+	if len(servers()) != 2 {
+		t.Errorf("Both servers should be registered: %v", servers())
+	}
+
+	// The reachable server acknowledges every snapshot, while the
+	// unreachable one is dropped after missing too many.
+	for i := 1; i <= maxNotifyFailures; i++ {
+		s.NotifySnapshot(true)
+		select {
+		case args := <-mock.Done:
+			if args.SnapshotID != uint64(i) {
+				t.Errorf("Wrong SnapshotID in notify")
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Timed out before the registered server got a notification")
+		}
+		// Wait for the unreachable server to exhaust its retries.
+		time.Sleep(50 * time.Millisecond)
+	}
+	status := servers()
+	if len(status) != 1 || status[0].Address != target.URL || !status[0].Alive || status[0].Acked != uint64(maxNotifyFailures) {
+		t.Errorf("Only the reachable server should remain registered: %v", status)
+	}
+
+	reply := &coordinator.UnregisterReply{}
+	if s.Unregister(&coordinator.UnregisterArgs{Address: target.URL}, reply) != nil || reply.Err != "" {
+		t.Errorf("Unregister should have succeeded: %v", reply)
+	}
+	if s.Unregister(&coordinator.UnregisterArgs{Address: target.URL}, reply) != nil || reply.Err == "" {
+		t.Errorf("Unregister should fail for an address not registered: %v", reply)
+	}
+	if len(servers()) != 0 {
+		t.Errorf("No servers should remain registered: %v", servers())
+	}
+	afterEach(s, []chan *notify.Args{mock.Done})
 }
 
 func TestNewServer(t *testing.T) {
@@ -263,6 +386,63 @@ func TestGetLayoutEmpty(t *testing.T) {
 	afterEach(s, nil)
 }
 
+func TestGetLayoutDelta(t *testing.T) {
+	defer func(max int) { maxLayoutDeltas = max }(maxLayoutDeltas)
+	maxLayoutDeltas = 3
+	s, err := NewServer("test", testAddr, windowConfig(), nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	s.SetIdentity(common.NewTrustDomainConfig("coordinator", "", true, false))
+	layouts := [][]uint64{make([]uint64, len(s.lastLayout))}
+	for i := 0; i < 5; i++ {
+		s.Commit(newCommit(), &coordinator.CommitReply{})
+		s.Commit(newCommit(), &coordinator.CommitReply{})
+		s.NotifySnapshot(true)
+		layouts = append(layouts, append([]uint64{}, s.lastLayout...))
+	}
+
+	// Applying a delta to a shard's layout yields the later layout.
+	for from := 2; from <= 5; from++ {
+		for to := from; to <= 5; to++ {
+			for shard := 0; shard < 2; shard++ {
+				args := &coordinator.GetLayoutDeltaArgs{FromSnapshotID: uint64(from), ToSnapshotID: uint64(to), ShardID: uint64(shard), NumShards: 2}
+				reply := &coordinator.GetLayoutDeltaReply{}
+				if s.GetLayoutDelta(args, reply) != nil || reply.Err != "" || reply.SnapshotID != 5 {
+					t.Fatalf("Error calling GetLayoutDelta(%d, %d): %v", from, to, reply)
+				}
+				size := len(s.lastLayout) / 2
+				layout := append([]uint64{}, layouts[from][shard*size:(shard+1)*size]...)
+				for i, slot := range reply.Slots {
+					layout[slot] = reply.Layout[i]
+				}
+				if !reflect.DeepEqual(layout, layouts[to][shard*size:(shard+1)*size]) {
+					t.Fatalf("Delta from %d to %d does not produce the later layout", from, to)
+				}
+				// Deltas to the current snapshot prove the shard's layout.
+				if to == 5 && !reply.Signature.VerifyLayout(layout, uint64(shard), 2, reply.Proof) {
+					t.Fatalf("Delta from %d does not prove the layout of shard %d", from, shard)
+				}
+			}
+		}
+	}
+
+	invalid := []*coordinator.GetLayoutDeltaArgs{
+		{FromSnapshotID: 1, ToSnapshotID: 5, NumShards: 1}, // No longer retained
+		{FromSnapshotID: 4, ToSnapshotID: 3, NumShards: 1},
+		{FromSnapshotID: 4, ToSnapshotID: 6, NumShards: 1},
+		{FromSnapshotID: 4, ToSnapshotID: 5, NumShards: 0},
+		{FromSnapshotID: 4, ToSnapshotID: 5, ShardID: 2, NumShards: 2},
+	}
+	for _, args := range invalid {
+		reply := &coordinator.GetLayoutDeltaReply{}
+		if s.GetLayoutDelta(args, reply) != nil || reply.Err == "" {
+			t.Fatalf("GetLayoutDelta(%v) should fail", args)
+		}
+	}
+	afterEach(s, nil)
+}
+
 func TestGetIntVecInvalidSnapshotID(t *testing.T) {
 	s, err := NewServer("test", testAddr, testConfig(), nil, 5, time.Hour)
 	if err != nil {
@@ -316,6 +496,165 @@ func TestCommit(t *testing.T) {
 	afterEach(s, nil)
 }
 
+func TestBatchCommit(t *testing.T) {
+	config := testConfig()
+	config.CuckooSeed = 4
+	s, err := NewServer("test", testAddr, config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	ref, err := NewServer("ref", testAddr, config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	reply := &coordinator.BatchCommitReply{}
+	if s.BatchCommit(&coordinator.BatchCommitArgs{}, reply) != nil || reply.Err != "" || len(reply.Errs) != 0 {
+		t.Fatalf("An empty batch should succeed: %v", reply)
+	}
+
+	// Writes already in the window, or earlier in the batch, are skipped.
+	existing, a, b := newCommit(), newCommit(), newCommit()
+	s.Commit(existing, &coordinator.CommitReply{})
+	args := &coordinator.BatchCommitArgs{Commits: []coordinator.CommitArgs{*a, *existing, *b, *a}}
+	if s.BatchCommit(args, reply) != nil || reply.Err != "" {
+		t.Fatalf("Error calling BatchCommit: %v", reply)
+	}
+	expected := []string{"", coordinator.ErrAlreadyCommitted, "", coordinator.ErrAlreadyCommitted}
+	if !reflect.DeepEqual(reply.Errs, expected) {
+		t.Fatalf("Wrong status of batched commits: %v", reply.Errs)
+	}
+	if s.numNewCommits != 3 {
+		t.Fatalf("Batch should have committed 2 writes, have %d new commits", s.numNewCommits)
+	}
+
+	// The batch lays out the same as its writes committed one at a time.
+	for _, commit := range []*coordinator.CommitArgs{existing, a, b} {
+		ref.Commit(commit, &coordinator.CommitReply{})
+	}
+	s.NotifySnapshot(true)
+	ref.NotifySnapshot(true)
+	layoutArgs := &coordinator.GetLayoutArgs{SnapshotID: 1, ShardID: 0, NumShards: 1}
+	layout, refLayout := &coordinator.GetLayoutReply{}, &coordinator.GetLayoutReply{}
+	s.GetLayout(layoutArgs, layout)
+	ref.GetLayout(layoutArgs, refLayout)
+	if layout.Err != "" || !reflect.DeepEqual(layout.Layout, refLayout.Layout) {
+		t.Fatalf("Batched layout differs from the reference: %v %v", layout, refLayout)
+	}
+	ref.Close()
+	afterEach(s, nil)
+}
+
+func TestOverflow(t *testing.T) {
+	// A table with no spare room overflows often.
+	config := testConfig()
+	config.NumBuckets = 4
+	config.BucketDepth = 1
+	config.MaxLoadFactor = 1
+	s, err := NewServer("test", testAddr, config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	numCommits := 200
+	for i := 0; i < numCommits; i++ {
+		args := newCommit()
+		args.ID = uint64(i + 1)
+		reply := &coordinator.CommitReply{}
+		if s.Commit(args, reply) != nil || reply.Err != "" {
+			t.Fatalf("Commit should have succeeded: %v", reply)
+		}
+	}
+
+	info := &coordinator.GetInfoReply{}
+	s.GetInfo(nil, info)
+	stats := info.Commits
+	if stats.Placed+stats.Overflowed != uint64(numCommits) || stats.Rejected != 0 {
+		t.Fatalf("Every commit should have been placed: %+v", stats)
+	}
+	if stats.Overflowed == 0 || stats.EarlyEvictions < stats.Overflowed {
+		t.Fatalf("Commits should have overflowed, evicting older ones: %+v", stats)
+	}
+
+	// The window holds exactly the commits in the table.
+	s.lock.RLock()
+	if uint64(len(s.commitLog)) > config.WindowSize() || s.cuckooTable.GetNumElements() != uint64(len(s.commitLog)) {
+		t.Fatalf("Window of %d commits differs from table of %d", len(s.commitLog), s.cuckooTable.GetNumElements())
+	}
+	for _, c := range s.commitLog {
+		if !s.cuckooTable.Contains(asCuckooItem(config.NumBuckets, c)) {
+			t.Fatalf("Commit %d in the window is not in the table", c.ID)
+		}
+	}
+	if s.commitLog[len(s.commitLog)-1].ID != uint64(numCommits) {
+		t.Fatalf("The newest commit should never be given up")
+	}
+	s.lock.RUnlock()
+	afterEach(s, nil)
+}
+
+func TestRetention(t *testing.T) {
+	config := windowConfig()
+	config.MinRetention = time.Minute
+	config.MaxRetainedItems = config.WindowSize() + 8
+	s, err := NewServer("test", testAddr, config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating new server")
+	}
+	start := time.Now()
+	commit := func(id uint64, at time.Duration) {
+		args := newCommit()
+		args.ID = id
+		args.Time = start.Add(at).UnixNano()
+		reply := &coordinator.CommitReply{}
+		if s.Commit(args, reply) != nil || reply.Err != "" {
+			t.Fatalf("Commit should have succeeded: %v", reply)
+		}
+	}
+	kept := func() (uint64, int) {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.commitLog[0].ID, len(s.commitLog)
+	}
+
+	// Commits younger than MinRetention outlive the window, until
+	// MaxRetainedItems newer have been written.
+	window, limit := config.WindowSize(), config.MaxRetainedItems
+	for id := uint64(1); id <= limit+1; id++ {
+		commit(id, time.Duration(id)*time.Second)
+		if oldest, n := kept(); id <= limit && (oldest != 1 || uint64(n) != id) {
+			t.Fatalf("Expected young commits 1 through %d to be kept, got %d from %d", id, n, oldest)
+		}
+	}
+	if oldest, n := kept(); oldest != 2 || uint64(n) != limit {
+		t.Fatalf("Expected commits 2 through %d to be kept, got %d from %d", limit+1, n, oldest)
+	}
+	// Once MinRetention old, commits beyond the window are evicted.
+	next := limit + 2
+	commit(next, 2*time.Minute)
+	if oldest, n := kept(); oldest != next+1-window || uint64(n) != window {
+		t.Fatalf("Expected commits %d through %d to be kept, got %d from %d", next+1-window, next, n, oldest)
+	}
+	// A gap in seqnos, as after writes aborted elsewhere, evicts by seqno,
+	// but for the young commit within MaxRetainedItems.
+	commit(next+limit-1, 2*time.Minute)
+	if oldest, n := kept(); oldest != next || n != 2 {
+		t.Fatalf("Commits should be evicted by seqno, kept %d from %d", n, oldest)
+	}
+
+	// The retention guaranteed is published to clients.
+	published := &common.Config{}
+	s.GetCommonConfig(nil, published)
+	if published.MinRetention != config.MinRetention || published.RetentionLimit() != limit {
+		t.Fatalf("Retention policy should be published, got %v and %d", published.MinRetention, published.RetentionLimit())
+	}
+	// No more than the table holds is kept, whatever MaxRetainedItems.
+	capacity := config.NumBuckets * config.BucketDepth
+	published.MaxRetainedItems = 2 * capacity
+	if published.RetentionLimit() != capacity {
+		t.Fatalf("Retention should be limited to the %d items of the table, got %d", capacity, published.RetentionLimit())
+	}
+	afterEach(s, nil)
+}
+
 func TestAddServer(t *testing.T) {
 	numServers := 3
 	mocks, channels := setupMocks(numServers)
@@ -366,14 +705,19 @@ func TestSnapshot(t *testing.T) {
 	if layoutReply.Err != "" || layoutReply.SnapshotID != 1 {
 		t.Errorf("GetLayout error: %v", layoutReply)
 	}
+	found := false
 	for i, id := range layoutReply.Layout {
 		if id == commit.ID {
+			found = true
 			bucket := uint64(i) / config.BucketDepth
-			if bucket != commit.Bucket1 && bucket != commit.Bucket2 {
+			if bucket != commit.Bucket1%config.NumBuckets && bucket != commit.Bucket2%config.NumBuckets {
 				t.Errorf("Invalid layout. Commit not in correct location")
 			}
 		}
 	}
+	if !found {
+		t.Errorf("Invalid layout. Commit not found")
+	}
 	// Check interest vector
 	intVecArgs := &coordinator.GetIntVecArgs{SnapshotID: 1}
 	intVecReply := &coordinator.GetIntVecReply{}
@@ -448,3 +792,259 @@ func TestSnapshotTimer(t *testing.T) {
 	afterEach(s, channels)
 
 }
+
+func TestPersistence(t *testing.T) {
+	defer func(interval uint64) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 3
+	dir, err := ioutil.TempDir("", "coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := windowConfig()
+	config.CuckooSeed = 3
+	open := func() *Server {
+		s, err := NewPersistentServer("test", testAddr, config, nil, 1000, time.Hour, dir)
+		if err != nil {
+			t.Fatalf("Error restoring server: %v", err)
+		}
+		return s
+	}
+	// A crashed server writes nothing more to disk.
+	crash := func(s *Server) {
+		s.lock.Lock()
+		s.wal.Close()
+		s.wal = nil
+		s.lock.Unlock()
+		s.Close()
+	}
+	commit := func(servers ...*Server) {
+		args := newCommit()
+		for _, s := range servers {
+			if err := s.Commit(args, &coordinator.CommitReply{}); err != nil {
+				t.Fatalf("Error calling Commit: %v", err)
+			}
+		}
+	}
+	snapshot := func(servers ...*Server) {
+		for _, s := range servers {
+			s.NotifySnapshot(true)
+		}
+	}
+	same := func(expected *Server, s *Server) {
+		expected.lock.RLock()
+		s.lock.RLock()
+		a, errA := expected.marshalState()
+		b, errB := s.marshalState()
+		s.lock.RUnlock()
+		expected.lock.RUnlock()
+		if errA != nil || errB != nil {
+			t.Fatalf("Error marshaling state: %v %v", errA, errB)
+		}
+		if !bytes.Equal(a, b) {
+			t.Fatalf("Restored server differs from one which never restarted")
+		}
+	}
+
+	// A reference which never restarts sees the same commits and snapshots.
+	ref, err := NewServer("ref", testAddr, config, nil, 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := open()
+	for i := 0; i < 30; i++ {
+		commit(ref, s)
+		if i%4 == 3 {
+			snapshot(ref, s)
+		}
+	}
+	crash(s)
+
+	// Replay combines the last checkpoint with the log since.
+	s = open()
+	same(ref, s)
+	reply := &coordinator.GetLayoutReply{}
+	if s.GetLayout(&coordinator.GetLayoutArgs{SnapshotID: 7, ShardID: 0, NumShards: 1}, reply) != nil || reply.Err != "" {
+		t.Fatalf("Restored server should serve the last snapshot: %v", reply)
+	}
+
+	// A commit torn by a crash is discarded.
+	commit(s)
+	crash(s)
+	info, err := os.Stat(s.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(s.logPath(), info.Size()-2)
+	s = open()
+	same(ref, s)
+
+	// A crash after checkpointing, before the log is truncated, leaves
+	// records which the checkpoint already covers.
+	checkpointInterval = s.sinceCheckpoint + 1
+	commit(ref, s)
+	commit(ref, s)
+	stale, err := ioutil.ReadFile(s.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := s.logIndex
+	snapshot(ref, s)
+	if s.sinceCheckpoint != 0 {
+		t.Fatalf("Snapshot should have checkpointed")
+	}
+	crash(s)
+	ioutil.WriteFile(s.logPath(), stale, 0600)
+	wal, err := persist.OpenLog(s.logPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Append(encodeRecord(index, &op{kind: snapshotOp}))
+	wal.Close()
+	s = open()
+	same(ref, s)
+
+	// The restored server makes the same choices as the reference.
+	for i := 0; i < 10; i++ {
+		commit(ref, s)
+	}
+	snapshot(ref, s)
+	same(ref, s)
+
+	// A batch is logged as one record, and replays to the same statuses.
+	batch := &coordinator.BatchCommitArgs{Commits: []coordinator.CommitArgs{*newCommit(), *newCommit()}}
+	batch.Commits = append(batch.Commits, batch.Commits[0])
+	for _, server := range []*Server{ref, s} {
+		if err := server.BatchCommit(batch, &coordinator.BatchCommitReply{}); err != nil {
+			t.Fatalf("Error calling BatchCommit: %v", err)
+		}
+	}
+	crash(s)
+	s = open()
+	same(ref, s)
+
+	// A graceful shutdown checkpoints the final state.
+	s.Close()
+	s = open()
+	same(ref, s)
+	if info, err := os.Stat(s.logPath()); err != nil || info.Size() != 0 {
+		t.Fatalf("Log should be empty after a checkpoint: %v", err)
+	}
+	s.Close()
+	ref.Close()
+}
+
+func TestPersistRegistrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func() *Server {
+		s, err := NewPersistentServer("test", testAddr, testConfig(), nil, 1000, time.Hour, dir)
+		if err != nil {
+			t.Fatalf("Error restoring server: %v", err)
+		}
+		return s
+	}
+	registered := func(s *Server) []string {
+		reply := &coordinator.GetInfoReply{}
+		if s.GetInfo(nil, reply) != nil {
+			t.Fatalf("Error calling GetInfo")
+		}
+		addresses := make([]string, 0)
+		for _, status := range reply.Servers {
+			addresses = append(addresses, status.Name+"@"+status.Address)
+		}
+		return addresses
+	}
+
+	s := open()
+	for _, name := range []string{"a", "b", "c"} {
+		reply := &coordinator.RegisterReply{}
+		if s.Register(&coordinator.RegisterArgs{Name: name, Address: "http://" + name}, reply) != nil || reply.Err != "" {
+			t.Fatalf("Register should have succeeded: %v", reply)
+		}
+	}
+	reply := &coordinator.UnregisterReply{}
+	if s.Unregister(&coordinator.UnregisterArgs{Address: "http://b"}, reply) != nil || reply.Err != "" {
+		t.Fatalf("Unregister should have succeeded: %v", reply)
+	}
+	expected := fmt.Sprint(registered(s))
+
+	// Registrations are replayed from the log after a crash.
+	s.lock.Lock()
+	s.wal.Close()
+	s.wal = nil
+	s.lock.Unlock()
+	s.Close()
+	s = open()
+	if fmt.Sprint(registered(s)) != expected {
+		t.Fatalf("Registrations should survive a crash: %v rather than %v", registered(s), expected)
+	}
+
+	// And restored from the checkpoint made as the server closes.
+	s.Close()
+	s = open()
+	if fmt.Sprint(registered(s)) != expected {
+		t.Fatalf("Registrations should survive a restart: %v rather than %v", registered(s), expected)
+	}
+	s.Close()
+}
+
+func benchServer(b *testing.B) (*Server, []*coordinator.CommitArgs) {
+	config := common.Config{
+		NumBuckets:         1024,
+		BucketDepth:        4,
+		DataSize:           256,
+		BloomFalsePositive: 0.01,
+		WriteInterval:      time.Minute,
+		ReadInterval:       time.Minute,
+		MaxLoadFactor:      0.50,
+	}
+	s, err := NewServer("bench", testAddr, config, nil, config.WindowSize(), time.Hour)
+	if err != nil {
+		b.Fatalf("Error creating new server")
+	}
+	commits := make([]*coordinator.CommitArgs, b.N)
+	for i := range commits {
+		commits[i] = newCommit()
+	}
+	return s, commits
+}
+
+func BenchmarkCommit(b *testing.B) {
+	s, commits := benchServer(b)
+	b.ResetTimer()
+	for _, args := range commits {
+		reply := &coordinator.CommitReply{}
+		if s.Commit(args, reply) != nil || reply.Err != "" {
+			b.Fatalf("Error calling Commit: %v", reply)
+		}
+	}
+	b.StopTimer()
+	s.Close()
+}
+
+func BenchmarkBatchCommit(b *testing.B) {
+	batchSize := 64
+	s, commits := benchServer(b)
+	b.ResetTimer()
+	for i := 0; i < len(commits); i += batchSize {
+		args := &coordinator.BatchCommitArgs{}
+		for _, c := range commits[i:] {
+			if len(args.Commits) == batchSize {
+				break
+			}
+			args.Commits = append(args.Commits, *c)
+		}
+		reply := &coordinator.BatchCommitReply{}
+		if s.BatchCommit(args, reply) != nil || reply.Err != "" {
+			b.Fatalf("Error calling BatchCommit: %v", reply)
+		}
+	}
+	b.StopTimer()
+	s.Close()
+}
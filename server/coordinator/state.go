@@ -0,0 +1,269 @@
+package coordinator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/server/persist"
+)
+
+// The coordinator persists its state as a checkpoint of its window of
+// commits, cuckoo table, the last snapshot served, and the servers registered
+// for notifications, plus a log of the commits, snapshots and registrations
+// made since that checkpoint. Replaying the log makes the same choices as were
+// made live, so a restarted coordinator serves the same SnapshotID and layout
+// to the same servers. Each logged record carries the count of records applied
+// before it, so records already covered by the checkpoint are skipped if a
+// crash interrupts log truncation.
+
+// checkpointInterval is the number of snapshots between checkpoints.
+var checkpointInterval uint64 = 16
+
+func (s *Server) checkpointPath() string {
+	return filepath.Join(s.persistPath, s.name+".checkpoint")
+}
+
+func (s *Server) logPath() string {
+	return filepath.Join(s.persistPath, s.name+".wal")
+}
+
+// restore recovers the persisted state of the coordinator, and opens its log
+// for subsequent records. It must be called before the server's loop starts.
+func (s *Server) restore() error {
+	if err := os.MkdirAll(s.persistPath, 0700); err != nil {
+		return err
+	}
+
+	state, err := persist.ReadSnapshot(s.checkpointPath())
+	if err == nil {
+		if err = s.unmarshalState(state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	replayed := 0
+	_, err = persist.ReadLog(s.logPath(), func(record []byte) error {
+		index, o, err := decodeRecord(record)
+		if err != nil {
+			return err
+		}
+		if index < s.logIndex {
+			return nil
+		} else if index > s.logIndex {
+			return fmt.Errorf("log skips from record %d to %d", s.logIndex, index)
+		}
+		// Commits rejected live are rejected again.
+		if err = s.applyOp(o); err != nil && err != errCommitRejected {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.wal, err = persist.OpenLog(s.logPath())
+	if err != nil {
+		return err
+	}
+	s.log.Info.Printf("Restored snapshot %d with %d commits, %d records from log.", s.snapshotCount, len(s.commitLog), replayed)
+	return nil
+}
+
+// logRecord appends an op to the log ahead of applying it. Must hold the lock.
+func (s *Server) logRecord(o *op) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Append(encodeRecord(s.logIndex, o))
+}
+
+// checkpoint durably records the current state, and truncates the log.
+// Must hold the lock.
+func (s *Server) checkpoint() {
+	state, err := s.marshalState()
+	if err == nil {
+		err = persist.WriteSnapshot(s.checkpointPath(), state)
+	}
+	if err == nil {
+		err = s.wal.Reset()
+	}
+	if err != nil {
+		s.log.Error.Printf("Failed to checkpoint coordinator: %v", err)
+		return
+	}
+	s.sinceCheckpoint = 0
+}
+
+// Must hold the lock.
+func (s *Server) closePersistence() {
+	if s.wal == nil {
+		return
+	}
+	s.checkpoint()
+	s.wal.Close()
+	s.wal = nil
+}
+
+func (s *Server) marshalState() ([]byte, error) {
+	var buf bytes.Buffer
+	header := []uint64{s.logIndex, s.snapshotCount, s.numNewCommits, uint64(len(s.commitLog)), s.latestCommit, s.snapshotFirst, s.snapshotLast}
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	for _, c := range s.commitLog {
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{c.ID, c.Bucket1, c.Bucket2, uint64(c.Time), uint64(len(c.IntVecLoc))}); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(&buf, binary.LittleEndian, c.IntVecLoc); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, s.lastLayout); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, uint64(len(s.intVec))); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, s.intVec); err != nil {
+		return nil, err
+	}
+	// Servers given to NewServer have no address, and are given again.
+	registered := make([]*registration, 0, len(s.servers))
+	for _, r := range s.servers {
+		if r.address != "" {
+			registered = append(registered, r)
+		}
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, uint64(len(registered))); err != nil {
+		return nil, err
+	}
+	for _, r := range registered {
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{uint64(len(r.name)), uint64(len(r.address))}); err != nil {
+			return nil, err
+		}
+		buf.WriteString(r.name)
+		buf.WriteString(r.address)
+	}
+	table, err := s.cuckooTable.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(table)
+	return buf.Bytes(), nil
+}
+
+func (s *Server) unmarshalState(data []byte) error {
+	reader := bytes.NewReader(data)
+	var header [7]uint64
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header[3] > s.config.RetentionLimit() {
+		return errors.New("checkpoint has more commits than the window holds")
+	}
+	commitLog := make([]*coordinator.CommitArgs, header[3])
+	for i := range commitLog {
+		var c [5]uint64
+		if err := binary.Read(reader, binary.LittleEndian, &c); err != nil {
+			return err
+		}
+		if c[4] > uint64(reader.Len())/8 {
+			return errors.New("malformed commit in checkpoint")
+		}
+		commitLog[i] = &coordinator.CommitArgs{ID: c[0], Bucket1: c[1], Bucket2: c[2], Time: int64(c[3]), IntVecLoc: make([]uint64, c[4])}
+		if err := binary.Read(reader, binary.LittleEndian, commitLog[i].IntVecLoc); err != nil {
+			return err
+		}
+	}
+	layout := make([]uint64, len(s.lastLayout))
+	if err := binary.Read(reader, binary.LittleEndian, layout); err != nil {
+		return err
+	}
+	var intVecLength uint64
+	if err := binary.Read(reader, binary.LittleEndian, &intVecLength); err != nil {
+		return err
+	}
+	if intVecLength > uint64(reader.Len())/8 {
+		return errors.New("malformed interest vector in checkpoint")
+	}
+	intVec := make([]uint64, intVecLength)
+	if err := binary.Read(reader, binary.LittleEndian, intVec); err != nil {
+		return err
+	}
+	var numRegistered uint64
+	if err := binary.Read(reader, binary.LittleEndian, &numRegistered); err != nil {
+		return err
+	}
+	if numRegistered > uint64(reader.Len())/16 {
+		return errors.New("malformed registrations in checkpoint")
+	}
+	registered := make([][2]string, numRegistered)
+	for i := range registered {
+		var lengths [2]uint64
+		if err := binary.Read(reader, binary.LittleEndian, &lengths); err != nil {
+			return err
+		}
+		if lengths[0]+lengths[1] > uint64(reader.Len()) {
+			return errors.New("malformed registration in checkpoint")
+		}
+		field := make([]byte, lengths[0]+lengths[1])
+		reader.Read(field)
+		registered[i] = [2]string{string(field[:lengths[0]]), string(field[lengths[0]:])}
+	}
+	table := make([]byte, reader.Len())
+	reader.Read(table)
+	if err := s.cuckooTable.UnmarshalBinary(table); err != nil {
+		return err
+	}
+	s.logIndex = header[0]
+	s.snapshotCount = header[1]
+	s.numNewCommits = header[2]
+	s.latestCommit, s.snapshotFirst, s.snapshotLast = header[4], header[5], header[6]
+	s.commitLog = commitLog
+	s.lastLayout = layout
+	s.layoutTree = coordinator.LayoutTree(layout, s.config.BucketDepth)
+	// Deltas are not persisted, so none reach back before a checkpoint.
+	s.layoutDeltas = make([]*layoutDelta, 0)
+	s.intVec = intVec
+	// The registrations replace all but the servers given to NewServer.
+	servers := make([]*registration, 0, len(s.servers))
+	for _, r := range s.servers {
+		if r.address == "" {
+			servers = append(servers, r)
+		}
+	}
+	s.servers = servers
+	for _, r := range registered {
+		s.addRegistration(r[0], r[1])
+	}
+	s.signature = s.signSnapshot()
+	return nil
+}
+
+// A record holds its index, followed by its op.
+func encodeRecord(index uint64, o *op) []byte {
+	record := make([]byte, 8)
+	binary.LittleEndian.PutUint64(record, index)
+	return append(record, encodeOp(o)...)
+}
+
+// decodeRecord returns the index of a record, and its op.
+func decodeRecord(record []byte) (uint64, *op, error) {
+	if len(record) < 8 {
+		return 0, nil, errors.New("malformed log record")
+	}
+	o, err := decodeOp(record[8:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.LittleEndian.Uint64(record), o, nil
+}
@@ -6,8 +6,10 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,12 +26,22 @@ type Frontend struct {
 	*Config
 
 	proposedSeqNo   uint64 // Use atomic.AddUint64, atomic.LoadUint64
+	epoch           uint64 // The committed epoch named by reads. Use atomic.
 	currentInterest *globalInterest
 	readChan        chan *readRequest
 
+	// Writes hold a read lock while sent to replicas, so that an epoch,
+	// holding the write lock, is prepared at the same seqno on every replica.
+	writeLock sync.RWMutex
+
 	replicas []common.ReplicaInterface
 	dead     int32
 
+	// Recent writes, by GlobalSeqNo modulo its length, kept so they can be
+	// retransmitted to replicas that missed them.
+	recentWrites []*common.ReplicaWriteArgs
+	recentLock   sync.Mutex
+
 	Verbose bool
 }
 
@@ -47,6 +59,10 @@ type readRequest struct {
 	Done  chan bool
 }
 
+// epochCommitAttempts is how many times a replica is asked to commit an
+// epoch before the flip to it is aborted.
+const epochCommitAttempts = 3
+
 // NewFrontend creates a new Frontend for a provided configuration.
 func NewFrontend(name string, config *Config, replicas []common.ReplicaInterface) *Frontend {
 	fe := &Frontend{}
@@ -55,13 +71,16 @@ func NewFrontend(name string, config *Config, replicas []common.ReplicaInterface
 	fe.Config = config
 	fe.replicas = replicas
 	fe.readChan = make(chan *readRequest, 10)
+	if config.Config != nil {
+		fe.recentWrites = make([]*common.ReplicaWriteArgs, config.Config.WindowSize()+1)
+	}
 	nextInterest := new(globalInterest)
 	fe.currentInterest = nextInterest
 
 	// Periodically serialize database epoch advances.
-	go fe.periodicWrite()
+	fe.clock().Go(fe.periodicWrite)
 	// Batch incoming reads into combined requests to replicas.
-	go fe.batchReads()
+	fe.clock().Go(fe.batchReads)
 
 	return fe
 }
@@ -87,25 +106,34 @@ func (fe *Frontend) GetConfig(args *interface{}, reply *common.Config) error {
 }
 
 func (fe *Frontend) Write(args *common.WriteArgs, reply *common.WriteReply) error {
+	fe.writeLock.RLock()
+	defer fe.writeLock.RUnlock()
 	seqNo := atomic.AddUint64(&fe.proposedSeqNo, 1)
 	args.GlobalSeqNo = seqNo
+	args.Time = fe.clock().Now().UnixNano()
 
 	replicaWrite := &common.ReplicaWriteArgs{
 		WriteArgs: *args,
 	}
-	replicaReply := common.ReplicaWriteReply{}
+	fe.recordWrite(replicaWrite)
 	if fe.Verbose {
 		fe.log.Printf("write to %d,%d serialized.\n", args.Bucket1, args.Bucket2)
 	}
 	//@todo writes in parallel
 	for i, r := range fe.replicas {
+		replicaReply := common.ReplicaWriteReply{}
 		err := r.Write(replicaWrite, &replicaReply)
 		if err != nil {
+			// The replica will report the write missing once reachable again.
 			reply.Err = err.Error()
-			fe.log.Fatalf("Error writing to replica %d: %v", i, err)
+			fe.log.Printf("Error writing to replica %d: %v", i, err)
+			continue
 		} else if len(replicaReply.Err) > 0 {
 			reply.Err = replicaReply.Err
 		}
+		if len(replicaReply.Missing) > 0 {
+			fe.retransmit(i, r, replicaReply.Missing)
+		}
 	}
 	reply.GlobalSeqNo = args.GlobalSeqNo
 
@@ -128,31 +156,141 @@ func (fe *Frontend) GetUpdates(args *common.GetUpdatesArgs, reply *common.GetUpd
 	return nil
 }
 
+// recordWrite keeps a write available for retransmission.
+func (fe *Frontend) recordWrite(write *common.ReplicaWriteArgs) {
+	if len(fe.recentWrites) == 0 {
+		return
+	}
+	fe.recentLock.Lock()
+	fe.recentWrites[write.GlobalSeqNo%uint64(len(fe.recentWrites))] = write
+	fe.recentLock.Unlock()
+}
+
+// retransmit resends writes that a replica reports missing. Writes which
+// may still be in flight to the replica are sent again regardless, since
+// replicas ignore duplicates.
+func (fe *Frontend) retransmit(index int, replica common.ReplicaInterface, missing []uint64) {
+	for _, seqNo := range missing {
+		var write *common.ReplicaWriteArgs
+		if len(fe.recentWrites) > 0 {
+			fe.recentLock.Lock()
+			write = fe.recentWrites[seqNo%uint64(len(fe.recentWrites))]
+			fe.recentLock.Unlock()
+		}
+		if write == nil || write.GlobalSeqNo != seqNo {
+			fe.log.Printf("Replica %d is missing write %d, which is no longer available.\n", index, seqNo)
+			continue
+		}
+		if fe.Verbose {
+			fe.log.Printf("Retransmitting write %d to replica %d.\n", seqNo, index)
+		}
+		var reply common.ReplicaWriteReply
+		if err := replica.Write(write, &reply); err != nil {
+			fe.log.Printf("Error retransmitting to replica %d: %v", index, err)
+			return
+		}
+	}
+}
+
 // periodicWrite runs until the dead flag is set, and periodically send a write
 // request to all replicas telling them to advance their write epoch.
 func (fe *Frontend) periodicWrite() {
 	for atomic.LoadInt32(&fe.dead) == 0 {
-		tick := time.After(fe.WriteInterval)
+		tick := fe.clock().After(fe.WriteInterval)
 		select {
 		case <-tick:
-			args := &common.ReplicaWriteArgs{
-				EpochFlag: true,
-			}
-			var rep common.ReplicaWriteReply
 			if fe.Verbose {
 				fe.log.Printf("Periodic update of database sent to replicas.\n")
 			}
-			for _, r := range fe.replicas {
-				r.Write(args, &rep)
-			}
+			fe.advanceEpoch()
 		}
 	}
 }
 
+// advanceEpoch flips every replica to a new epoch in two phases. Each replica
+// prepares a snapshot of the same writes, and only once all have done so are
+// they told to commit. Reads name the new epoch after every replica commits;
+// replicas keep the previous epoch for reads issued before then.
+func (fe *Frontend) advanceEpoch() {
+	fe.writeLock.Lock()
+	defer fe.writeLock.Unlock()
+
+	id := atomic.LoadUint64(&fe.epoch) + 1
+	seqNo := atomic.LoadUint64(&fe.proposedSeqNo)
+	prepare := &common.ReplicaWriteArgs{EpochFlag: true, EpochID: id, Phase: common.EpochPrepare}
+	for i, r := range fe.replicas {
+		if err := fe.prepareEpoch(i, r, prepare, seqNo); err != nil {
+			fe.log.Printf("Epoch %d not prepared by replica %d: %v\n", id, i, err)
+			return
+		}
+	}
+
+	commit := &common.ReplicaWriteArgs{EpochFlag: true, EpochID: id, Phase: common.EpochCommit}
+	for i, r := range fe.replicas {
+		if err := fe.commitEpoch(r, commit); err != nil {
+			fe.log.Printf("Epoch %d not committed by replica %d: %v\n", id, i, err)
+			fe.abortEpoch(id)
+			return
+		}
+	}
+	atomic.StoreUint64(&fe.epoch, id)
+}
+
+// commitEpoch asks a replica to commit a prepared epoch, retrying up to
+// epochCommitAttempts times.
+func (fe *Frontend) commitEpoch(replica common.ReplicaInterface, args *common.ReplicaWriteArgs) error {
+	var err error
+	for attempt := 0; attempt < epochCommitAttempts; attempt++ {
+		var reply common.ReplicaWriteReply
+		if err = replica.Write(args, &reply); err == nil && reply.Err != "" {
+			err = errors.New(reply.Err)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// abortEpoch returns every replica to the epoch reads currently name, after
+// a flip to the epoch id could not be committed everywhere.
+func (fe *Frontend) abortEpoch(id uint64) {
+	abort := &common.ReplicaWriteArgs{EpochFlag: true, EpochID: id, Phase: common.EpochAbort}
+	for i, r := range fe.replicas {
+		var reply common.ReplicaWriteReply
+		if err := r.Write(abort, &reply); err != nil {
+			fe.log.Printf("Error aborting epoch %d on replica %d: %v\n", id, i, err)
+		}
+	}
+}
+
+// prepareEpoch asks a replica to prepare an epoch, which must include every
+// write through seqNo. Writes the replica lacks are retransmitted once.
+func (fe *Frontend) prepareEpoch(index int, replica common.ReplicaInterface, args *common.ReplicaWriteArgs, seqNo uint64) error {
+	for attempt := 0; ; attempt++ {
+		var reply common.ReplicaWriteReply
+		if err := replica.Write(args, &reply); err != nil {
+			return err
+		} else if reply.Err != "" {
+			return errors.New(reply.Err)
+		}
+		if reply.GlobalSeqNo == seqNo {
+			return nil
+		} else if attempt > 0 || reply.GlobalSeqNo > seqNo {
+			return fmt.Errorf("prepared through write %d, not %d", reply.GlobalSeqNo, seqNo)
+		}
+		missing := make([]uint64, 0, seqNo-reply.GlobalSeqNo)
+		for s := reply.GlobalSeqNo + 1; s <= seqNo; s++ {
+			missing = append(missing, s)
+		}
+		fe.retransmit(index, replica, missing)
+	}
+}
+
 func (fe *Frontend) periodicUpdate() {
 	// refresh global interest vector from replicas
 	for atomic.LoadInt32(&fe.dead) == 0 {
-		tick := time.After(time.Duration(fe.WriteInterval.Nanoseconds() * int64(fe.InterestMultiple)))
+		tick := fe.clock().After(time.Duration(fe.WriteInterval.Nanoseconds() * int64(fe.InterestMultiple)))
 		select {
 		case <-tick:
 			args := &common.ReplicaWriteArgs{
@@ -213,7 +351,7 @@ func (fe *Frontend) generateInterestVector(partials []common.ReplicaWriteReply)
 func (fe *Frontend) batchReads() {
 	batch := make([]*readRequest, 0, fe.Config.ReadBatch)
 	var readReq *readRequest
-	tick := time.After(fe.Config.ReadInterval)
+	tick := fe.clock().After(fe.Config.ReadInterval)
 	for atomic.LoadInt32(&fe.dead) == 0 {
 		select {
 		case readReq = <-fe.readChan:
@@ -230,7 +368,7 @@ func (fe *Frontend) batchReads() {
 				go fe.triggerBatchRead(batch)
 				batch = make([]*readRequest, 0, fe.Config.ReadBatch)
 			}
-			tick = time.After(fe.Config.ReadInterval)
+			tick = fe.clock().After(fe.Config.ReadInterval)
 			continue
 		}
 	}
@@ -249,15 +387,7 @@ func (fe *Frontend) triggerBatchRead(batch []*readRequest) error {
 		fe.log.Printf("Batch read with %d items sent to replicas.\n", len(batch))
 	}
 
-	// Choose a SeqNoRange
-	currSeqNo := atomic.LoadUint64(&fe.proposedSeqNo) + 1
-	if currSeqNo <= uint64(fe.Config.WindowSize()) {
-		args.SeqNoRange.Start = 1 // Minimum of 1
-	} else {
-		args.SeqNoRange.Start = currSeqNo - uint64(fe.Config.WindowSize()) // Inclusive
-	}
-	args.SeqNoRange.End = currSeqNo // Exclusive
-	args.SeqNoRange.Aborted = make([]uint64, 0, 0)
+	args.Epoch = atomic.LoadUint64(&fe.epoch)
 
 	// Start computation
 	// @todo reads in parallel
@@ -266,13 +396,29 @@ func (fe *Frontend) triggerBatchRead(batch []*readRequest) error {
 	for i, r := range fe.replicas {
 		err := r.BatchRead(args, &replies[i])
 		if err != nil || replies[i].Err != "" {
-			replicaErr = err
-			fe.log.Fatalf("Error making read to replica %d: %v%v", i, err, replies[i].Err)
+			replicaErr = fmt.Errorf("failure from replica %d: %v%v", i, err, replies[i].Err)
+			fe.log.Printf("Error making read to replica %d: %v%v", i, err, replies[i].Err)
+			break
 		}
 		if len(replies[i].Replies) != len(batch) {
-			replicaErr = errors.New("failure from Replica " + string(i))
+			replicaErr = fmt.Errorf("failure from replica %d", i)
 			fe.log.Fatalf("Replica %d gave the wrong number of replies (%d instead of %d)", i, len(replies[i].Replies), len(batch))
 		}
+		// Replies are only meaningful combined if every replica read the
+		// same database.
+		if err := agreeingReplies(&replies[0], &replies[i]); err != nil {
+			replicaErr = fmt.Errorf("failure from replica %d: %v", i, err)
+			fe.log.Printf("Replica %d disagrees with replica 0: %v", i, err)
+			break
+		}
+	}
+	if replicaErr != nil {
+		// Replies combined from fewer than all replicas reveal nothing.
+		for _, val := range batch {
+			val.Reply.Err = replicaErr.Error()
+			val.Done <- true
+		}
+		return replicaErr
 	}
 
 	// Respond to clients
@@ -284,13 +430,37 @@ func (fe *Frontend) triggerBatchRead(batch []*readRequest) error {
 		for _, rp := range replies {
 			val.Reply.Combine(rp.Replies[i].Data)
 		}
-		if replicaErr != nil {
-			val.Reply.Err = replicaErr.Error()
+		val.Reply.GlobalSeqNo = replies[0].Replies[i].GlobalSeqNo
+		val.Reply.Epoch = replies[0].Replies[i].Epoch
+		val.Reply.Roots = make([]common.DBRoot, len(replies))
+		val.Reply.Digests = make([]common.ReadDigest, len(replies))
+		for j, rp := range replies {
+			val.Reply.Roots[j] = rp.Root
+			if i < len(rp.Digests) {
+				val.Reply.Digests[j] = rp.Digests[i]
+			}
 		}
-		val.Reply.GlobalSeqNo = args.SeqNoRange
 		val.Reply.LastInterestSN = lastInterestSN
 		val.Done <- true
 	}
 
 	return nil
 }
+
+// agreeingReplies checks that two replicas served a batch of reads from the
+// same epoch, with the same writes in the window and the same database root.
+// Clients check the signed roots themselves.
+func agreeingReplies(a *common.BatchReadReply, b *common.BatchReadReply) error {
+	if b.Root.Root != a.Root.Root {
+		return fmt.Errorf("database root was %x rather than %x", b.Root.Root, a.Root.Root)
+	}
+	for i := range b.Replies {
+		if b.Replies[i].Epoch != a.Replies[i].Epoch {
+			return fmt.Errorf("read %d was of epoch %d rather than %d", i, b.Replies[i].Epoch, a.Replies[i].Epoch)
+		}
+		if !b.Replies[i].GlobalSeqNo.Equals(a.Replies[i].GlobalSeqNo) {
+			return fmt.Errorf("read %d was of writes %v rather than %v", i, b.Replies[i].GlobalSeqNo, a.Replies[i].GlobalSeqNo)
+		}
+	}
+	return nil
+}
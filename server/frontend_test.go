@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -89,3 +91,181 @@ func TestFrontendRead(t *testing.T) {
 
 	f.Close()
 }
+
+// lossyReplica applies writes in order like a Replica, but drops the first
+// delivery of some of them.
+type lossyReplica struct {
+	drop    map[uint64]bool
+	applied []uint64
+	pending map[uint64]bool
+}
+
+func (m *lossyReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag || args.InterestFlag {
+		return nil
+	}
+	if m.drop[args.GlobalSeqNo] {
+		delete(m.drop, args.GlobalSeqNo)
+		return nil
+	}
+	m.pending[args.GlobalSeqNo] = true
+	next := uint64(len(m.applied)) + 1
+	for m.pending[next] {
+		delete(m.pending, next)
+		m.applied = append(m.applied, next)
+		next++
+	}
+	last := next
+	for seqNo := range m.pending {
+		if seqNo > last {
+			last = seqNo
+		}
+	}
+	for s := next; s < last; s++ {
+		if !m.pending[s] {
+			reply.Missing = append(reply.Missing, s)
+		}
+	}
+	return nil
+}
+func (m *lossyReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	return nil
+}
+
+func TestFrontendRetransmit(t *testing.T) {
+	back := &lossyReplica{drop: map[uint64]bool{2: true}, pending: make(map[uint64]bool)}
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, MaxLoadFactor: 0.95},
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{back})
+	defer f.Close()
+	for i := 0; i < 3; i++ {
+		if err := f.Write(&common.WriteArgs{}, &common.WriteReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(back.applied) != 3 || back.applied[1] != 2 {
+		t.Fatalf("Dropped write should have been retransmitted, replica has %v", back.applied)
+	}
+}
+
+// epochReplica records the phases of epoch flips sent by the frontend.
+type epochReplica struct {
+	name   string
+	log    *[]string
+	seqNo  uint64
+	behind bool
+	// Whether commits of epochs fail.
+	failCommit bool
+	epochs     []uint64
+	seqNos     common.Range
+}
+
+func (m *epochReplica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if !args.EpochFlag {
+		if !m.behind {
+			m.seqNo = args.GlobalSeqNo
+		}
+		return nil
+	}
+	*m.log = append(*m.log, fmt.Sprintf("%s-%d-%d", m.name, args.Phase, args.EpochID))
+	reply.GlobalSeqNo = m.seqNo
+	if m.failCommit && args.Phase == common.EpochCommit {
+		reply.Err = "commit failed"
+	}
+	return nil
+}
+func (m *epochReplica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	m.epochs = append(m.epochs, args.Epoch)
+	reply.Replies = make([]common.ReadReply, len(args.Args))
+	for i := range reply.Replies {
+		reply.Replies[i].Epoch = args.Epoch
+		reply.Replies[i].GlobalSeqNo = m.seqNos
+	}
+	return nil
+}
+
+func TestFrontendEpochs(t *testing.T) {
+	log := make([]string, 0)
+	a := &epochReplica{name: "a", log: &log}
+	b := &epochReplica{name: "b", log: &log}
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, MaxLoadFactor: 0.95},
+		ReadBatch:     1,
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{a, b})
+	defer f.Close()
+
+	f.Write(&common.WriteArgs{}, &common.WriteReply{})
+	f.advanceEpoch()
+	expected := []string{"a-1-1", "b-1-1", "a-2-1", "b-2-1"}
+	if fmt.Sprint(log) != fmt.Sprint(expected) {
+		t.Fatalf("Every replica should prepare before any commits: %v", log)
+	}
+	f.triggerBatchRead([]*readRequest{{&common.EncodedReadArgs{}, &common.ReadReply{}, make(chan bool, 1)}})
+	if a.epochs[0] != 1 || b.epochs[0] != 1 {
+		t.Fatalf("Reads should name the committed epoch")
+	}
+
+	// A replica which does not have every write cannot prepare the epoch.
+	log = log[:0]
+	b.behind = true
+	f.Write(&common.WriteArgs{}, &common.WriteReply{})
+	f.advanceEpoch()
+	for _, l := range log {
+		if l[2] == '2' {
+			t.Fatalf("Epoch should not be committed when a replica is behind: %v", log)
+		}
+	}
+	if atomic.LoadUint64(&f.epoch) != 1 {
+		t.Fatalf("Frontend should remain at the last committed epoch")
+	}
+
+	// A flip which a replica fails to commit is aborted on every replica.
+	log = log[:0]
+	b.behind = false
+	b.failCommit = true
+	f.Write(&common.WriteArgs{}, &common.WriteReply{})
+	f.advanceEpoch()
+	if len(log) < 2 || log[len(log)-2] != "a-3-2" || log[len(log)-1] != "b-3-2" {
+		t.Fatalf("Epoch should be aborted when a replica fails to commit: %v", log)
+	}
+	if atomic.LoadUint64(&f.epoch) != 1 {
+		t.Fatalf("Frontend should not publish an epoch which was aborted")
+	}
+}
+
+func TestFrontendReadAgreement(t *testing.T) {
+	log := make([]string, 0)
+	a := &epochReplica{name: "a", log: &log, seqNos: common.Range{Start: 1, End: 3}}
+	b := &epochReplica{name: "b", log: &log, seqNos: common.Range{Start: 1, End: 3}}
+	serverConfig := &Config{
+		Config:        &common.Config{NumBuckets: 64, BucketDepth: 4, MaxLoadFactor: 0.95},
+		ReadBatch:     1,
+		WriteInterval: time.Minute,
+		ReadInterval:  time.Minute,
+	}
+	f := NewFrontend("testing", serverConfig, []common.ReplicaInterface{a, b})
+	defer f.Close()
+	f.Write(&common.WriteArgs{}, &common.WriteReply{})
+	f.advanceEpoch()
+
+	reply := &common.ReadReply{}
+	if err := f.triggerBatchRead([]*readRequest{{&common.EncodedReadArgs{}, reply, make(chan bool, 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Epoch != 1 || !reply.GlobalSeqNo.Equals(a.seqNos) {
+		t.Fatalf("Reply should carry the metadata of the replicas, got %v at epoch %d", reply.GlobalSeqNo, reply.Epoch)
+	}
+
+	b.seqNos.End = 2
+	reply = &common.ReadReply{}
+	if err := f.triggerBatchRead([]*readRequest{{&common.EncodedReadArgs{}, reply, make(chan bool, 1)}}); err == nil || reply.Err == "" {
+		t.Fatalf("Replies of replicas which read different writes should not be combined")
+	}
+}
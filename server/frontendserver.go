@@ -28,7 +28,18 @@ func NewFrontendServer(name string, serverConfig *Config, replicas []*common.Tru
 
 	rpcs := make([]common.ReplicaInterface, len(replicas))
 	for i, r := range replicas {
-		rpcs[i] = common.NewReplicaRPC(r.Name, r)
+		if !r.IsDistributed {
+			rpcs[i] = common.NewReplicaRPC(r.Name, r)
+			continue
+		}
+		addresses, _ := r.GetAddresses()
+		members := make([]common.ReplicaInterface, len(addresses))
+		for j, address := range addresses {
+			member := *r
+			member.Address = address
+			members[j] = common.NewReplicaRPC(r.Name, &member)
+		}
+		rpcs[i] = NewReplicaGroup(r.Name, members)
 	}
 
 	fe.Frontend = NewFrontend(name, serverConfig, rpcs)
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/privacylab/talek/common"
+)
+
+// ReplicaGroup is the set of servers of a distributed trust domain, each
+// holding one shard of the database. Requests are fanned out to every server,
+// and their partial responses to reads combined, so that the frontend sees
+// the group as a single replica.
+type ReplicaGroup struct {
+	log     *common.Logger
+	name    string
+	members []common.ReplicaInterface // In order of shard
+
+	// The root of each shard's buckets, as of the last epoch prepared.
+	roots     [][32]byte
+	rootsLock sync.Mutex
+}
+
+// NewReplicaGroup creates a ReplicaGroup of servers, given in order of shard.
+func NewReplicaGroup(name string, members []common.ReplicaInterface) *ReplicaGroup {
+	g := &ReplicaGroup{}
+	g.log = common.NewLogger(name)
+	g.name = name
+	g.members = members
+	return g
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// Write sends a write to every server. The reply holds the latest write
+// applied by all of them, and every write missed by any. The roots of the
+// shards as an epoch is prepared are passed to each as it commits, so that
+// they serve the root of the whole database.
+func (g *ReplicaGroup) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
+	if args.EpochFlag && args.Phase == common.EpochImmediate {
+		prepare, commit := *args, *args
+		prepare.Phase, commit.Phase = common.EpochPrepare, common.EpochCommit
+		if err := g.Write(&prepare, reply); err != nil || reply.Err != "" {
+			return err
+		}
+		var commitReply common.ReplicaWriteReply
+		err := g.Write(&commit, &commitReply)
+		reply.Err = commitReply.Err
+		return err
+	} else if args.EpochFlag && args.Phase == common.EpochCommit {
+		commit := *args
+		g.rootsLock.Lock()
+		commit.ShardRoots = g.roots
+		g.rootsLock.Unlock()
+		args = &commit
+	}
+
+	var lastErr error
+	replied := false
+	missing := make(map[uint64]bool)
+	roots := make([][32]byte, len(g.members))
+	for i, m := range g.members {
+		var memberReply common.ReplicaWriteReply
+		if err := m.Write(args, &memberReply); err != nil {
+			// The server will report the write missing once reachable again.
+			g.log.Warn.Printf("Error writing to shard %d: %v", i, err)
+			lastErr = err
+			continue
+		}
+		if !replied {
+			reply.InterestVec = memberReply.InterestVec
+			reply.Signature = memberReply.Signature
+		}
+		if !replied || memberReply.GlobalSeqNo < reply.GlobalSeqNo {
+			reply.GlobalSeqNo = memberReply.GlobalSeqNo
+		}
+		replied = true
+		if reply.Err == "" && memberReply.Err != "" {
+			reply.Err = fmt.Sprintf("shard %d: %s", i, memberReply.Err)
+		}
+		for _, seqNo := range memberReply.Missing {
+			missing[seqNo] = true
+		}
+		roots[i] = memberReply.Root
+	}
+	if args.EpochFlag && args.Phase == common.EpochPrepare {
+		g.rootsLock.Lock()
+		g.roots = roots
+		g.rootsLock.Unlock()
+	}
+	for seqNo := range missing {
+		reply.Missing = append(reply.Missing, seqNo)
+	}
+	sort.Slice(reply.Missing, func(i, j int) bool { return reply.Missing[i] < reply.Missing[j] })
+	return lastErr
+}
+
+// BatchRead makes a batch of reads of every server in parallel, and combines
+// their responses. Servers must agree on the epoch read and its root.
+// The combined responses carry digests which are not signed, since no
+// server saw them.
+func (g *ReplicaGroup) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
+	if len(g.members) == 0 {
+		return errors.New("no servers in group")
+	}
+	replies := make([]common.BatchReadReply, len(g.members))
+	errs := make([]error, len(g.members))
+	var wg sync.WaitGroup
+	for i, m := range g.members {
+		wg.Add(1)
+		go func(i int, m common.ReplicaInterface) {
+			defer wg.Done()
+			errs[i] = m.BatchRead(args, &replies[i])
+		}(i, m)
+	}
+	wg.Wait()
+
+	for i := range replies {
+		if errs[i] != nil {
+			return fmt.Errorf("shard %d: %v", i, errs[i])
+		} else if replies[i].Err != "" {
+			reply.Err = fmt.Sprintf("shard %d: %s", i, replies[i].Err)
+			return nil
+		} else if len(replies[i].Replies) != len(args.Args) {
+			reply.Err = fmt.Sprintf("shard %d gave %d replies rather than %d", i, len(replies[i].Replies), len(args.Args))
+			return nil
+		}
+		if err := agreeingReplies(&replies[0], &replies[i]); err != nil {
+			reply.Err = fmt.Sprintf("shard %d disagrees with shard 0: %v", i, err)
+			return nil
+		}
+	}
+	reply.Root = replies[0].Root
+	reply.Replies = replies[0].Replies
+	reply.Digests = make([]common.ReadDigest, len(reply.Replies))
+	for i := range reply.Replies {
+		for _, rp := range replies[1:] {
+			if err := reply.Replies[i].Combine(rp.Replies[i].Data); err != nil {
+				reply.Replies[i].Err = err.Error()
+			}
+		}
+		reply.Digests[i] = common.NewReadDigest(reply.Replies[i].Data)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/merkle"
+	coordinator "github.com/privacylab/talek/server/coordinator"
+)
+
+func TestReplicaGroup(t *testing.T) {
+	testReplicaGroup(t, 0.50)
+}
+
+// A full table overflows, and the coordinator must give up the same items
+// early as the replicas of a central trust domain.
+func TestReplicaGroupOverflow(t *testing.T) {
+	testReplicaGroup(t, 1)
+}
+
+func testReplicaGroup(t *testing.T, maxLoadFactor float64) {
+	config := common.Config{
+		NumBuckets:         64,
+		BucketDepth:        2,
+		DataSize:           64,
+		MaxLoadFactor:      maxLoadFactor,
+		BloomFalsePositive: 0.1,
+		CuckooSeed:         7,
+	}
+	tds := []*common.TrustDomainConfig{
+		common.NewTrustDomainConfig("central", "", true, false),
+		common.NewTrustDomainConfig("distributed", "", true, true),
+	}
+	coord, err := coordinator.NewServer("TestReplicaGroup-coordinator", "", config, nil, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer coord.Close()
+	identity := common.NewTrustDomainConfig("coordinator", "", true, false)
+	coord.SetIdentity(identity)
+
+	central := NewReplica("TestReplicaGroup-central", "cpu.0", Config{Config: &config, ReadBatch: 1, WriteInterval: time.Second, TrustDomain: tds[0]})
+	defer central.Close()
+	members := make([]common.ReplicaInterface, 2)
+	for i := range members {
+		shard := NewReplica("TestReplicaGroup-shard", "cpu.0", Config{
+			Config:           &config,
+			ReadBatch:        1,
+			WriteInterval:    time.Second,
+			TrustDomain:      tds[1],
+			TrustDomainIndex: 1,
+			ShardID:          uint64(i),
+			NumShards:        2,
+			Coordinator:      coord,
+			CoordinatorKey:   identity.SignPublicKey,
+		})
+		defer shard.Close()
+		members[i] = shard
+	}
+	group := NewReplicaGroup("TestReplicaGroup-group", members)
+
+	fe := NewFrontend("TestReplicaGroup", &Config{Config: &config, ReadBatch: 1, WriteInterval: time.Minute, ReadInterval: time.Millisecond}, []common.ReplicaInterface{central, group})
+	defer fe.Close()
+
+	writes := make([]*common.WriteArgs, 0)
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			args := &common.WriteArgs{
+				Bucket1: uint64(rand.Intn(int(config.NumBuckets))),
+				Bucket2: uint64(rand.Intn(int(config.NumBuckets))),
+				Data:    make([]byte, config.DataSize),
+			}
+			rand.Read(args.Data)
+			if err := fe.Write(args, &common.WriteReply{}); err != nil {
+				t.Fatal(err)
+			}
+			writes = append(writes, args)
+		}
+	}
+
+	// Enough writes that the oldest leave the window.
+	write(100)
+	fe.advanceEpoch()
+	if atomic.LoadUint64(&fe.epoch) != 1 {
+		t.Fatalf("Every trust domain should have prepared the epoch")
+	}
+
+	read := func(bucket uint64) []byte {
+		args := common.ReadArgs{TD: make([]common.PirArgs, len(tds))}
+		for i := range args.TD {
+			args.TD[i].RequestVector = make([]byte, config.NumBuckets/8)
+			args.TD[i].PadSeed = make([]byte, drbg.SeedLength)
+			rand.Read(args.TD[i].PadSeed)
+		}
+		rand.Read(args.TD[0].RequestVector)
+		copy(args.TD[1].RequestVector, args.TD[0].RequestVector)
+		args.TD[1].RequestVector[bucket/8] ^= 1 << (bucket % 8)
+		encoded, err := args.Encode(tds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &common.ReadReply{}
+		fe.Read(&encoded, reply)
+		if reply.Err != "" {
+			t.Fatalf("Read failed: %v", reply.Err)
+		}
+		if err := reply.VerifyRoots(tds); err != nil {
+			t.Fatalf("Trust domains should sign the same root: %v", err)
+		}
+		for i := range args.TD {
+			drbg.Overlay(args.TD[i].PadSeed, reply.Data)
+		}
+		data, tag := reply.Data[:len(reply.Data)-merkle.Size], reply.Data[len(reply.Data)-merkle.Size:]
+		if leaf := merkle.Leaf(data); !bytes.Equal(leaf[:], tag) {
+			t.Fatalf("Trust domains disagree on bucket %d", bucket)
+		}
+		return data
+	}
+
+	found := func() {
+		for _, w := range writes[len(writes)-10:] {
+			if !bytes.Contains(read(w.Bucket1), w.Data) && !bytes.Contains(read(w.Bucket2), w.Data) {
+				t.Fatalf("Write %d was not found in either of its buckets", w.GlobalSeqNo)
+			}
+		}
+	}
+	found()
+
+	// Later epochs place writes by the changes to the layout.
+	write(20)
+	fe.advanceEpoch()
+	if atomic.LoadUint64(&fe.epoch) != 2 {
+		t.Fatalf("Every trust domain should have prepared the next epoch")
+	}
+	found()
+}
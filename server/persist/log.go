@@ -0,0 +1,106 @@
+package persist
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// recordHeaderLength is the size of the length and checksum framing each record.
+const recordHeaderLength = 8
+
+// Log is an append-only file of records. Each record is framed with its
+// length and checksum, so that a record torn by a crash can be detected.
+type Log struct {
+	file *os.File
+	path string
+}
+
+// OpenLog opens the log at path for appending, creating it if needed.
+// Any torn or corrupt records at the end of the log are discarded.
+func OpenLog(path string) (*Log, error) {
+	valid, err := ReadLog(path, func([]byte) error { return nil })
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(valid); err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Log{file, path}, nil
+}
+
+// ReadLog calls fn with each intact record of the log at path, in order.
+// Reading stops at the first torn or corrupt record, which is where a crash
+// interrupted an append. It returns the length of the intact prefix.
+func ReadLog(path string, fn func(record []byte) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var valid int64
+	var header [recordHeaderLength]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return valid, nil
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		record := make([]byte, length)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return valid, nil
+		}
+		if binary.LittleEndian.Uint32(header[4:8]) != crc32.Checksum(record, crcTable) {
+			return valid, nil
+		}
+		if err := fn(record); err != nil {
+			return valid, err
+		}
+		valid += int64(recordHeaderLength) + int64(length)
+	}
+}
+
+/** PUBLIC METHODS **/
+
+// Append adds a record to the end of the log. Records are handed to the
+// operating system, but not synced, so they survive a crash of the process.
+func (l *Log) Append(record []byte) error {
+	buf := make([]byte, recordHeaderLength+len(record))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(record, crcTable))
+	copy(buf[recordHeaderLength:], record)
+	_, err := l.file.Write(buf)
+	return err
+}
+
+// Sync flushes appended records to stable storage.
+func (l *Log) Sync() error {
+	return l.file.Sync()
+}
+
+// Reset discards all records, once they are covered by a snapshot.
+func (l *Log) Reset() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,99 @@
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	if _, err := ReadSnapshot(path); !os.IsNotExist(err) {
+		t.Fatalf("Missing snapshot should not exist, got %v", err)
+	}
+	if err := WriteSnapshot(path, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSnapshot(path, []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ReadSnapshot(path)
+	if err != nil || !bytes.Equal(data, []byte("second")) {
+		t.Fatalf("Read back %v, %v", data, err)
+	}
+
+	// Flip a bit of the stored data.
+	raw, _ := ioutil.ReadFile(path)
+	raw[len(raw)-1] ^= 1
+	ioutil.WriteFile(path, raw, 0600)
+	if _, err := ReadSnapshot(path); err != ErrCorrupt {
+		t.Fatalf("Corruption should be detected, got %v", err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+
+	l, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{[]byte("one"), []byte("two"), {}, []byte("three")}
+	for _, r := range records {
+		if err := l.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	// Simulate a crash partway through appending the last record.
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-2)
+
+	read := make([][]byte, 0)
+	if _, err := ReadLog(path, func(r []byte) error {
+		read = append(read, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 3 || !bytes.Equal(read[1], records[1]) {
+		t.Fatalf("Expected intact records before the torn one, got %v", read)
+	}
+
+	// Reopening discards the torn record, and appends after the intact ones.
+	l, err = OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Append([]byte("four"))
+	l.Close()
+	read = read[:0]
+	ReadLog(path, func(r []byte) error {
+		read = append(read, r)
+		return nil
+	})
+	if len(read) != 4 || !bytes.Equal(read[3], []byte("four")) {
+		t.Fatalf("Append after recovery failed, got %v", read)
+	}
+
+	l, _ = OpenLog(path)
+	l.Reset()
+	l.Close()
+	if n, _ := ReadLog(path, func([]byte) error { return nil }); n != 0 {
+		t.Fatalf("Reset log should be empty")
+	}
+}
@@ -0,0 +1,75 @@
+// Package persist provides the on-disk primitives used by servers to survive
+// restarts: checksummed snapshots, which are replaced atomically, and
+// append-only logs of records made since the last snapshot.
+package persist
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrCorrupt is returned when persisted data fails its checksum.
+var ErrCorrupt = errors.New("persisted data is corrupt")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteSnapshot durably replaces the snapshot at path with data.
+// The snapshot is written to a temporary file which is synced and renamed
+// into place, so a crash leaves either the old or new snapshot intact.
+func WriteSnapshot(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(data, crcTable))
+	if _, err = tmp.Write(sum[:]); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// ReadSnapshot returns the data of the snapshot at path. If no snapshot
+// exists, the error satisfies os.IsNotExist.
+func ReadSnapshot(path string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) < 4 {
+		return nil, ErrCorrupt
+	}
+	data := contents[4:]
+	if binary.LittleEndian.Uint32(contents[0:4]) != crc32.Checksum(data, crcTable) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
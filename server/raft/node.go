@@ -0,0 +1,726 @@
+// Package raft replicates a log of commands across a small cluster of nodes,
+// so that a state machine survives the failure of a minority of them. It
+// implements the leader election, log replication and snapshots of Raft, as
+// described in "In Search of an Understandable Consensus Algorithm".
+//
+// A persistent node saves its term, vote and log to disk before replying to
+// or acting on them, so that it may rejoin the cluster after a restart. Other
+// nodes hold their log in memory, and must not rejoin with the same identity,
+// since they would have forgotten the votes they cast.
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	protocol "github.com/privacylab/talek/protocol/raft"
+	"github.com/privacylab/talek/server/persist"
+)
+
+// StateMachine is replicated by a Node. Every node applies the same commands
+// in the same order, so they must be deterministic.
+type StateMachine interface {
+	// Apply executes a committed command, and returns its result to the
+	// node which proposed it
+	Apply(command []byte) (interface{}, error)
+	// Snapshot serializes the state produced by the commands applied so far
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot
+	Restore(snapshot []byte) error
+}
+
+var (
+	// ErrNotLeader is returned when proposing a command to a node which is
+	// not the leader, or which lost leadership before the command committed.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrTimeout is returned when a command is not committed in time.
+	ErrTimeout = errors.New("timed out waiting for commit")
+	// ErrClosed is returned by a node which has been closed.
+	ErrClosed = errors.New("node is closed")
+)
+
+// The leader sends heartbeats every heartbeatInterval, and a follower which
+// hears nothing for a random timeout between electionTimeout and twice that
+// stands for election. The log is compacted into a snapshot once it holds
+// maxLogEntries applied entries.
+var (
+	heartbeatInterval = 50 * time.Millisecond
+	electionTimeout   = 300 * time.Millisecond
+	proposeTimeout    = 5 * time.Second
+	maxLogEntries     = uint64(1024)
+	maxAppendEntries  = 256
+)
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Node is a member of a raft cluster
+type Node struct {
+	/** Private State **/
+	// Static
+	log     *common.Logger
+	name    string
+	id      string
+	peers   map[string]protocol.Interface
+	machine StateMachine
+
+	// Serializes applying commands with installing snapshots
+	applyLock sync.Mutex
+
+	// Thread-safe (locked)
+	lock          sync.Mutex
+	role          role
+	term          uint64
+	votedFor      string
+	leader        string
+	entries       []protocol.Entry // Following snapshotIndex
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshot      []byte
+	commitIndex   uint64
+	lastApplied   uint64
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	triggers      map[string]chan bool
+	deadline      time.Time
+	waiters       map[uint64]*waiter
+
+	// Persistence, disabled when wal is nil (locked)
+	persistPath string
+	wal         *persist.Log
+	records     uint64 // Logged since the node was created
+	savedTerm   uint64
+	savedVote   string
+	unsaved     uint64 // The first entry changed since saved, or 0 if none
+
+	// Channels
+	applyChan chan bool
+	closeChan chan bool
+	dead      int32 // Use atomic
+}
+
+// waiter is a command proposed by this node, awaiting its application
+type waiter struct {
+	term uint64
+	done chan result
+}
+
+// result is the outcome of applying a command
+type result struct {
+	value interface{}
+	err   error
+}
+
+// NewNode creates a node identified by id, replicating machine with peers
+// keyed by their own ids.
+func NewNode(name string, id string, peers map[string]protocol.Interface, machine StateMachine) *Node {
+	n, _ := NewPersistentNode(name, id, peers, machine, "")
+	return n
+}
+
+// NewPersistentNode creates a node which persists its state in the directory
+// persistPath, and restores any state persisted there, including the
+// snapshot of its machine.
+func NewPersistentNode(name string, id string, peers map[string]protocol.Interface, machine StateMachine, persistPath string) (*Node, error) {
+	n := &Node{}
+	n.log = common.NewLogger(name)
+	n.name = name
+	n.id = id
+	n.peers = peers
+	n.machine = machine
+
+	n.entries = make([]protocol.Entry, 0)
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.triggers = make(map[string]chan bool)
+	n.waiters = make(map[uint64]*waiter)
+	n.resetDeadline()
+
+	n.persistPath = persistPath
+	if persistPath != "" {
+		if err := n.restore(); err != nil {
+			n.log.Error.Printf("raft.NewNode(%v) could not restore persisted state: %v", id, err)
+			return nil, err
+		}
+	}
+
+	n.applyChan = make(chan bool, 1)
+	n.closeChan = make(chan bool)
+
+	go n.run()
+	go n.applyLoop()
+
+	n.log.Info.Printf("raft.NewNode(%v) success\n", id)
+	return n, nil
+}
+
+/** PUBLIC METHODS (threadsafe) **/
+
+// Propose replicates a command, and waits for this node to apply it.
+// It returns the result of applying the command.
+func (n *Node) Propose(command []byte) (interface{}, error) {
+	n.lock.Lock()
+	if atomic.LoadInt32(&n.dead) != 0 {
+		n.lock.Unlock()
+		return nil, ErrClosed
+	}
+	if n.role != leader {
+		n.lock.Unlock()
+		return nil, ErrNotLeader
+	}
+	e := protocol.Entry{Term: n.term, Index: n.lastIndex() + 1, Data: command}
+	unsaved := n.unsaved
+	n.entries = append(n.entries, e)
+	n.markUnsaved(e.Index)
+	if err := n.save(); err != nil {
+		// The entry is dropped, so that it is neither replicated nor saved
+		// with a later one.
+		n.log.Error.Printf("%v failed to save entry %d: %v", n.id, e.Index, err)
+		n.entries = n.entries[:len(n.entries)-1]
+		n.unsaved = unsaved
+		n.lock.Unlock()
+		return nil, err
+	}
+	w := &waiter{term: n.term, done: make(chan result, 1)}
+	n.waiters[e.Index] = w
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- true:
+		default:
+		}
+	}
+	n.advanceCommit()
+	n.lock.Unlock()
+
+	select {
+	case r := <-w.done:
+		return r.value, r.err
+	case <-time.After(proposeTimeout):
+		n.lock.Lock()
+		if n.waiters[e.Index] == w {
+			delete(n.waiters, e.Index)
+		}
+		n.lock.Unlock()
+		return nil, ErrTimeout
+	case <-n.closeChan:
+		return nil, ErrClosed
+	}
+}
+
+// IsLeader returns whether this node is the leader of the cluster
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.role == leader
+}
+
+// Leader returns the id of the leader last heard from, if any
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.leader
+}
+
+// Close stops the node
+func (n *Node) Close() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if atomic.SwapInt32(&n.dead, 1) != 0 {
+		return
+	}
+	close(n.closeChan)
+	n.closePersistence()
+	n.log.Info.Printf("%v.Close: success", n.id)
+}
+
+// RequestVote grants a vote to a candidate whose log is at least as up to
+// date as this node's, if no other candidate has its vote in the term. The
+// vote is saved before it is granted.
+func (n *Node) RequestVote(args *protocol.RequestVoteArgs, reply *protocol.RequestVoteReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if atomic.LoadInt32(&n.dead) != 0 {
+		return ErrClosed
+	}
+
+	if args.Term > n.term {
+		n.becomeFollower(args.Term)
+	}
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	upToDate := args.LastLogTerm > n.lastTerm() ||
+		(args.LastLogTerm == n.lastTerm() && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		n.resetDeadline()
+		reply.VoteGranted = true
+	}
+	return n.save()
+}
+
+// AppendEntries appends entries from the leader which follow an entry
+// matching the leader's log, replacing any which conflict. The entries are
+// saved before the leader is told they were appended.
+func (n *Node) AppendEntries(args *protocol.AppendEntriesArgs, reply *protocol.AppendEntriesReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if atomic.LoadInt32(&n.dead) != 0 {
+		return ErrClosed
+	}
+	n.appendEntries(args, reply)
+	return n.save()
+}
+
+// InstallSnapshot replaces the state of a node too far behind the leader's
+// log to be sent the entries it lacks, and checkpoints it before replying.
+func (n *Node) InstallSnapshot(args *protocol.InstallSnapshotArgs, reply *protocol.InstallSnapshotReply) error {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if atomic.LoadInt32(&n.dead) != 0 {
+		return ErrClosed
+	}
+
+	reply.Term = n.term
+	if args.Term < n.term {
+		return nil
+	}
+	if args.Term > n.term || n.role != follower {
+		n.becomeFollower(args.Term)
+		reply.Term = n.term
+	}
+	n.leader = args.LeaderID
+	n.resetDeadline()
+
+	if args.LastIndex <= n.lastApplied {
+		return n.save()
+	}
+	if err := n.machine.Restore(args.Data); err != nil {
+		n.log.Error.Printf("%v failed to restore snapshot: %v", n.id, err)
+		return err
+	}
+	// Entries following the snapshot are kept if they agree with it.
+	if args.LastIndex < n.lastIndex() && n.termAt(args.LastIndex) == args.LastTerm {
+		n.entries = append([]protocol.Entry{}, n.entries[args.LastIndex-n.snapshotIndex:]...)
+	} else {
+		n.entries = make([]protocol.Entry, 0)
+	}
+	n.snapshotIndex = args.LastIndex
+	n.snapshotTerm = args.LastTerm
+	n.snapshot = args.Data
+	if n.commitIndex < args.LastIndex {
+		n.commitIndex = args.LastIndex
+	}
+	n.lastApplied = args.LastIndex
+	for index, w := range n.waiters {
+		if index <= args.LastIndex {
+			delete(n.waiters, index)
+			w.done <- result{err: ErrNotLeader}
+		}
+	}
+	if err := n.checkpoint(); err != nil {
+		n.log.Error.Printf("%v failed to checkpoint snapshot: %v", n.id, err)
+		return err
+	}
+	n.log.Info.Printf("%v installed snapshot through %d", n.id, args.LastIndex)
+	return nil
+}
+
+/** PRIVATE METHODS **/
+
+// appendEntries handles AppendEntries. Must hold the lock.
+func (n *Node) appendEntries(args *protocol.AppendEntriesArgs, reply *protocol.AppendEntriesReply) {
+	reply.Term = n.term
+	if args.Term < n.term {
+		return
+	}
+	if args.Term > n.term || n.role != follower {
+		n.becomeFollower(args.Term)
+		reply.Term = n.term
+	}
+	n.leader = args.LeaderID
+	n.resetDeadline()
+
+	if args.PrevLogIndex > n.lastIndex() {
+		reply.LastIndex = n.lastIndex()
+		return
+	}
+	// Entries through the snapshot are committed, so match the leader's.
+	if args.PrevLogIndex > n.snapshotIndex && n.termAt(args.PrevLogIndex) != args.PrevLogTerm {
+		reply.LastIndex = args.PrevLogIndex - 1
+		return
+	}
+	for _, e := range args.Entries {
+		if e.Index <= n.snapshotIndex {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			n.entries = n.entries[:e.Index-n.snapshotIndex-1]
+		}
+		n.entries = append(n.entries, e)
+		n.markUnsaved(e.Index)
+	}
+	reply.Success = true
+
+	commit := args.LeaderCommit
+	if last := args.PrevLogIndex + uint64(len(args.Entries)); last < commit {
+		commit = last
+	}
+	if commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	return
+}
+
+// run stands for election when the leader has not been heard from
+func (n *Node) run() {
+	ticker := time.NewTicker(heartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closeChan:
+			return
+		case <-ticker.C:
+		}
+		n.lock.Lock()
+		expired := n.role != leader && time.Now().After(n.deadline)
+		n.lock.Unlock()
+		if expired {
+			n.startElection()
+		}
+	}
+}
+
+func (n *Node) startElection() {
+	n.lock.Lock()
+	n.role = candidate
+	n.term++
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetDeadline()
+	if err := n.save(); err != nil {
+		n.log.Error.Printf("%v failed to save its vote in term %d: %v", n.id, n.term, err)
+		n.role = follower
+		n.lock.Unlock()
+		return
+	}
+	term := n.term
+	args := &protocol.RequestVoteArgs{
+		Term:         n.term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if n.quorum(votes) {
+		n.becomeLeader()
+	}
+	n.lock.Unlock()
+
+	for _, peer := range n.peers {
+		go func(peer protocol.Interface) {
+			reply := &protocol.RequestVoteReply{}
+			if err := peer.RequestVote(args, reply); err != nil {
+				return
+			}
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term)
+				n.resetDeadline()
+				return
+			}
+			if n.role != candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if n.quorum(votes) {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Must hold the lock.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+	}
+	n.role = follower
+}
+
+// Must hold the lock.
+func (n *Node) becomeLeader() {
+	// An entry of the new term commits those of earlier terms.
+	n.entries = append(n.entries, protocol.Entry{Term: n.term, Index: n.lastIndex() + 1})
+	n.markUnsaved(n.lastIndex())
+	if err := n.save(); err != nil {
+		n.log.Error.Printf("%v failed to save the first entry of term %d: %v", n.id, n.term, err)
+		n.becomeFollower(n.term)
+		return
+	}
+	n.role = leader
+	n.leader = n.id
+	n.log.Info.Printf("%v elected leader of term %d", n.id, n.term)
+
+	n.triggers = make(map[string]chan bool)
+	for id := range n.peers {
+		n.nextIndex[id] = n.lastIndex()
+		n.matchIndex[id] = 0
+		n.triggers[id] = make(chan bool, 1)
+		go n.replicate(id, n.term, n.triggers[id])
+	}
+	n.advanceCommit()
+}
+
+// replicate sends entries to a peer while this node leads the term
+func (n *Node) replicate(id string, term uint64, trigger chan bool) {
+	for {
+		more, ok := n.sendEntries(id, term)
+		if !ok {
+			return
+		}
+		if more {
+			continue
+		}
+		select {
+		case <-trigger:
+		case <-time.After(heartbeatInterval):
+		case <-n.closeChan:
+			return
+		}
+	}
+}
+
+// sendEntries sends the entries a peer lacks, or a heartbeat. It returns
+// whether more remain to be sent, and whether this node still leads the term.
+func (n *Node) sendEntries(id string, term uint64) (bool, bool) {
+	n.lock.Lock()
+	if n.role != leader || n.term != term || atomic.LoadInt32(&n.dead) != 0 {
+		n.lock.Unlock()
+		return false, false
+	}
+	peer := n.peers[id]
+	next := n.nextIndex[id]
+
+	if next <= n.snapshotIndex {
+		args := &protocol.InstallSnapshotArgs{
+			Term:      term,
+			LeaderID:  n.id,
+			LastIndex: n.snapshotIndex,
+			LastTerm:  n.snapshotTerm,
+			Data:      n.snapshot,
+		}
+		n.lock.Unlock()
+		reply := &protocol.InstallSnapshotReply{}
+		if err := peer.InstallSnapshot(args, reply); err != nil {
+			return false, true
+		}
+		n.lock.Lock()
+		defer n.lock.Unlock()
+		if !n.leads(term, reply.Term) {
+			return false, false
+		}
+		if args.LastIndex > n.matchIndex[id] {
+			n.matchIndex[id] = args.LastIndex
+			n.nextIndex[id] = args.LastIndex + 1
+		}
+		n.advanceCommit()
+		return n.nextIndex[id] <= n.lastIndex(), true
+	}
+
+	prev := next - 1
+	entries := n.entries[prev-n.snapshotIndex:]
+	if len(entries) > maxAppendEntries {
+		entries = entries[:maxAppendEntries]
+	}
+	args := &protocol.AppendEntriesArgs{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.termAt(prev),
+		Entries:      append([]protocol.Entry{}, entries...),
+		LeaderCommit: n.commitIndex,
+	}
+	n.lock.Unlock()
+	reply := &protocol.AppendEntriesReply{}
+	if err := peer.AppendEntries(args, reply); err != nil {
+		return false, true
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !n.leads(term, reply.Term) {
+		return false, false
+	}
+	if reply.Success {
+		if match := prev + uint64(len(args.Entries)); match > n.matchIndex[id] {
+			n.matchIndex[id] = match
+			n.nextIndex[id] = match + 1
+		}
+		n.advanceCommit()
+	} else {
+		// Back up to the peer's log, at least one entry each attempt.
+		next = reply.LastIndex + 1
+		if next > prev {
+			next = prev
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[id] = next
+	}
+	return n.nextIndex[id] <= n.lastIndex(), true
+}
+
+// leads checks a reply to the leader of term, stepping down if the reply is
+// from a later term. Must hold the lock.
+func (n *Node) leads(term uint64, replyTerm uint64) bool {
+	if replyTerm > n.term {
+		n.becomeFollower(replyTerm)
+		n.resetDeadline()
+		return false
+	}
+	return n.role == leader && n.term == term
+}
+
+// advanceCommit commits the latest entry of the current term stored by a
+// quorum of the cluster. Must hold the lock.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex && index > n.snapshotIndex; index-- {
+		if n.termAt(index) != n.term {
+			return
+		}
+		count := 1
+		for id := range n.peers {
+			if n.matchIndex[id] >= index {
+				count++
+			}
+		}
+		if n.quorum(count) {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *Node) applyLoop() {
+	for {
+		select {
+		case <-n.closeChan:
+			n.lock.Lock()
+			for index, w := range n.waiters {
+				delete(n.waiters, index)
+				w.done <- result{err: ErrClosed}
+			}
+			n.lock.Unlock()
+			return
+		case <-n.applyChan:
+		}
+		n.applyCommitted()
+	}
+}
+
+// applyCommitted applies committed entries to the state machine, and
+// compacts the log once it grows too long.
+func (n *Node) applyCommitted() {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	n.lock.Lock()
+	entries := append([]protocol.Entry{}, n.entries[n.lastApplied-n.snapshotIndex:n.commitIndex-n.snapshotIndex]...)
+	n.lock.Unlock()
+
+	for _, e := range entries {
+		var value interface{}
+		var err error
+		if len(e.Data) > 0 {
+			value, err = n.machine.Apply(e.Data)
+		}
+		n.lock.Lock()
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				// Another leader's entry replaced the proposed one.
+				value, err = nil, ErrNotLeader
+			}
+			w.done <- result{value, err}
+		}
+		n.lock.Unlock()
+	}
+
+	n.lock.Lock()
+	compact := n.lastApplied-n.snapshotIndex >= maxLogEntries
+	n.lock.Unlock()
+	if !compact {
+		return
+	}
+	snapshot, err := n.machine.Snapshot()
+	if err != nil {
+		n.log.Error.Printf("%v failed to snapshot: %v", n.id, err)
+		return
+	}
+	n.lock.Lock()
+	index := n.lastApplied
+	n.snapshotTerm = n.termAt(index)
+	n.entries = append([]protocol.Entry{}, n.entries[index-n.snapshotIndex:]...)
+	n.snapshotIndex = index
+	n.snapshot = snapshot
+	if err := n.checkpoint(); err != nil {
+		n.log.Error.Printf("%v failed to checkpoint: %v", n.id, err)
+	}
+	n.lock.Unlock()
+}
+
+/** HELPER FUNCTIONS (must hold the lock) **/
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyChan <- true:
+	default:
+	}
+}
+
+func (n *Node) resetDeadline() {
+	n.deadline = time.Now().Add(electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout))))
+}
+
+func (n *Node) quorum(count int) bool {
+	return 2*count > len(n.peers)+1
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.entries))
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.termAt(n.lastIndex())
+}
+
+// termAt returns the term of an entry, or 0 if it is not in the log
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	} else if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.snapshotIndex-1].Term
+}
@@ -0,0 +1,371 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	protocol "github.com/privacylab/talek/protocol/raft"
+	"github.com/privacylab/talek/server/persist"
+)
+
+/********************************
+ *** HELPER FUNCTIONS
+ ********************************/
+
+// testMachine records the commands applied to it
+type testMachine struct {
+	lock    sync.Mutex
+	applied [][]byte
+}
+
+func (m *testMachine) Apply(command []byte) (interface{}, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.applied = append(m.applied, append([]byte{}, command...))
+	return len(m.applied), nil
+}
+
+func (m *testMachine) Snapshot() ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return json.Marshal(m.applied)
+}
+
+func (m *testMachine) Restore(snapshot []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return json.Unmarshal(snapshot, &m.applied)
+}
+
+func (m *testMachine) commands() [][]byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([][]byte{}, m.applied...)
+}
+
+var errUnreachable = errors.New("unreachable")
+
+// network connects nodes in process, any of which may be cut off
+type network struct {
+	lock     sync.Mutex
+	nodes    map[string]*Node
+	machines map[string]*testMachine
+	down     map[string]bool
+}
+
+// link is the connection from one node to another
+type link struct {
+	net      *network
+	from, to string
+}
+
+func (l *link) node() (*Node, error) {
+	l.net.lock.Lock()
+	defer l.net.lock.Unlock()
+	if l.net.down[l.from] || l.net.down[l.to] {
+		return nil, errUnreachable
+	}
+	return l.net.nodes[l.to], nil
+}
+
+func (l *link) RequestVote(args *protocol.RequestVoteArgs, reply *protocol.RequestVoteReply) error {
+	n, err := l.node()
+	if err != nil {
+		return err
+	}
+	return n.RequestVote(args, reply)
+}
+
+func (l *link) AppendEntries(args *protocol.AppendEntriesArgs, reply *protocol.AppendEntriesReply) error {
+	n, err := l.node()
+	if err != nil {
+		return err
+	}
+	return n.AppendEntries(args, reply)
+}
+
+func (l *link) InstallSnapshot(args *protocol.InstallSnapshotArgs, reply *protocol.InstallSnapshotReply) error {
+	n, err := l.node()
+	if err != nil {
+		return err
+	}
+	return n.InstallSnapshot(args, reply)
+}
+
+func newNetwork(size int) *network {
+	net := &network{
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*testMachine),
+		down:     make(map[string]bool),
+	}
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("node%d", i)
+	}
+	net.lock.Lock()
+	defer net.lock.Unlock()
+	for _, id := range ids {
+		peers := make(map[string]protocol.Interface)
+		for _, other := range ids {
+			if other != id {
+				peers[other] = &link{net, id, other}
+			}
+		}
+		net.machines[id] = &testMachine{}
+		net.nodes[id] = NewNode("test-"+id, id, peers, net.machines[id])
+	}
+	return net
+}
+
+func (net *network) setDown(id string, down bool) {
+	net.lock.Lock()
+	net.down[id] = down
+	net.lock.Unlock()
+}
+
+func (net *network) close() {
+	for _, n := range net.nodes {
+		n.Close()
+	}
+}
+
+// leader waits for a single leader among the reachable nodes
+func (net *network) leader(t *testing.T) *Node {
+	var found *Node
+	eventually(t, "a leader to be elected", func() bool {
+		found = nil
+		net.lock.Lock()
+		defer net.lock.Unlock()
+		for id, n := range net.nodes {
+			if !net.down[id] && n.IsLeader() {
+				if found != nil {
+					return false
+				}
+				found = n
+			}
+		}
+		return found != nil
+	})
+	return found
+}
+
+// converged waits for every reachable node to apply the same commands
+func (net *network) converged(t *testing.T, count int) {
+	eventually(t, "nodes to apply every command", func() bool {
+		net.lock.Lock()
+		defer net.lock.Unlock()
+		var expected [][]byte
+		for id, m := range net.machines {
+			if net.down[id] {
+				continue
+			}
+			applied := m.commands()
+			if len(applied) != count {
+				return false
+			}
+			if expected == nil {
+				expected = applied
+			}
+			for i := range applied {
+				if !bytes.Equal(applied[i], expected[i]) {
+					t.Fatalf("Nodes applied different commands at %d", i)
+				}
+			}
+		}
+		return true
+	})
+}
+
+func eventually(t *testing.T, what string, check func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if check() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func propose(t *testing.T, n *Node, from int, to int) {
+	for i := from; i < to; i++ {
+		if _, err := n.Propose([]byte(fmt.Sprintf("command %d", i))); err != nil {
+			t.Fatalf("Error proposing command %d: %v", i, err)
+		}
+	}
+}
+
+/********************************
+ *** TESTS
+ ********************************/
+
+func TestSingleNode(t *testing.T) {
+	net := newNetwork(1)
+	defer net.close()
+	leader := net.leader(t)
+	propose(t, leader, 0, 10)
+	net.converged(t, 10)
+
+	// A proposal returns the result of applying it.
+	if applied, err := leader.Propose([]byte("command")); err != nil || applied != 11 {
+		t.Fatalf("Proposal should return the result of applying it, got %v %v", applied, err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	net := newNetwork(3)
+	defer net.close()
+	leader := net.leader(t)
+	for _, n := range net.nodes {
+		if n != leader {
+			if _, err := n.Propose([]byte("command")); err != ErrNotLeader {
+				t.Fatalf("A follower should refuse proposals, got %v", err)
+			}
+		}
+	}
+	propose(t, leader, 0, 20)
+	net.converged(t, 20)
+}
+
+func TestLeaderFailure(t *testing.T) {
+	net := newNetwork(3)
+	defer net.close()
+	leader := net.leader(t)
+	propose(t, leader, 0, 20)
+
+	// The remaining nodes elect a leader, which holds every committed command.
+	net.setDown(leader.id, true)
+	leader.Close()
+	next := net.leader(t)
+	if next == leader {
+		t.Fatalf("A failed node should not remain leader")
+	}
+	propose(t, next, 20, 30)
+	net.converged(t, 30)
+	if _, err := leader.Propose([]byte("command")); err != ErrClosed {
+		t.Fatalf("A closed node should refuse proposals, got %v", err)
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	defer func(max uint64) { maxLogEntries = max }(maxLogEntries)
+	maxLogEntries = 8
+	net := newNetwork(3)
+	defer net.close()
+	leader := net.leader(t)
+
+	// A follower cut off while the log is compacted is sent a snapshot.
+	var lagging *Node
+	for _, n := range net.nodes {
+		if n != leader {
+			lagging = n
+		}
+	}
+	net.setDown(lagging.id, true)
+	propose(t, leader, 0, 50)
+	net.setDown(lagging.id, false)
+	net.converged(t, 50)
+	lagging.lock.Lock()
+	defer lagging.lock.Unlock()
+	if lagging.snapshotIndex == 0 {
+		t.Fatalf("Lagging follower should have installed a snapshot")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	defer func(max uint64) { maxLogEntries = max }(maxLogEntries)
+	maxLogEntries = 8
+	dir, err := ioutil.TempDir("", "talek-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	machine := &testMachine{}
+	n, err := NewPersistentNode("test-persist", "node0", nil, machine, dir)
+	if err != nil {
+		t.Fatalf("Error creating node: %v", err)
+	}
+	eventually(t, "a leader to be elected", n.IsLeader)
+	propose(t, n, 0, 20)
+	n.lock.Lock()
+	term, compacted := n.term, n.snapshotIndex > 0
+	n.lock.Unlock()
+	if !compacted {
+		t.Fatalf("Log should have been compacted")
+	}
+	n.Close()
+
+	// A restarted node restores its snapshot and log, and applies the
+	// entries following the snapshot again once it commits them.
+	restored := &testMachine{}
+	n, err = NewPersistentNode("test-persist", "node0", nil, restored, dir)
+	if err != nil {
+		t.Fatalf("Error restoring node: %v", err)
+	}
+	defer n.Close()
+	n.lock.Lock()
+	if n.term < term || n.votedFor != "node0" {
+		t.Fatalf("Restored node should remember term %d and its vote, got %d and %q", term, n.term, n.votedFor)
+	}
+	n.lock.Unlock()
+	eventually(t, "the restored node to apply every command", func() bool {
+		return len(restored.commands()) == 20
+	})
+	propose(t, n, 20, 25)
+	for i, command := range restored.commands() {
+		if !bytes.Equal(command, []byte(fmt.Sprintf("command %d", i))) {
+			t.Fatalf("Restored node applied %q at %d", command, i)
+		}
+	}
+}
+
+func TestSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talek-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	machine := &testMachine{}
+	n, err := NewPersistentNode("test-save", "node0", nil, machine, dir)
+	if err != nil {
+		t.Fatalf("Error creating node: %v", err)
+	}
+	defer n.Close()
+	eventually(t, "a leader to be elected", n.IsLeader)
+	propose(t, n, 0, 5)
+
+	// A proposal which cannot be saved is dropped, and is not saved with the
+	// proposals following it.
+	n.lock.Lock()
+	last := n.lastIndex()
+	n.wal.Close()
+	n.lock.Unlock()
+	if _, err := n.Propose([]byte("unsaved")); err == nil {
+		t.Fatalf("A proposal which cannot be saved should fail")
+	}
+	n.lock.Lock()
+	if n.lastIndex() != last || n.unsaved != 0 {
+		t.Fatalf("A failed proposal should be dropped, got last index %d and unsaved %d", n.lastIndex(), n.unsaved)
+	}
+	n.wal, err = persist.OpenLog(n.logPath())
+	n.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	propose(t, n, 5, 10)
+	eventually(t, "the node to apply every command", func() bool {
+		return len(machine.commands()) == 10
+	})
+	for i, command := range machine.commands() {
+		if !bytes.Equal(command, []byte(fmt.Sprintf("command %d", i))) {
+			t.Fatalf("Node applied %q at %d", command, i)
+		}
+	}
+}
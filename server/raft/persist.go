@@ -0,0 +1,252 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+
+	protocol "github.com/privacylab/talek/protocol/raft"
+	"github.com/privacylab/talek/server/persist"
+)
+
+// A persistent node saves its term, vote and log as a checkpoint, holding its
+// snapshot and the entries following it, plus a log of the changes since.
+// Each logged record carries the count of records logged before it, so
+// records already covered by the checkpoint are skipped if a crash interrupts
+// log truncation.
+
+// Record kinds of the log
+const (
+	voteRecord  = 'v'
+	entryRecord = 'e'
+)
+
+var errCorruptRecord = errors.New("corrupt raft record")
+
+func (n *Node) checkpointPath() string {
+	return filepath.Join(n.persistPath, n.name+".raft")
+}
+
+func (n *Node) logPath() string {
+	return filepath.Join(n.persistPath, n.name+".raftlog")
+}
+
+// restore recovers the persisted state of the node, restores its machine to
+// the persisted snapshot, and opens its log for subsequent records. It must
+// be called before the node's loops start.
+func (n *Node) restore() error {
+	if err := os.MkdirAll(n.persistPath, 0700); err != nil {
+		return err
+	}
+
+	state, err := persist.ReadSnapshot(n.checkpointPath())
+	if err == nil {
+		if err = n.unmarshalState(state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	_, err = persist.ReadLog(n.logPath(), n.replay)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if n.snapshot != nil {
+		if err := n.machine.Restore(n.snapshot); err != nil {
+			return err
+		}
+	}
+	n.commitIndex = n.snapshotIndex
+	n.lastApplied = n.snapshotIndex
+	n.savedTerm, n.savedVote = n.term, n.votedFor
+
+	n.wal, err = persist.OpenLog(n.logPath())
+	if err != nil {
+		return err
+	}
+	n.log.Info.Printf("%v restored term %d with snapshot through %d and %d entries.", n.id, n.term, n.snapshotIndex, len(n.entries))
+	return nil
+}
+
+// save durably records any change to the term, vote or entries of the node,
+// before it replies to or acts on them. Must hold the lock.
+func (n *Node) save() error {
+	if n.wal == nil {
+		n.unsaved = 0
+		return nil
+	}
+	changed := false
+	if n.term != n.savedTerm || n.votedFor != n.savedVote {
+		if err := n.logRecord(encodeVote(n.term, n.votedFor)); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if n.unsaved != 0 {
+		from := n.unsaved
+		if from <= n.snapshotIndex {
+			from = n.snapshotIndex + 1
+		}
+		for index := from; index <= n.lastIndex(); index++ {
+			if err := n.logRecord(encodeEntry(&n.entries[index-n.snapshotIndex-1])); err != nil {
+				return err
+			}
+		}
+		changed = true
+	}
+	if changed {
+		if err := n.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	n.savedTerm, n.savedVote, n.unsaved = n.term, n.votedFor, 0
+	return nil
+}
+
+// markUnsaved notes that the entries from index onwards changed. Must hold
+// the lock.
+func (n *Node) markUnsaved(index uint64) {
+	if n.unsaved == 0 || index < n.unsaved {
+		n.unsaved = index
+	}
+}
+
+// checkpoint durably records the snapshot and the entries following it, and
+// truncates the log. Must hold the lock.
+func (n *Node) checkpoint() error {
+	if n.wal == nil {
+		return nil
+	}
+	err := persist.WriteSnapshot(n.checkpointPath(), n.marshalState())
+	if err == nil {
+		err = n.wal.Reset()
+	}
+	if err != nil {
+		return err
+	}
+	n.savedTerm, n.savedVote, n.unsaved = n.term, n.votedFor, 0
+	return nil
+}
+
+// Must hold the lock.
+func (n *Node) closePersistence() {
+	if n.wal == nil {
+		return
+	}
+	if err := n.checkpoint(); err != nil {
+		n.log.Error.Printf("%v failed to checkpoint: %v", n.id, err)
+	}
+	n.wal.Close()
+	n.wal = nil
+}
+
+// Must hold the lock.
+func (n *Node) logRecord(record []byte) error {
+	var count [8]byte
+	binary.LittleEndian.PutUint64(count[:], n.records)
+	if err := n.wal.Append(append(count[:], record...)); err != nil {
+		return err
+	}
+	n.records++
+	return nil
+}
+
+// replay applies a record of the log to the restored state.
+func (n *Node) replay(record []byte) error {
+	if len(record) < 9 {
+		return errCorruptRecord
+	}
+	count := binary.LittleEndian.Uint64(record[0:8])
+	if count < n.records {
+		return nil
+	}
+	n.records = count + 1
+	data := record[9:]
+	switch record[8] {
+	case voteRecord:
+		if len(data) < 8 {
+			return errCorruptRecord
+		}
+		n.term, n.votedFor = binary.LittleEndian.Uint64(data[0:8]), string(data[8:])
+	case entryRecord:
+		if len(data) < 16 {
+			return errCorruptRecord
+		}
+		e := protocol.Entry{
+			Term:  binary.LittleEndian.Uint64(data[0:8]),
+			Index: binary.LittleEndian.Uint64(data[8:16]),
+			Data:  append([]byte{}, data[16:]...),
+		}
+		if e.Index <= n.snapshotIndex || e.Index > n.lastIndex()+1 {
+			return errCorruptRecord
+		}
+		// A later record of an index replaces the entries from it.
+		n.entries = append(n.entries[:e.Index-n.snapshotIndex-1], e)
+	default:
+		return errCorruptRecord
+	}
+	return nil
+}
+
+func encodeVote(term uint64, votedFor string) []byte {
+	record := make([]byte, 9, 9+len(votedFor))
+	record[0] = voteRecord
+	binary.LittleEndian.PutUint64(record[1:9], term)
+	return append(record, votedFor...)
+}
+
+func encodeEntry(e *protocol.Entry) []byte {
+	record := make([]byte, 17, 17+len(e.Data))
+	record[0] = entryRecord
+	binary.LittleEndian.PutUint64(record[1:9], e.Term)
+	binary.LittleEndian.PutUint64(record[9:17], e.Index)
+	return append(record, e.Data...)
+}
+
+func (n *Node) marshalState() []byte {
+	var buf bytes.Buffer
+	header := []uint64{n.records, n.term, n.snapshotIndex, n.snapshotTerm, uint64(len(n.votedFor)), uint64(len(n.snapshot)), uint64(len(n.entries))}
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.WriteString(n.votedFor)
+	buf.Write(n.snapshot)
+	for _, e := range n.entries {
+		binary.Write(&buf, binary.LittleEndian, []uint64{e.Term, e.Index, uint64(len(e.Data))})
+		buf.Write(e.Data)
+	}
+	return buf.Bytes()
+}
+
+func (n *Node) unmarshalState(state []byte) error {
+	buf := bytes.NewReader(state)
+	header := make([]uint64, 7)
+	if err := binary.Read(buf, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	n.records, n.term, n.snapshotIndex, n.snapshotTerm = header[0], header[1], header[2], header[3]
+	if header[4]+header[5] > uint64(buf.Len()) {
+		return errCorruptRecord
+	}
+	votedFor := make([]byte, header[4])
+	buf.Read(votedFor)
+	n.votedFor = string(votedFor)
+	if header[5] > 0 {
+		n.snapshot = make([]byte, header[5])
+		buf.Read(n.snapshot)
+	}
+	n.entries = make([]protocol.Entry, 0, header[6])
+	for i := uint64(0); i < header[6]; i++ {
+		fields := make([]uint64, 3)
+		if err := binary.Read(buf, binary.LittleEndian, fields); err != nil {
+			return err
+		} else if fields[2] > uint64(buf.Len()) {
+			return errCorruptRecord
+		}
+		e := protocol.Entry{Term: fields[0], Index: fields[1], Data: make([]byte, fields[2])}
+		buf.Read(e.Data)
+		n.entries = append(n.entries, e)
+	}
+	return nil
+}
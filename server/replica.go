@@ -1,17 +1,25 @@
 package server
 
 import (
+	"errors"
 	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/drbg"
+	"github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/protocol/notify"
 	"github.com/willscott/bloom"
 	"golang.org/x/net/trace"
 )
 
-// Replica implements a centralized talek replica.
+// Replica implements a talek replica. A replica either holds the whole
+// database of its trust domain, or, in a distributed trust domain, one shard
+// of it, placing items as laid out by the trust domain's coordinator.
 type Replica struct {
 	/** Private State **/
 	// Static
@@ -24,6 +32,23 @@ type Replica struct {
 	shard          *Shard
 	committedSeqNo uint64 // Use atomic.AddUint64, atomic.LoadUint64
 	interestVector *bloom.Filter
+	coordinator    coordinator.Interface // Of a distributed trust domain
+
+	// The layout of the shard's buckets last fetched from the coordinator,
+	// against which later layouts are fetched as deltas, and the signature of
+	// its snapshot.
+	layout          []uint64
+	layoutSnapshot  uint64
+	layoutSignature coordinator.SnapshotSignature
+	layoutLock      sync.Mutex
+
+	// Writes received ahead of a missing predecessor, by GlobalSeqNo.
+	pendingWrites map[uint64]*common.ReplicaWriteArgs
+	writeLock     sync.Mutex
+
+	// Snapshot being sent to a peer catching up.
+	transfer     *stateTransfer
+	transferLock sync.Mutex
 
 	// Channels
 	ReadBatch []*common.ReadRequest
@@ -32,6 +57,16 @@ type Replica struct {
 	closeChan chan int
 }
 
+// stateTransfer is a snapshot of the database, served in chunks.
+type stateTransfer struct {
+	id    uint64
+	seqNo uint64
+	data  []byte
+}
+
+// stateChunkSize is the amount of snapshot sent in each GetState reply.
+const stateChunkSize = 1 << 20
+
 // NewReplica creates a new Replica server.
 func NewReplica(name string, socket string, config Config) *Replica {
 	r := &Replica{}
@@ -48,8 +83,22 @@ func NewReplica(name string, socket string, config Config) *Replica {
 	r.interestVector = iv
 
 	r.config.Store(config)
+	r.pendingWrites = make(map[uint64]*common.ReplicaWriteArgs)
 
 	r.shard = NewShard(name, socket, config)
+	if r.shard == nil {
+		return nil
+	}
+	if config.distributed() {
+		r.coordinator = config.Coordinator
+		if r.coordinator == nil && config.CoordinatorKey != [32]byte{} {
+			r.coordinator = coordinator.NewVerifyingClient(name, config.CoordinatorAddress, config.CoordinatorKey)
+		} else if r.coordinator == nil {
+			r.coordinator = coordinator.NewClient(name, config.CoordinatorAddress)
+		}
+	}
+	// Resume from any persisted state.
+	r.committedSeqNo = r.shard.seqNo
 
 	return r
 }
@@ -61,8 +110,15 @@ func (r *Replica) Close() {
 }
 
 /** PUBLIC METHODS (threadsafe) **/
-// TODO: need a receive queue serializer to be able to pause on missing seq numbers and
-// process only in order - in case conn between leader and replica needs restart.
+
+// Write applies a write from the frontend. Writes are applied strictly in
+// order of GlobalSeqNo: a write arriving ahead of its predecessors is held
+// until they arrive, and the reply lists the writes still missing so that
+// the frontend can retransmit them. Duplicate writes are ignored.
+// Epoch writes prepare or commit a snapshot of the writes applied so far, and
+// reply with the latest of them so the frontend can check replicas agree.
+// Preparing an epoch also replies with the root of the shard's buckets, which
+// the shards of a distributed trust domain combine as the epoch commits.
 func (r *Replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWriteReply) error {
 	r.log.Trace.Println("Write: enter")
 	tr := trace.New("replica.write", "Write")
@@ -76,17 +132,54 @@ func (r *Replica) Write(args *common.ReplicaWriteArgs, reply *common.ReplicaWrit
 		return nil
 	}
 
-	r.shard.Write(args)
-	r.interestVector.TestAndSet(args.InterestVector)
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
 
-	atomic.StoreUint64(&r.committedSeqNo, args.GlobalSeqNo)
-	reply.GlobalSeqNo = args.GlobalSeqNo
+	if args.EpochFlag {
+		if r.coordinator != nil && (args.Phase == common.EpochPrepare || args.Phase == common.EpochImmediate) {
+			if err := r.syncLayout(r.config.Load().(Config)); err != nil {
+				reply.Err = err.Error()
+				r.log.Warn.Printf("Epoch %d not prepared: %v", args.EpochID, err)
+				return nil
+			}
+		}
+		if err := r.shard.Write(args); err != nil {
+			reply.Err = err.Error()
+		} else if args.Phase == common.EpochPrepare || args.Phase == common.EpochImmediate {
+			// Set by the write thread before the epoch write returned.
+			reply.Root = r.shard.preparedRoot
+		}
+		reply.GlobalSeqNo = atomic.LoadUint64(&r.committedSeqNo)
+		return nil
+	}
+
+	config := r.config.Load().(Config)
+	next := atomic.LoadUint64(&r.committedSeqNo) + 1
+	if args.GlobalSeqNo >= next {
+		if args.GlobalSeqNo-next >= config.WindowSize() {
+			reply.Err = errTooFarBehind.Error()
+			r.log.Warn.Printf("Write %d is beyond the window from %d.", args.GlobalSeqNo, next)
+			return nil
+		}
+		r.pendingWrites[args.GlobalSeqNo] = args
+	}
+	for write, ok := r.pendingWrites[next]; ok; write, ok = r.pendingWrites[next] {
+		delete(r.pendingWrites, next)
+		r.apply(write)
+		next++
+	}
+
+	reply.GlobalSeqNo = next - 1
+	reply.Missing = r.missingWrites(next)
 	r.log.Trace.Println("Write: exit")
 	return nil
 }
 
 // BatchRead performs a set of reads against the talek database at one logical point in time.
 // BatchRead is replicated to followers with a batching determined by the leader.
+// Reads are made against the named epoch, which must be current or previous.
+// The reply carries the merkle root of the epoch, and a digest of the response
+// to each read, signed by the trust domain.
 func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchReadReply) error {
 	r.log.Trace.Println("BatchRead: enter")
 	tr := trace.New("replica.batchread", "BatchRead")
@@ -96,6 +189,7 @@ func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchRe
 
 	localArgs := new(DecodedBatchReadRequest)
 	localArgs.ReplyChan = make(chan *common.BatchReadReply)
+	localArgs.Epoch = args.Epoch
 	localArgs.Args = make([]common.PirArgs, config.ReadBatch)
 	for i, val := range args.Args {
 		//Handle pad requests.
@@ -116,9 +210,17 @@ func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchRe
 
 	// wait for results
 	myReply := <-localArgs.ReplyChan
+	if myReply.Err != "" {
+		reply.Err = myReply.Err
+		return nil
+	}
 
-	// Mutate results
+	// Mutate results. In a distributed trust domain, the pad is applied by
+	// only the first shard, since the responses of shards are combined.
 	for i, val := range localArgs.Args {
+		if config.ShardID > 0 && config.distributed() {
+			break
+		}
 		if myReply.Replies[i].Err == "" {
 			if err := drbg.Overlay(val.PadSeed, myReply.Replies[i].Data); err != nil {
 				myReply.Replies[i].Err = err.Error()
@@ -131,6 +233,266 @@ func (r *Replica) BatchRead(args *common.BatchReadRequest, reply *common.BatchRe
 		return nil
 	}
 	reply.Replies = myReply.Replies[0:len(args.Args)]
+	// Sign the root of the epoch read, so that clients can check that every
+	// trust domain read the same database, and the response to each read, so
+	// that clients can compare the answers of trust domains.
+	reply.Root = myReply.Root
+	reply.Digests = make([]common.ReadDigest, len(reply.Replies))
+	for i := range reply.Replies {
+		reply.Digests[i] = common.NewReadDigest(reply.Replies[i].Data)
+	}
+	if config.TrustDomain != nil && len(reply.Replies) > 0 {
+		epoch := reply.Replies[0].Epoch
+		root, err := common.NewDBRoot(config.TrustDomain, epoch, reply.Replies[0].GlobalSeqNo, myReply.Root.Root)
+		if err != nil {
+			r.log.Warn.Printf("Could not sign database root: %v", err)
+		}
+		reply.Root = root
+		for i, val := range args.Args {
+			var request []byte
+			if len(val.PirArgs) > config.TrustDomainIndex {
+				request = val.PirArgs[config.TrustDomainIndex]
+			}
+			if err := reply.Digests[i].Sign(config.TrustDomain, epoch, request); err != nil {
+				r.log.Warn.Printf("Could not sign read response: %v", err)
+			}
+		}
+	}
 	r.log.Trace.Println("BatchRead: exit")
 	return nil
 }
+
+// GetState serves a consistent snapshot of the database to a peer, in chunks.
+// A request without a snapshot id begins a new snapshot; subsequent requests
+// name it and the offset to continue from.
+func (r *Replica) GetState(args *common.GetStateArgs, reply *common.GetStateReply) error {
+	r.log.Trace.Println("GetState: enter")
+	r.transferLock.Lock()
+	defer r.transferLock.Unlock()
+
+	if args.Snapshot == 0 {
+		state, seqNo, err := r.shard.GetState()
+		if err != nil {
+			reply.Err = err.Error()
+			return nil
+		}
+		id := uint64(1)
+		if r.transfer != nil {
+			id = r.transfer.id + 1
+		}
+		r.transfer = &stateTransfer{id, seqNo, state}
+	} else if r.transfer == nil || r.transfer.id != args.Snapshot {
+		reply.Err = errSnapshotGone.Error()
+		return nil
+	}
+
+	t := r.transfer
+	if args.Offset > uint64(len(t.data)) {
+		reply.Err = "offset beyond end of snapshot"
+		return nil
+	}
+	end := args.Offset + stateChunkSize
+	if end > uint64(len(t.data)) {
+		end = uint64(len(t.data))
+	}
+	reply.Snapshot = t.id
+	reply.SeqNo = t.seqNo
+	reply.Length = uint64(len(t.data))
+	reply.Data = t.data[args.Offset:end]
+	r.log.Trace.Println("GetState: exit")
+	return nil
+}
+
+// CatchUp replaces the database with a snapshot transferred from a healthy
+// peer, and then resumes applying writes from the frontend after the
+// snapshot's seqno. Writes buffered during the transfer that follow the
+// snapshot are applied; any gap is reported to the frontend on its next write.
+// The interest vector is not transferred, and rebuilds as writes arrive.
+func (r *Replica) CatchUp(peer common.ReplicaStateInterface) error {
+	var state []byte
+	var seqNo uint64
+	args := &common.GetStateArgs{}
+	for {
+		reply := &common.GetStateReply{}
+		if err := peer.GetState(args, reply); err != nil {
+			return err
+		}
+		if reply.Err != "" {
+			return errors.New(reply.Err)
+		}
+		if state == nil {
+			state = make([]byte, 0, reply.Length)
+		}
+		state = append(state, reply.Data...)
+		args.Snapshot = reply.Snapshot
+		args.Offset = uint64(len(state))
+		if args.Offset >= reply.Length {
+			seqNo = reply.SeqNo
+			break
+		}
+		if len(reply.Data) == 0 {
+			return errors.New("peer stopped sending state")
+		}
+	}
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+	if committed := atomic.LoadUint64(&r.committedSeqNo); seqNo <= committed {
+		r.log.Info.Printf("Peer state at %d is not ahead of local state at %d.", seqNo, committed)
+		return nil
+	}
+	if err := r.shard.SetState(state); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&r.committedSeqNo, seqNo)
+
+	for pending := range r.pendingWrites {
+		if pending <= seqNo {
+			delete(r.pendingWrites, pending)
+		}
+	}
+	next := seqNo + 1
+	for write, ok := r.pendingWrites[next]; ok; write, ok = r.pendingWrites[next] {
+		delete(r.pendingWrites, next)
+		r.apply(write)
+		next++
+	}
+	r.log.Info.Printf("Caught up to seqno %d from peer.", next-1)
+	return nil
+}
+
+// Notify is called by the coordinator of a distributed trust domain when it
+// snapshots a new layout. The layout is placed ahead of the next epoch if it
+// reflects the writes applied so far.
+func (r *Replica) Notify(args *notify.Args, reply *notify.Reply) error {
+	if r.coordinator == nil {
+		reply.Err = "not in a distributed trust domain"
+		return nil
+	}
+	layout, signature, err := r.fetchLayout(args.SnapshotID)
+	if err == nil {
+		err = r.shard.SetLayout(layout, signature.FirstID, signature.LastID)
+	}
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+/** Private methods **/
+
+// layoutPollInterval is how often the coordinator is asked for a new layout
+// while an epoch waits for it.
+const layoutPollInterval = 10 * time.Millisecond
+
+var errTooFarBehind = errors.New("replica too far behind to buffer write")
+var errSnapshotGone = errors.New("snapshot is no longer available")
+
+// apply commits the next write in order to the database. In a distributed
+// trust domain, every shard also commits it to the coordinator, which places
+// it in the layout of a later snapshot once the first of them arrives.
+func (r *Replica) apply(args *common.ReplicaWriteArgs) {
+	r.shard.Write(args)
+	r.interestVector.TestAndSet(args.InterestVector)
+	atomic.StoreUint64(&r.committedSeqNo, args.GlobalSeqNo)
+
+	if r.coordinator != nil {
+		commit := &coordinator.CommitArgs{ID: args.GlobalSeqNo, Bucket1: args.Bucket1, Bucket2: args.Bucket2, Time: args.Time}
+		var reply coordinator.CommitReply
+		if err := r.coordinator.Commit(commit, &reply); err != nil || reply.Err != "" {
+			r.log.Error.Printf("Failed to commit write %d to the coordinator: %v%v", args.GlobalSeqNo, err, reply.Err)
+		}
+	}
+}
+
+// syncLayout places the writes applied so far as laid out by the coordinator,
+// waiting up to a write interval for it to snapshot a layout of them all. A
+// layout of writes not yet applied is left for the frontend to retransmit
+// them and prepare the epoch again.
+func (r *Replica) syncLayout(config Config) error {
+	deadline := time.Now().Add(config.WriteInterval)
+	for {
+		var info coordinator.GetInfoReply
+		err := r.coordinator.GetInfo(nil, &info)
+		if err == nil && info.Err != "" {
+			err = errors.New(info.Err)
+		}
+		var layout []uint64
+		var signature coordinator.SnapshotSignature
+		if err == nil {
+			layout, signature, err = r.fetchLayout(info.SnapshotID)
+		}
+		if err == nil {
+			err = r.shard.SetLayout(layout, signature.FirstID, signature.LastID)
+		}
+		if err == nil || err == errLayoutAhead {
+			return nil
+		} else if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(layoutPollInterval)
+	}
+}
+
+// fetchLayout gets the layout of the shard's buckets from the coordinator,
+// with the signature of its snapshot. Only the slots changed since the layout
+// last fetched are transferred, unless the coordinator no longer holds the
+// changes of its snapshot, or the layout they produce differs from the one
+// the coordinator signed.
+func (r *Replica) fetchLayout(snapshotID uint64) ([]uint64, coordinator.SnapshotSignature, error) {
+	config := r.config.Load().(Config)
+	shardID, numShards := config.ShardID, config.numShards()
+	r.layoutLock.Lock()
+	defer r.layoutLock.Unlock()
+	if r.layout != nil && snapshotID == r.layoutSnapshot {
+		return append([]uint64{}, r.layout...), r.layoutSignature, nil
+	} else if r.layout != nil && snapshotID > r.layoutSnapshot {
+		args := &coordinator.GetLayoutDeltaArgs{FromSnapshotID: r.layoutSnapshot, ToSnapshotID: snapshotID, ShardID: shardID, NumShards: numShards}
+		var reply coordinator.GetLayoutDeltaReply
+		if err := r.coordinator.GetLayoutDelta(args, &reply); err == nil && reply.Err == "" {
+			// Copied, since the shard may still hold the previous layout.
+			layout := append([]uint64{}, r.layout...)
+			for i, slot := range reply.Slots {
+				if slot < uint64(len(layout)) {
+					layout[slot] = reply.Layout[i]
+				}
+			}
+			verify := config.CoordinatorKey != [32]byte{}
+			if !verify || reply.Signature.VerifyLayout(layout, shardID, numShards, reply.Proof) {
+				r.layout, r.layoutSnapshot, r.layoutSignature = layout, snapshotID, reply.Signature
+				return layout, reply.Signature, nil
+			}
+		}
+	}
+
+	args := &coordinator.GetLayoutArgs{SnapshotID: snapshotID, ShardID: shardID, NumShards: numShards}
+	var reply coordinator.GetLayoutReply
+	if err := r.coordinator.GetLayout(args, &reply); err != nil {
+		return nil, coordinator.SnapshotSignature{}, err
+	} else if reply.Err != "" {
+		return nil, coordinator.SnapshotSignature{}, errors.New(reply.Err)
+	}
+	r.layout, r.layoutSnapshot, r.layoutSignature = reply.Layout, snapshotID, reply.Signature
+	return reply.Layout, reply.Signature, nil
+}
+
+// missingWrites lists the gaps from next up to the latest pending write.
+func (r *Replica) missingWrites(next uint64) []uint64 {
+	if len(r.pendingWrites) == 0 {
+		return nil
+	}
+	pending := make([]uint64, 0, len(r.pendingWrites))
+	for seqNo := range r.pendingWrites {
+		pending = append(pending, seqNo)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+
+	missing := make([]uint64, 0)
+	for _, seqNo := range pending {
+		for ; next < seqNo; next++ {
+			missing = append(missing, next)
+		}
+		next = seqNo + 1
+	}
+	return missing
+}
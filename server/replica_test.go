@@ -1,10 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"testing"
 
 	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/drbg"
 	"github.com/privacylab/talek/libtalek"
 )
 
@@ -35,12 +37,148 @@ func BenchmarkWrite(b *testing.B) {
 	}
 
 	var reply common.ReplicaWriteReply
-	t0 := NewReplica("t0", "cpu.0", Config{&config, 1, 0, 0, nil, 0})
+	t0 := NewReplica("t0", "cpu.0", Config{&config, 1, 0, 0, nil, 0, "", 0, 0, 0, "", [32]byte{}, nil, nil})
 
 	// Start timing
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
+		// Writes are applied in order, so each needs the next seqno.
+		repArgs.GlobalSeqNo = uint64(i + 1)
 		_ = t0.Write(repArgs, &reply)
 	}
 
 }
+
+func TestReplicaWriteOrder(t *testing.T) {
+	config := common.Config{
+		NumBuckets:         64,
+		BucketDepth:        4,
+		DataSize:           256,
+		MaxLoadFactor:      0.90,
+		BloomFalsePositive: 0.1,
+	}
+	r := NewReplica("TestReplicaWriteOrder", "cpu.0", Config{Config: &config, ReadBatch: 1})
+	defer r.Close()
+
+	write := func(seqNo uint64) *common.ReplicaWriteReply {
+		reply := &common.ReplicaWriteReply{}
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     seqNo % config.NumBuckets,
+			Bucket2:     (seqNo + 1) % config.NumBuckets,
+			Data:        make([]byte, config.DataSize),
+		}}
+		if err := r.Write(args, reply); err != nil || reply.Err != "" {
+			t.Fatalf("Write %d failed: %v %v", seqNo, err, reply.Err)
+		}
+		return reply
+	}
+
+	if reply := write(3); reply.GlobalSeqNo != 0 || len(reply.Missing) != 2 || reply.Missing[0] != 1 || reply.Missing[1] != 2 {
+		t.Fatalf("Write ahead of a gap should be held: %+v", reply)
+	}
+	if reply := write(1); reply.GlobalSeqNo != 1 || len(reply.Missing) != 1 || reply.Missing[0] != 2 {
+		t.Fatalf("First write should apply, leaving a gap: %+v", reply)
+	}
+	if reply := write(5); reply.GlobalSeqNo != 1 || len(reply.Missing) != 2 || reply.Missing[1] != 4 {
+		t.Fatalf("Every gap should be reported: %+v", reply)
+	}
+	if reply := write(2); reply.GlobalSeqNo != 3 || len(reply.Missing) != 1 {
+		t.Fatalf("Filling a gap should apply held writes: %+v", reply)
+	}
+	// Retransmitted duplicates are ignored.
+	if reply := write(2); reply.GlobalSeqNo != 3 {
+		t.Fatalf("Duplicate write changed state: %+v", reply)
+	}
+	if reply := write(4); reply.GlobalSeqNo != 5 || len(reply.Missing) != 0 {
+		t.Fatalf("All writes should be applied: %+v", reply)
+	}
+	// Epoch writes wait for preceding writes to be applied.
+	r.shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	if r.shard.entries.len() != 5 || r.shard.entries.at(2).ID != 3 {
+		t.Fatalf("Writes were not applied in order")
+	}
+}
+
+func TestReplicaCatchUp(t *testing.T) {
+	config := common.Config{
+		NumBuckets:         1024,
+		BucketDepth:        4,
+		DataSize:           256,
+		MaxLoadFactor:      0.90,
+		BloomFalsePositive: 0.1,
+	}
+	td := common.NewTrustDomainConfig("td", "", true, false)
+	serverConfig := Config{Config: &config, ReadBatch: 1, TrustDomain: td}
+	healthy := NewReplica("TestReplicaCatchUp-healthy", "cpu.0", serverConfig)
+	defer healthy.Close()
+	rebuilt := NewReplica("TestReplicaCatchUp-rebuilt", "cpu.0", serverConfig)
+	defer rebuilt.Close()
+
+	write := func(r *Replica, seqNo uint64) {
+		data := make([]byte, config.DataSize)
+		for i := range data {
+			data[i] = byte(seqNo + uint64(i))
+		}
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     seqNo % config.NumBuckets,
+			Bucket2:     (seqNo * 7) % config.NumBuckets,
+			Data:        data,
+		}}
+		reply := &common.ReplicaWriteReply{}
+		if err := r.Write(args, reply); err != nil || reply.Err != "" {
+			t.Fatalf("Write %d failed: %v %v", seqNo, err, reply.Err)
+		}
+	}
+	flip := func(r *Replica) {
+		r.Write(&common.ReplicaWriteArgs{EpochFlag: true}, &common.ReplicaWriteReply{})
+	}
+	read := func(r *Replica, bucket uint64) []byte {
+		args := common.ReadArgs{TD: []common.PirArgs{{
+			RequestVector: make([]byte, config.NumBuckets/8),
+			PadSeed:       make([]byte, drbg.SeedLength),
+		}}}
+		args.TD[0].RequestVector[bucket/8] |= 1 << (bucket % 8)
+		encoded, err := args.Encode([]*common.TrustDomainConfig{td})
+		if err != nil {
+			t.Fatalf("Failed to encode read: %v", err)
+		}
+		reply := &common.BatchReadReply{}
+		if err := r.BatchRead(&common.BatchReadRequest{Args: []common.EncodedReadArgs{encoded}}, reply); err != nil || reply.Err != "" {
+			t.Fatalf("Read failed: %v %v", err, reply.Err)
+		}
+		return reply.Replies[0].Data
+	}
+	same := func() {
+		flip(healthy)
+		flip(rebuilt)
+		for bucket := uint64(0); bucket < config.NumBuckets; bucket += 37 {
+			if !bytes.Equal(read(healthy, bucket), read(rebuilt, bucket)) {
+				t.Fatalf("Replicas disagree on bucket %d", bucket)
+			}
+		}
+	}
+
+	for seqNo := uint64(1); seqNo <= 500; seqNo++ {
+		write(healthy, seqNo)
+	}
+	// The snapshot spans several chunks, and a live write arriving during
+	// the transfer is held until the snapshot is installed.
+	write(rebuilt, 501)
+	if err := rebuilt.CatchUp(healthy); err != nil {
+		t.Fatalf("Failed to catch up: %v", err)
+	}
+	write(healthy, 501)
+	if rebuilt.committedSeqNo != 501 {
+		t.Fatalf("Held write was not applied after catching up, at %d", rebuilt.committedSeqNo)
+	}
+	same()
+
+	// Both replicas then follow the live write stream identically.
+	for seqNo := uint64(502); seqNo <= 600; seqNo++ {
+		write(healthy, seqNo)
+		write(rebuilt, seqNo)
+	}
+	same()
+}
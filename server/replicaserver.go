@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -8,6 +9,8 @@ import (
 
 	"github.com/gorilla/rpc"
 	"github.com/gorilla/rpc/json"
+	"github.com/privacylab/talek/protocol/coordinator"
+	"github.com/privacylab/talek/protocol/notify"
 )
 
 // ReplicaServer is an RPC server for a Replica
@@ -31,6 +34,7 @@ func NewReplicaServer(name string, backing string, serverConfig Config) *Replica
 	r.Server = rpc.NewServer()
 	r.Server.RegisterCodec(json.NewCodec(), "application/json")
 	r.Server.RegisterTCPService(r.Replica, "Replica")
+	r.Server.RegisterTCPService(&notify.Service{Interface: r.Replica}, "Notify")
 
 	return r
 }
@@ -41,6 +45,7 @@ func (r *ReplicaServer) Run(address string) (net.Listener, error) {
 		r.Server = rpc.NewServer()
 		r.Server.RegisterCodec(&json.Codec{}, "application/json")
 		r.Server.RegisterTCPService(r.Replica, "Replica")
+		r.Server.RegisterTCPService(&notify.Service{Interface: r.Replica}, "Notify")
 	}
 
 	bindAddr, err := net.ResolveTCPAddr("tcp4", address)
@@ -55,3 +60,32 @@ func (r *ReplicaServer) Run(address string) (net.Listener, error) {
 
 	return listener, nil
 }
+
+// Register asks the coordinator of a distributed trust domain to notify the
+// replica of new snapshots at address.
+func (r *ReplicaServer) Register(address string) error {
+	if r.Replica.coordinator == nil {
+		return errors.New("replica has no coordinator")
+	}
+	var reply coordinator.RegisterReply
+	if err := r.Replica.coordinator.Register(&coordinator.RegisterArgs{Name: r.name, Address: address}, &reply); err != nil {
+		return err
+	} else if reply.Err != "" {
+		return errors.New(reply.Err)
+	}
+	return nil
+}
+
+// Unregister stops notifications from the coordinator to address.
+func (r *ReplicaServer) Unregister(address string) error {
+	if r.Replica.coordinator == nil {
+		return errors.New("replica has no coordinator")
+	}
+	var reply coordinator.UnregisterReply
+	if err := r.Replica.coordinator.Unregister(&coordinator.UnregisterArgs{Address: address}, &reply); err != nil {
+		return err
+	} else if reply.Err != "" {
+		return errors.New(reply.Err)
+	}
+	return nil
+}
@@ -1,18 +1,23 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"sync/atomic"
 
 	"github.com/privacylab/talek/common"
 	"github.com/privacylab/talek/cuckoo"
+	"github.com/privacylab/talek/merkle"
 	"github.com/privacylab/talek/pir"
+	"github.com/privacylab/talek/server/persist"
 )
 
 // Shard represents a single shard of the PIR database.
 // It runs a thread handling processing of incoming requests. It is
 // responsible for the logic of placing writes into memory and managing a cuckoo
 // hash table for doing so, and of driving the PIR daemon.
+// In a distributed trust domain, the shard instead places writes as laid out
+// by the coordinator, and holds and hashes only its range of buckets.
 type Shard struct {
 	// Private State
 	log  *common.Logger
@@ -22,20 +27,98 @@ type Shard struct {
 	*pir.DB
 	dead int
 
-	Entries []cuckoo.Item
-	*cuckoo.Table
+	entries       window // Items in the window, by GlobalSeqNo
+	*cuckoo.Table        // Nil in a distributed trust domain
+
+	// In a distributed trust domain, the placement of items in the buckets
+	// held by the shard, the first of them, and those changed since the last
+	// epoch. Owned by the write thread.
+	layout       []uint64
+	bucketOffset uint64
+	dirty        []uint64
 
 	config atomic.Value // Config
 
 	// Channels
 	writeChan        chan *common.ReplicaWriteArgs
 	readChan         chan *DecodedBatchReadRequest
-	outstandingReads chan chan *common.BatchReadReply
+	outstandingReads chan *outstandingRead
 	readReplies      chan []byte
-	syncChan         chan int
+	syncChan         chan int   // Acknowledges shutdown of the read thread
+	writeSync        chan error // Acknowledges epochs and shutdown of the write thread
+	stateChan        chan *stateRequest
+	layoutChan       chan *layoutRequest
+	epochChan        chan *epochUpdate
+
+	// Snapshots of the database readable by epoch, owned by the read thread.
+	// The previous epoch is kept until every replica has committed the current.
+	prepared *epoch
+	current  *epoch
+	previous *epoch
+
+	// Persistence, owned by the write thread
+	wal           *persist.Log
+	applied       uint64 // Number of writes applied to the table
+	seqNo         uint64 // GlobalSeqNo of the last applied write
+	sinceSnapshot int
+
+	// Hashes of the buckets held by the shard, and their root as of the last
+	// epoch prepared. Owned by the write thread.
+	tree         *merkle.Tree
+	preparedRoot [merkle.Size]byte
+}
+
+// epoch is a snapshot of the database which reads can name, along with the
+// writes in the window when it was taken and the hashes of its buckets.
+type epoch struct {
+	id     uint64
+	seqNos common.Range
+	root   [merkle.Size]byte
+	tags   [][merkle.Size]byte
+	*pir.Snapshot
+}
+
+// epochUpdate passes a phase of an epoch flip to the read thread.
+type epochUpdate struct {
+	id       uint64
+	phase    common.EpochPhase
+	seqNos   common.Range
+	root     [merkle.Size]byte
+	tags     [][merkle.Size]byte
+	snapshot *pir.Snapshot
+	done     chan error
+}
+
+// outstandingRead is a read awaiting its PIR response, with the epoch it was
+// made against.
+type outstandingRead struct {
+	replyChan chan *common.BatchReadReply
+	epoch     uint64
+	seqNos    common.Range
+	root      [merkle.Size]byte
+	tags      [][merkle.Size]byte // The check tag of each read
+}
 
-	sinceFlip        int
-	outstandingLimit int
+// stateRequest asks the write thread to export its state, or, if install is
+// set, to replace its state.
+type stateRequest struct {
+	install []byte
+	reply   chan stateResult
+}
+
+type stateResult struct {
+	state []byte
+	seqNo uint64
+	err   error
+}
+
+// layoutRequest asks the write thread to place items as laid out by the
+// coordinator, which lays out the commits from first through last.
+type layoutRequest struct {
+	layout []uint64
+	first  uint64
+	last   uint64
+	reply  chan error
 }
 
 // DecodedBatchReadRequest represents a set of PIR args from clients.
@@ -44,10 +127,12 @@ type Shard struct {
 type DecodedBatchReadRequest struct {
 	Args      []common.PirArgs
 	ReplyChan chan *common.BatchReadReply
+	Epoch     uint64
 }
 
 // NewShard creates an interface to a PIR daemon at socket, using a given
-// server configuration for sizing and locating data.
+// server configuration for sizing and locating data. A comma separated list
+// of backings range partitions the buckets of the database across them.
 func NewShard(name string, backing string, config Config) *Shard {
 	s := &Shard{}
 	s.log = common.NewLogger(name)
@@ -57,7 +142,11 @@ func NewShard(name string, backing string, config Config) *Shard {
 	s.writeChan = make(chan *common.ReplicaWriteArgs)
 	s.readChan = make(chan *DecodedBatchReadRequest)
 	s.syncChan = make(chan int)
-	s.outstandingReads = make(chan chan *common.BatchReadReply, 5)
+	s.writeSync = make(chan error)
+	s.stateChan = make(chan *stateRequest)
+	s.layoutChan = make(chan *layoutRequest)
+	s.epochChan = make(chan *epochUpdate)
+	s.outstandingReads = make(chan *outstandingRead, 5)
 	s.readReplies = make(chan []byte)
 
 	// TODO: per-server config of where the local PIR socket is.
@@ -67,7 +156,15 @@ func NewShard(name string, backing string, config Config) *Shard {
 		return nil
 	}
 	s.Server = pirServer
-	err = s.Server.Configure(int(config.Config.DataSize*config.Config.BucketDepth), int(config.Config.NumBuckets), config.ReadBatch)
+	numBuckets := config.Config.NumBuckets / config.numShards()
+	if config.distributed() {
+		if numBuckets*config.numShards() != config.Config.NumBuckets || config.ShardID >= config.numShards() {
+			s.log.Error.Fatalf("Could not divide %d buckets into shard %d of %d.", config.Config.NumBuckets, config.ShardID, config.numShards())
+			return nil
+		}
+		s.bucketOffset = config.ShardID * numBuckets
+	}
+	err = s.Server.Configure(int(config.Config.DataSize*config.Config.BucketDepth), int(numBuckets), config.ReadBatch)
 	if err != nil {
 		s.log.Error.Fatalf("Could not start PIR back end with correct parameters: %v", err)
 		return nil
@@ -79,15 +176,48 @@ func NewShard(name string, backing string, config Config) *Shard {
 		return nil
 	}
 	s.DB = db
-	//Set initial DB
-	s.Server.SetDB(s.DB)
 
-	// TODO: rand seed
-	s.Table = cuckoo.NewTable(name+"-Table", config.Config.NumBuckets, config.Config.BucketDepth, config.Config.DataSize, db.DB, 0)
-	s.Entries = make([]cuckoo.Item, 0, config.Config.NumBuckets*config.Config.BucketDepth)
+	s.entries = newWindow(config.Config.RetentionLimit())
+	if config.distributed() {
+		if config.PersistPath != "" {
+			s.log.Warn.Printf("Persistence is not supported in a distributed trust domain.")
+		}
+		// The root of the whole database is combined from those of the
+		// buckets of each shard, which must be whole subtrees.
+		if numBuckets&(numBuckets-1) != 0 {
+			s.log.Error.Fatalf("Shards of %d buckets can not be combined into a merkle root.", numBuckets)
+			return nil
+		}
+		s.layout = make([]uint64, numBuckets*config.Config.BucketDepth)
+	} else {
+		s.Table = cuckoo.NewTable(name+"-Table", config.Config.NumBuckets, config.Config.BucketDepth, config.Config.DataSize, db.DB, config.Config.CuckooSeed)
+		if config.PersistPath != "" {
+			if err := s.restore(config); err != nil {
+				s.log.Error.Fatalf("Could not restore persisted state: %v", err)
+				return nil
+			}
+		}
+		s.Table.TakeDirty()
+	}
+	s.tree = merkle.NewTree(s.DB.DB, s.Server.CellLength)
+	s.preparedRoot = s.tree.Root()
 
-	//TODO: should be a parameter in globalconfig
-	s.outstandingLimit = int(float32(config.Config.NumBuckets*uint64(config.Config.BucketDepth)) * 0.50)
+	// Initial epoch. Subsequent epochs copy and hash only buckets changed since.
+	snap, err := s.Server.Snapshot(s.DB)
+	if err != nil {
+		s.log.Error.Fatalf("Could not snapshot DB: %v", err)
+		return nil
+	}
+	root := s.preparedRoot
+	if config.distributed() {
+		// Every shard begins empty.
+		roots := make([][merkle.Size]byte, config.numShards())
+		for i := range roots {
+			roots[i] = root
+		}
+		root = merkle.Combine(roots, int(numBuckets))
+	}
+	s.current = &epoch{0, s.windowRange(), root, s.tags(), snap}
 
 	go s.processReads()
 	go s.processReplies()
@@ -97,9 +227,15 @@ func NewShard(name string, backing string, config Config) *Shard {
 
 /** PUBLIC METHODS (threadsafe) **/
 
+// Write queues a write to the database. Writes advancing the epoch block
+// until the read thread has applied them, and return an error if the epoch
+// could not be committed.
 func (s *Shard) Write(args *common.ReplicaWriteArgs) error {
 	s.log.Trace.Println("Write: ")
 	s.writeChan <- args
+	if args.EpochFlag {
+		return <-s.writeSync
+	}
 	return nil
 }
 
@@ -108,6 +244,34 @@ func (s *Shard) BatchRead(args *DecodedBatchReadRequest) {
 	s.readChan <- args
 }
 
+// GetState returns a consistent snapshot of the database, and the seqno of
+// the latest write it reflects.
+func (s *Shard) GetState() ([]byte, uint64, error) {
+	req := &stateRequest{reply: make(chan stateResult)}
+	s.stateChan <- req
+	res := <-req.reply
+	return res.state, res.seqNo, res.err
+}
+
+// SetState replaces the database with a snapshot from GetState, and makes it
+// visible to subsequent reads.
+func (s *Shard) SetState(state []byte) error {
+	req := &stateRequest{install: state, reply: make(chan stateResult)}
+	s.stateChan <- req
+	res := <-req.reply
+	return res.err
+}
+
+// SetLayout places the items in the window as laid out by the coordinator of
+// a distributed trust domain, ahead of the next epoch. The layout is of the
+// buckets held by the shard, placing commits from first through last, which
+// must be the latest write applied.
+func (s *Shard) SetLayout(layout []uint64, first uint64, last uint64) error {
+	req := &layoutRequest{layout: layout, first: first, last: last, reply: make(chan error)}
+	s.layoutChan <- req
+	return <-req.reply
+}
+
 // Close shuts down the database.
 func (s *Shard) Close() {
 	s.log.Info.Printf("Graceful shutdown of shard.")
@@ -117,6 +281,7 @@ func (s *Shard) Close() {
 	}
 	s.dead = 1
 	s.writeChan <- nil
+	<-s.writeSync
 	s.readChan <- nil
 	<-s.syncChan
 }
@@ -128,6 +293,7 @@ func (s *Shard) processReads() {
 
 	defer s.DB.Free()
 	defer s.Server.Disconnect()
+	defer s.freeEpochs()
 	conf := s.config.Load().(Config)
 	for {
 		select {
@@ -139,14 +305,14 @@ func (s *Shard) processReads() {
 			}
 			s.batchRead(batchReadReq, conf)
 			continue
-		case <-s.syncChan:
-			s.Server.SetDB(s.DB)
+		case update := <-s.epochChan:
+			update.done <- s.applyEpoch(update)
 		}
 	}
 }
 
 func (s *Shard) processReplies() {
-	var outputChannel chan *common.BatchReadReply
+	var outstanding *outstandingRead
 	conf := s.config.Load().(Config)
 	itemLength := int(conf.DataSize * conf.BucketDepth)
 
@@ -154,20 +320,24 @@ func (s *Shard) processReplies() {
 		select {
 		case reply := <-s.readReplies:
 			// get the corresponding read request.
-			outputChannel = <-s.outstandingReads
+			outstanding = <-s.outstandingReads
 
 			response := &common.BatchReadReply{Err: "", Replies: make([]common.ReadReply, conf.ReadBatch)}
 
 			if len(reply) < conf.ReadBatch*itemLength {
 				s.log.Error.Printf("PIR Response was of length %d, not %d * %d\n", len(reply), conf.ReadBatch, itemLength)
-				outputChannel <- response
+				outstanding.replyChan <- response
 				continue
 			}
 			for i := 0; i < conf.ReadBatch; i++ {
-				response.Replies[i].Data = reply[i*itemLength : (i+1)*itemLength]
-				//TODO: reply.GlobalSeqNo
+				response.Replies[i].Data = make([]byte, itemLength+merkle.Size)
+				copy(response.Replies[i].Data, reply[i*itemLength:(i+1)*itemLength])
+				copy(response.Replies[i].Data[itemLength:], outstanding.tags[i][:])
+				response.Replies[i].GlobalSeqNo = outstanding.seqNos
+				response.Replies[i].Epoch = outstanding.epoch
 			}
-			outputChannel <- response
+			response.Root.Root = outstanding.root
+			outstanding.replyChan <- response
 		}
 	}
 }
@@ -177,55 +347,335 @@ func (s *Shard) processWrites() {
 	conf := s.config.Load().(Config)
 	for {
 		select {
+		case req := <-s.stateChan:
+			req.reply <- s.handleState(req)
+		case req := <-s.layoutChan:
+			req.reply <- s.applyLayout(req, conf)
 		case writeReq = <-s.writeChan:
 			if writeReq == nil {
+				s.closePersistence()
+				s.writeSync <- nil
 				return
 			} else if writeReq.EpochFlag {
-				s.applyWrites()
+				s.writeSync <- s.advanceEpoch(writeReq.EpochID, writeReq.Phase, writeReq.ShardRoots)
 				continue
 			}
 
-			itm := asCuckooItem(&writeReq.WriteArgs)
-			s.Entries = append(s.Entries, *itm)
-			ok, evicted := s.Table.Insert(itm)
-			// No longer need this pointer.
-			itm.Data = nil
-			if !ok || len(s.Entries) > int(float64(conf.Config.NumBuckets*conf.Config.BucketDepth)*conf.Config.MaxLoadFactor) {
-				s.evictOldItems()
+			if s.wal != nil {
+				if err := s.wal.Append(encodeLogRecord(s.applied, &writeReq.WriteArgs)); err != nil {
+					s.log.Error.Fatalf("Failed to log write: %v", err)
+				}
 			}
-			if evicted != nil {
-				ok, evicted = s.Table.Insert(evicted)
-				if !ok || evicted != nil {
-					s.log.Error.Fatalf("Consistency violation: lost an in-window DB item.")
+			s.insert(&writeReq.WriteArgs, conf)
+
+			if s.wal != nil {
+				s.sinceSnapshot++
+				if conf.SnapshotInterval > 0 && s.sinceSnapshot >= conf.SnapshotInterval {
+					s.snapshot()
 				}
 			}
-			s.sinceFlip++
+		}
+	}
+}
+
+func (s *Shard) handleState(req *stateRequest) stateResult {
+	if s.Table == nil {
+		return stateResult{err: errStateUnsupported}
+	}
+	if req.install == nil {
+		state, err := s.marshalState()
+		return stateResult{state, s.seqNo, err}
+	}
+	if err := s.unmarshalState(req.install); err != nil {
+		return stateResult{err: err}
+	}
+	// The installed state is not one of the frontend's epochs, so reads
+	// naming an epoch will fail until the next is committed.
+	s.advanceEpoch(0, common.EpochImmediate, nil)
+	if s.wal != nil {
+		s.snapshot()
+	}
+	s.log.Info.Printf("Installed state through seqno %d.", s.seqNo)
+	return stateResult{seqNo: s.seqNo}
+}
+
+// insert places a write in the cuckoo table. Items whose retention has
+// expired are evicted first, in the same way that the coordinator garbage
+// collects its commit log.
+func (s *Shard) insert(args *common.WriteArgs, conf Config) {
+	for s.entries.len() > 0 && (s.entries.len() >= s.entries.capacity() ||
+		conf.Config.Expired(s.entries.oldest().ID, s.entries.timeAt(0), args.GlobalSeqNo, args.Time)) {
+		s.evictOldest()
+	}
+
+	if s.Table == nil {
+		// The data of items which may be placed in the shard's buckets is
+		// kept until they leave the window, to be placed wherever the
+		// coordinator lays them out.
+		item := *asCuckooItem(args)
+		if !s.holds(item.Bucket1) && !s.holds(item.Bucket2) {
+			item.Data = nil
+		}
+		s.entries.push(item, args.Time)
+		s.applied++
+		s.seqNo = args.GlobalSeqNo
+		return
+	}
+
+	itm := asCuckooItem(args)
+	ok, evicted := s.Table.Insert(itm)
+	// No longer need this pointer.
+	itm.Data = nil
+	s.entries.push(*itm, args.Time)
+	if !ok && evicted == nil {
+		// An item which can never be placed is rejected, as the coordinator
+		// rejects it, but holds its place in the window.
+		s.log.Warn.Printf("Rejecting item %d, which cannot be placed.", itm.ID)
+		ok = true
+	}
+	// If the table cannot place every item in the window, the oldest are
+	// given up early rather than losing a newer one.
+	for !ok && evicted != nil {
+		s.log.Warn.Printf("Evicting item %d early to place item %d.", s.entries.oldest().ID, evicted.ID)
+		s.evictOldest()
+		if s.entries.len() == 0 || evicted.ID < s.entries.oldest().ID {
+			ok, evicted = true, nil
+			break
+		}
+		ok, evicted = s.Table.Insert(evicted)
+	}
+	if !ok {
+		s.log.Error.Fatalf("Consistency violation: lost an in-window DB item.")
+	}
+	s.applied++
+	s.seqNo = args.GlobalSeqNo
+}
+
+// advanceEpoch passes a phase of an epoch flip to the read thread, and waits
+// for it to be applied. Preparing an epoch snapshots the writes applied so far,
+// copying the buckets they changed into memory released by an earlier epoch
+// where possible. In a distributed trust domain, committing an epoch combines
+// the roots of every shard, as prepared, into the root of the whole database.
+func (s *Shard) advanceEpoch(id uint64, phase common.EpochPhase, shardRoots [][merkle.Size]byte) error {
+	update := &epochUpdate{id: id, phase: phase, done: make(chan error, 1)}
+	snapshot := phase == common.EpochPrepare || phase == common.EpochImmediate
+	var changed []uint64
+	if snapshot {
+		if s.Table != nil {
+			changed = s.Table.TakeDirty()
+			for _, bucket := range changed {
+				start := int(bucket) * s.Server.CellLength
+				s.tree.Set(int(bucket), s.DB.DB[start:start+s.Server.CellLength])
+			}
+		}
+		s.preparedRoot = s.tree.Root()
+	}
+	update.root = s.preparedRoot
+	if s.layout != nil && (phase == common.EpochCommit || phase == common.EpochImmediate) {
+		root, err := s.databaseRoot(shardRoots)
+		if err != nil {
+			s.log.Warn.Printf("Epoch %d not committed: %v", id, err)
+			return err
+		}
+		update.root = root
+	}
+	if snapshot {
+		if s.Table == nil {
+			// The tree was updated as the layout was applied.
+			changed, s.dirty = s.dirty, nil
+		}
+		update.seqNos = s.windowRange()
+		update.tags = s.tags()
+		snap, err := s.Server.SnapshotChanges(s.DB, changed)
+		if err != nil {
+			s.log.Error.Fatalf("Could not snapshot DB: %v", err)
+		}
+		update.snapshot = snap
+	}
+	s.epochChan <- update
+	return <-update.done
+}
 
-			// Trigger to swap to next DB.
-			if s.sinceFlip > s.outstandingLimit {
-				s.applyWrites()
+// applyEpoch updates the snapshots readable by the read thread. Committing an
+// epoch which is already current succeeds, so that commits can be retried.
+func (s *Shard) applyEpoch(update *epochUpdate) error {
+	switch update.phase {
+	case common.EpochPrepare:
+		if s.prepared != nil {
+			s.prepared.Free()
+		}
+		s.prepared = &epoch{update.id, update.seqNos, update.root, update.tags, update.snapshot}
+	case common.EpochCommit:
+		if s.prepared == nil || s.prepared.id != update.id {
+			if s.current != nil && s.current.id == update.id {
+				return nil
 			}
+			s.log.Warn.Printf("Commit of epoch %d, which was not prepared.", update.id)
+			return fmt.Errorf("epoch %d was not prepared", update.id)
+		}
+		s.prepared.root = update.root
+		s.commitEpoch(s.prepared)
+		s.prepared = nil
+	case common.EpochAbort:
+		if s.prepared != nil && s.prepared.id == update.id {
+			s.prepared.Free()
+			s.prepared = nil
 		}
+		if s.current != nil && s.current.id == update.id {
+			s.current.Free()
+			s.current = s.previous
+			s.previous = nil
+		}
+	default:
+		s.commitEpoch(&epoch{update.id, update.seqNos, update.root, update.tags, update.snapshot})
 	}
+	return nil
+}
+
+func (s *Shard) commitEpoch(e *epoch) {
+	if s.previous != nil {
+		s.previous.Free()
+	}
+	s.previous = s.current
+	s.current = e
+}
+
+// findEpoch returns the snapshot of a committed epoch, if still available.
+func (s *Shard) findEpoch(id uint64) *epoch {
+	if s.current != nil && s.current.id == id {
+		return s.current
+	} else if s.previous != nil && s.previous.id == id {
+		return s.previous
+	}
+	return nil
+}
+
+func (s *Shard) freeEpochs() {
+	for _, e := range []*epoch{s.prepared, s.current, s.previous} {
+		if e != nil {
+			e.Free()
+		}
+	}
+}
+
+// windowRange is the range of writes in the window, through the last applied.
+func (s *Shard) windowRange() common.Range {
+	seqNos := common.Range{Start: s.seqNo + 1, End: s.seqNo + 1, Aborted: []uint64{}}
+	if s.entries.len() > 0 {
+		seqNos.Start = s.entries.oldest().ID
+	}
+	return seqNos
+}
+
+// evictOldest removes the oldest item in the window from the table.
+func (s *Shard) evictOldest() {
+	item := s.entries.pop()
+	// Items given up early, or rejected, are no longer in the table.
+	if s.Table != nil && s.Table.Contains(&item) {
+		s.Table.Remove(&item)
+	}
+}
+
+// tags are the hashes of the buckets held by the shard.
+func (s *Shard) tags() [][merkle.Size]byte {
+	return s.tree.Leaves()
 }
 
-// applyWrites will enque a command to apply any outstanding writes to the
-// database to be seen by subsequent reads.
-func (s *Shard) applyWrites() {
-	s.syncChan <- 1
-	s.sinceFlip = 0
+// holds is whether a bucket is held by the shard.
+func (s *Shard) holds(bucket uint64) bool {
+	return bucket >= s.bucketOffset && bucket < s.bucketOffset+uint64(s.Server.CellCount)
 }
 
-func (s *Shard) evictOldItems() {
+// databaseRoot combines the roots of the buckets of every shard of a
+// distributed trust domain into the root of the whole database. The root
+// given for this shard must be the one it last prepared. A trust domain of a
+// single shard need not give the roots.
+func (s *Shard) databaseRoot(shardRoots [][merkle.Size]byte) ([merkle.Size]byte, error) {
 	conf := s.config.Load().(Config)
-	toRemove := int(float64(conf.Config.NumBuckets*conf.Config.BucketDepth) * conf.Config.LoadFactorStep)
-	if toRemove >= len(s.Entries) {
-		toRemove = len(s.Entries) - 1
+	if shardRoots == nil && conf.numShards() == 1 {
+		return s.preparedRoot, nil
+	} else if uint64(len(shardRoots)) != conf.numShards() {
+		return [merkle.Size]byte{}, fmt.Errorf("roots of %d shards rather than %d", len(shardRoots), conf.numShards())
+	} else if shardRoots[conf.ShardID] != s.preparedRoot {
+		return [merkle.Size]byte{}, errors.New("root of the shard differs from that prepared")
 	}
-	for i := 0; i < toRemove; i++ {
-		s.Table.Remove(&s.Entries[i])
+	return merkle.Combine(shardRoots, s.Server.CellCount), nil
+}
+
+var errStateUnsupported = errors.New("state transfer is not supported in a distributed trust domain")
+var errLayoutBehind = errors.New("layout does not place every write applied")
+var errLayoutAhead = errors.New("layout places writes not yet applied")
+
+// applyLayout places the items in the window as laid out by the coordinator.
+// Buckets whose placement changed are rebuilt from the data of their items,
+// hashed, and copied into the database.
+func (s *Shard) applyLayout(req *layoutRequest, conf Config) error {
+	layout := req.layout
+	if s.layout == nil {
+		return errors.New("layout of a shard outside a distributed trust domain")
+	} else if len(layout) != len(s.layout) {
+		return fmt.Errorf("layout of %d items rather than %d", len(layout), len(s.layout))
+	} else if req.last > s.seqNo {
+		return errLayoutAhead
+	} else if req.last < s.seqNo {
+		return errLayoutBehind
+	}
+	// The window holds contiguous writes, so the layout must place items
+	// within it, whose data was kept as they may be placed in the shard.
+	first := s.seqNo + 1
+	if s.entries.len() > 0 {
+		first = s.entries.oldest().ID
+	}
+	for _, id := range layout {
+		if id == 0 {
+			continue
+		} else if id < first || id < req.first || id > req.last {
+			return fmt.Errorf("layout places item %d outside the window", id)
+		} else if s.entries.at(int(id-first)).Data == nil {
+			return fmt.Errorf("layout places item %d outside its buckets", id)
+		}
+	}
+	// Older items were evicted early by the coordinator, when its table could
+	// not place every item in the window.
+	if s.entries.len() > 0 && first < req.first {
+		s.log.Warn.Printf("Evicting items %d to %d early, as the coordinator no longer places them.", first, req.first-1)
+		for s.entries.len() > 0 && s.entries.oldest().ID < req.first {
+			s.evictOldest()
+		}
+		first = req.first
+	}
+
+	depth := conf.Config.BucketDepth
+	itemSize := int(conf.Config.DataSize)
+	bucket := make([]byte, s.Server.CellLength)
+	for b := uint64(0); b < uint64(s.Server.CellCount); b++ {
+		items := layout[b*depth : (b+1)*depth]
+		if equalLayout(items, s.layout[b*depth:(b+1)*depth]) {
+			continue
+		}
+		for i := range bucket {
+			bucket[i] = 0
+		}
+		for i, id := range items {
+			if id != 0 {
+				copy(bucket[i*itemSize:(i+1)*itemSize], s.entries.at(int(id-first)).Data)
+			}
+		}
+		s.tree.Set(int(b), bucket)
+		copy(s.DB.DB[int(b)*s.Server.CellLength:], bucket)
+		s.dirty = append(s.dirty, b)
 	}
-	s.Entries = s.Entries[toRemove:]
+	copy(s.layout, layout)
+	return nil
+}
+
+func equalLayout(a, b []uint64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func asCuckooItem(wa *common.WriteArgs) *cuckoo.Item {
@@ -236,8 +686,8 @@ func asCuckooItem(wa *common.WriteArgs) *cuckoo.Item {
 func (s *Shard) batchRead(req *DecodedBatchReadRequest, conf Config) {
 	s.log.Trace.Printf("batchRead: enter\n")
 
-	// Run PIR
-	reqlength := int(conf.Config.NumBuckets) / 8
+	// Run PIR over the buckets held by the shard.
+	reqlength := s.Server.CellCount / 8
 	pirvector := make([]byte, reqlength*conf.ReadBatch)
 
 	if len(req.Args) != conf.ReadBatch {
@@ -246,17 +696,45 @@ func (s *Shard) batchRead(req *DecodedBatchReadRequest, conf Config) {
 		return
 	}
 
+	e := s.findEpoch(req.Epoch)
+	if e == nil {
+		s.log.Info.Printf("Read operation failed: epoch %d is not available.", req.Epoch)
+		req.ReplyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Epoch %d is not available.", req.Epoch)}
+		return
+	}
+
+	tags := make([][merkle.Size]byte, conf.ReadBatch)
 	for i := 0; i < conf.ReadBatch; i++ {
 		reqVector := req.Args[i].RequestVector
+		if offset := int(s.bucketOffset / 8); offset < len(reqVector) {
+			reqVector = reqVector[offset:]
+		} else {
+			reqVector = nil
+		}
 		copy(pirvector[reqlength*i:reqlength*(i+1)], reqVector)
+		tags[i] = readTag(e.tags, reqVector)
 	}
-	err := s.Server.Read(pirvector, s.readReplies)
+	err := s.Server.ReadSnapshot(e.Snapshot, pirvector, s.readReplies)
 	if err != nil {
 		s.log.Error.Fatalf("Reading from PIR Server failed: %v", err)
 		req.ReplyChan <- &common.BatchReadReply{Err: fmt.Sprintf("Failed to read: %v", err)}
 		return
 	}
-	s.outstandingReads <- req.ReplyChan
+	s.outstandingReads <- &outstandingRead{req.ReplyChan, e.id, e.seqNos, e.root, tags}
 
 	s.log.Trace.Printf("batchRead: exit\n")
 }
+
+// readTag combines the hashes of the buckets selected by a request vector in
+// the same way as their contents, so that a read of a single bucket carries
+// its hash. Clients use the tag to check that the read was answered correctly.
+func readTag(tags [][merkle.Size]byte, reqVector []byte) (tag [merkle.Size]byte) {
+	for b := range tags {
+		if b/8 < len(reqVector) && reqVector[b/8]&(1<<uint(b%8)) != 0 {
+			for i := range tag {
+				tag[i] ^= tags[b][i]
+			}
+		}
+	}
+	return
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
@@ -30,7 +31,6 @@ func testConf() Config {
 			DataSize:           uint64(fromEnvOrDefault("DATA_SIZE", 512)),
 			BloomFalsePositive: 0.95,
 			MaxLoadFactor:      0.95,
-			LoadFactorStep:     0.02,
 		},
 		ReadBatch:        fromEnvOrDefault("BATCH_SIZE", 8),
 		WriteInterval:    time.Second,
@@ -64,7 +64,7 @@ func TestShardSanity(t *testing.T) {
 	})
 
 	// Force DB write.
-	shard.syncChan <- 1
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
 
 	replychan := make(chan *common.BatchReadReply)
 
@@ -86,6 +86,236 @@ func TestShardSanity(t *testing.T) {
 	shard.Close()
 }
 
+func TestShardPartitioned(t *testing.T) {
+	conf := testConf()
+	single := NewShard("TestShardPartitioned-single", "cpu.0", conf)
+	defer single.Close()
+	partitioned := NewShard("TestShardPartitioned", "cpu.0,cpu.1,cpu.2", conf)
+	defer partitioned.Close()
+
+	// Several epochs, so that later ones reuse the memory of released ones.
+	for seqNo := uint64(1); seqNo <= 200; seqNo++ {
+		data := make([]byte, conf.DataSize)
+		copy(data, []byte(fmt.Sprintf("Write %d", seqNo)))
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     (seqNo * 13) % conf.NumBuckets,
+			Bucket2:     (seqNo * 101) % conf.NumBuckets,
+			Data:        data,
+		}}
+		single.Write(args)
+		partitioned.Write(args)
+		if seqNo%40 != 0 {
+			continue
+		}
+		single.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+		partitioned.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+
+		reqs := make([]common.PirArgs, conf.ReadBatch)
+		for i := range reqs {
+			reqs[i].RequestVector = make([]byte, conf.NumBuckets/8)
+			if i == 0 {
+				// A single bucket, to compare with the database.
+				reqs[i].RequestVector[seqNo/8%uint64(len(reqs[i].RequestVector))] = 1
+			} else {
+				rand.Read(reqs[i].RequestVector)
+			}
+		}
+		replies := make([]*common.BatchReadReply, 0, 2)
+		for _, s := range []*Shard{single, partitioned} {
+			replyChan := make(chan *common.BatchReadReply)
+			s.BatchRead(&DecodedBatchReadRequest{Args: reqs, ReplyChan: replyChan})
+			replies = append(replies, <-replyChan)
+		}
+		for i := range reqs {
+			if !bytes.Equal(replies[0].Replies[i].Data, replies[1].Replies[i].Data) {
+				t.Fatalf("Partitioned shard disagrees on read %d at write %d", i, seqNo)
+			}
+		}
+		bucketLength := conf.DataSize * conf.BucketDepth
+		bucket := seqNo / 8 % uint64(len(reqs[0].RequestVector)) * 8
+		if !bytes.Equal(replies[0].Replies[0].Data[:bucketLength], single.DB.DB[bucket*bucketLength:(bucket+1)*bucketLength]) {
+			t.Fatalf("Epoch at write %d differs from the database", seqNo)
+		}
+	}
+}
+
+func TestShardWindow(t *testing.T) {
+	conf := testConf()
+	conf.NumBuckets = 64
+	// Low enough that the table can always place every item in the window.
+	conf.MaxLoadFactor = 0.5
+	shard := NewShard("TestShardWindow", "cpu.0", conf)
+	defer shard.Close()
+	windowSize := conf.WindowSize()
+
+	for seqNo := uint64(1); seqNo <= 3*windowSize; seqNo++ {
+		shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     uint64(rand.Int()) % conf.NumBuckets,
+			Bucket2:     uint64(rand.Int()) % conf.NumBuckets,
+			Data:        make([]byte, conf.DataSize),
+		}})
+		// Epoch writes wait for preceding writes to be applied.
+		shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+
+		expected := seqNo
+		if expected > windowSize {
+			expected = windowSize
+		}
+		if uint64(shard.entries.len()) != expected || shard.GetNumElements() != expected {
+			t.Fatalf("After write %d, window holds %d items and table %d, not %d", seqNo, shard.entries.len(), shard.GetNumElements(), expected)
+		}
+		if shard.entries.oldest().ID != seqNo-expected+1 {
+			t.Fatalf("After write %d, oldest item is %d", seqNo, shard.entries.oldest().ID)
+		}
+	}
+
+	// A gap in seqnos, as after writes aborted elsewhere, evicts by seqno.
+	next := 3*windowSize + windowSize/2
+	shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+		GlobalSeqNo: next,
+		Bucket1:     0,
+		Bucket2:     1,
+		Data:        make([]byte, conf.DataSize),
+	}})
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	if shard.entries.oldest().ID != next-windowSize+1 {
+		t.Fatalf("Items older than the window of %d from %d should be evicted, oldest is %d", windowSize, next, shard.entries.oldest().ID)
+	}
+
+	// An item which cannot be placed is rejected, but keeps its place in the
+	// window.
+	for seqNo, bucket := range []uint64{conf.NumBuckets, 0} {
+		shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: next + 1 + uint64(seqNo),
+			Bucket1:     bucket,
+			Bucket2:     1,
+			Data:        make([]byte, conf.DataSize),
+		}})
+	}
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	held := shard.entries.len()
+	if shard.entries.at(held-2).ID != next+1 || shard.entries.at(held-1).ID != next+2 || shard.GetNumElements() != uint64(held-1) {
+		t.Fatalf("Item %d should hold its place in the window without being placed", next+1)
+	}
+}
+
+func TestShardRetention(t *testing.T) {
+	conf := testConf()
+	conf.NumBuckets = 64
+	conf.MaxLoadFactor = 0.25
+	// Young items outlive the window by up to half a window, as the
+	// coordinator keeps their commits.
+	conf.MinRetention = time.Minute
+	conf.MaxRetainedItems = conf.WindowSize() + conf.WindowSize()/2
+	window, limit := conf.WindowSize(), conf.MaxRetainedItems
+	shard := NewShard("TestShardRetention", "cpu.0", conf)
+	defer shard.Close()
+
+	start := time.Now()
+	write := func(seqNo uint64, at time.Duration) {
+		shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Time:        start.Add(at).UnixNano(),
+			Bucket1:     uint64(rand.Int()) % conf.NumBuckets,
+			Bucket2:     uint64(rand.Int()) % conf.NumBuckets,
+			Data:        make([]byte, conf.DataSize),
+		}})
+		shard.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+	}
+
+	for seqNo := uint64(1); seqNo <= window+1; seqNo++ {
+		write(seqNo, time.Duration(seqNo)*time.Millisecond)
+	}
+	if uint64(shard.entries.len()) != window+1 || shard.entries.oldest().ID != 1 {
+		t.Fatalf("Expected young items to outlive the window, window holds %d from %d", shard.entries.len(), shard.entries.oldest().ID)
+	}
+	for seqNo := window + 2; seqNo <= limit+1; seqNo++ {
+		write(seqNo, time.Duration(seqNo)*time.Millisecond)
+	}
+	if uint64(shard.entries.len()) != limit || shard.entries.oldest().ID != 2 {
+		t.Fatalf("Expected %d recent items from 2, window holds %d from %d", limit, shard.entries.len(), shard.entries.oldest().ID)
+	}
+	// Once MinRetention old, items beyond the window are evicted.
+	next := limit + 2
+	write(next, 2*time.Minute)
+	if uint64(shard.entries.len()) != window || shard.entries.oldest().ID != next+1-window {
+		t.Fatalf("Expected %d items from %d, window holds %d from %d", window, next+1-window, shard.entries.len(), shard.entries.oldest().ID)
+	}
+	// A gap in seqnos evicts by seqno, but for the young item within
+	// MaxRetainedItems.
+	write(next+limit-1, 2*time.Minute)
+	if shard.entries.len() != 2 || shard.entries.oldest().ID != next {
+		t.Fatalf("Items should be evicted by seqno, window holds %d from %d", shard.entries.len(), shard.entries.oldest().ID)
+	}
+}
+
+func TestShardPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := testConf()
+	conf.NumBuckets = 64
+	conf.PersistPath = dir
+	conf.SnapshotInterval = 5
+	write := func(shards []*Shard, seqNo uint64) {
+		data := make([]byte, conf.DataSize)
+		copy(data, []byte(fmt.Sprintf("Write %d", seqNo)))
+		args := &common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     uint64(rand.Int()) % conf.NumBuckets,
+			Bucket2:     uint64(rand.Int()) % conf.NumBuckets,
+			Data:        data,
+		}}
+		for _, s := range shards {
+			s.Write(args)
+			// Epoch writes wait for preceding writes to be applied.
+			s.Write(&common.ReplicaWriteArgs{EpochFlag: true})
+		}
+	}
+	state := func(s *Shard) []byte {
+		data, err := s.marshalState()
+		if err != nil {
+			t.Fatalf("Failed to marshal shard state: %v", err)
+		}
+		return data
+	}
+
+	original := NewShard("persist", "cpu.0", conf)
+	for i := uint64(1); i <= 12; i++ {
+		write([]*Shard{original}, i)
+	}
+
+	// Restore without closing the original, as after a crash. The state must
+	// combine the last snapshot with the logged writes since.
+	restored := NewShard("persist", "cpu.0", conf)
+	if restored.seqNo != 12 || !bytes.Equal(state(original), state(restored)) {
+		t.Fatalf("Restored shard differs from the original after a crash.")
+	}
+
+	// Subsequent writes should be placed identically.
+	for i := uint64(13); i <= 20; i++ {
+		write([]*Shard{original, restored}, i)
+	}
+	if !bytes.Equal(state(original), state(restored)) {
+		t.Fatalf("Restored shard diverged from the original.")
+	}
+	expected := state(restored)
+	original.Close()
+	restored.Close()
+
+	// A graceful shutdown snapshots the final state.
+	restarted := NewShard("persist", "cpu.0", conf)
+	if restarted.seqNo != 20 || !bytes.Equal(expected, state(restarted)) {
+		t.Fatalf("Restarted shard differs from the one shut down.")
+	}
+	restarted.Close()
+}
+
 func BenchmarkShard(b *testing.B) {
 	fmt.Printf("Benchmark began with N=%d\n", b.N)
 	readsPerWrite := fromEnvOrDefault("READS_PER_WRITE", 20)
@@ -121,7 +351,7 @@ func BenchmarkShard(b *testing.B) {
 	for i := 0; i < conf.ReadBatch; i++ {
 		reqs[i] = req
 	}
-	stdRead := &DecodedBatchReadRequest{reqs, replychan}
+	stdRead := &DecodedBatchReadRequest{reqs, replychan, 0}
 
 	b.ResetTimer()
 
@@ -144,3 +374,128 @@ func BenchmarkShard(b *testing.B) {
 	fmt.Printf("Benchmark called close w N=%d\n", b.N)
 	shard.Close()
 }
+
+func TestShardEpochs(t *testing.T) {
+	conf := testConf()
+	conf.ReadBatch = 1
+	shard := NewShard("TestShardEpochs", "cpu.0", conf)
+	defer shard.Close()
+
+	write := func(seqNo uint64, magic string) {
+		data := make([]byte, conf.DataSize)
+		copy(data, magic)
+		shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: seqNo,
+			Bucket1:     0,
+			Bucket2:     0,
+			Data:        data,
+		}})
+	}
+	flip := func(id uint64, phase common.EpochPhase) error {
+		return shard.Write(&common.ReplicaWriteArgs{EpochFlag: true, EpochID: id, Phase: phase})
+	}
+	// read returns the first item of bucket 0 at an epoch.
+	read := func(id uint64) (string, string) {
+		rv := make([]byte, conf.NumBuckets/8)
+		rv[0] = 0x01
+		replyChan := make(chan *common.BatchReadReply)
+		shard.BatchRead(&DecodedBatchReadRequest{Args: []common.PirArgs{{RequestVector: rv}}, ReplyChan: replyChan, Epoch: id})
+		reply := <-replyChan
+		if reply.Err != "" {
+			return "", reply.Err
+		}
+		return string(bytes.TrimRight(reply.Replies[0].Data[:conf.DataSize], "\x00")), ""
+	}
+
+	write(1, "one")
+	flip(1, common.EpochPrepare)
+	write(2, "two")
+	if data, _ := read(0); data != "" {
+		t.Fatalf("Prepared writes should not be read before commit, read %q", data)
+	}
+	if _, err := read(1); err == "" {
+		t.Fatalf("Prepared epoch should not be readable before commit")
+	}
+
+	flip(1, common.EpochCommit)
+	if data, _ := read(1); data != "one" {
+		t.Fatalf("Committed epoch should hold prepared writes, read %q", data)
+	}
+	if data, err := read(0); err != "" || data != "" {
+		t.Fatalf("Previous epoch should remain readable: %q %v", data, err)
+	}
+
+	flip(2, common.EpochPrepare)
+	flip(2, common.EpochCommit)
+	if _, err := read(0); err == "" {
+		t.Fatalf("Epoch before previous should be released")
+	}
+	if data, _ := read(1); data != "one" {
+		t.Fatalf("Previous epoch changed, read %q", data)
+	}
+
+	// Commits may be retried, but an epoch must be prepared to be committed.
+	if err := flip(3, common.EpochCommit); err == nil {
+		t.Fatalf("Commit of an unprepared epoch should fail")
+	}
+	flip(3, common.EpochPrepare)
+	if err := flip(3, common.EpochCommit); err != nil {
+		t.Fatal(err)
+	}
+	if err := flip(3, common.EpochCommit); err != nil {
+		t.Fatalf("Retried commit should succeed: %v", err)
+	}
+
+	// Aborting a committed epoch returns to the previous one.
+	flip(3, common.EpochAbort)
+	if _, err := read(3); err == "" {
+		t.Fatalf("Aborted epoch should not be readable")
+	}
+	if data, err := read(2); err != "" || data != "one" {
+		t.Fatalf("Previous epoch should be current again: %q %v", data, err)
+	}
+}
+
+func TestShardReadRange(t *testing.T) {
+	conf := testConf()
+	conf.ReadBatch = 1
+	shard := NewShard("TestShardReadRange", "cpu.0", conf)
+	defer shard.Close()
+
+	read := func(id uint64) *common.ReadReply {
+		replyChan := make(chan *common.BatchReadReply)
+		args := []common.PirArgs{{RequestVector: make([]byte, conf.NumBuckets/8)}}
+		shard.BatchRead(&DecodedBatchReadRequest{Args: args, ReplyChan: replyChan, Epoch: id})
+		reply := <-replyChan
+		if reply.Err != "" {
+			t.Fatalf("Read of epoch %d failed: %s", id, reply.Err)
+		}
+		return &reply.Replies[0]
+	}
+
+	if reply := read(0); reply.Epoch != 0 || reply.GlobalSeqNo.Start != 1 || reply.GlobalSeqNo.End != 1 {
+		t.Fatalf("Empty database should have an empty range, got %v at epoch %d", reply.GlobalSeqNo, reply.Epoch)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		shard.Write(&common.ReplicaWriteArgs{WriteArgs: common.WriteArgs{
+			GlobalSeqNo: i,
+			Bucket1:     i,
+			Bucket2:     i + 1,
+			Data:        make([]byte, conf.DataSize),
+		}})
+	}
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true, EpochID: 5, Phase: common.EpochPrepare})
+	shard.Write(&common.ReplicaWriteArgs{EpochFlag: true, EpochID: 5, Phase: common.EpochCommit})
+
+	reply := read(5)
+	if reply.Epoch != 5 {
+		t.Fatalf("Reply should name the epoch read, got %d", reply.Epoch)
+	}
+	if !reply.GlobalSeqNo.Equals(common.Range{Start: 1, End: 4}) {
+		t.Fatalf("Reply should cover the committed writes, got %v", reply.GlobalSeqNo)
+	}
+	if reply := read(0); reply.GlobalSeqNo.End != 1 {
+		t.Fatalf("Previous epoch should report its own range, got %v", reply.GlobalSeqNo)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/cuckoo"
+	"github.com/privacylab/talek/server/persist"
+)
+
+// A shard persists its state as a snapshot of its cuckoo table and window of
+// entries, plus a log of the writes applied since that snapshot. Each logged
+// write carries the count of writes applied before it, so writes already
+// covered by the snapshot are skipped if a crash interrupts log truncation.
+
+func (s *Shard) snapshotPath(conf Config) string {
+	return filepath.Join(conf.PersistPath, s.name+".snapshot")
+}
+
+func (s *Shard) logPath(conf Config) string {
+	return filepath.Join(conf.PersistPath, s.name+".wal")
+}
+
+// restore recovers the persisted state of the shard, and opens its log for
+// subsequent writes. It must be called before the shard's threads start.
+func (s *Shard) restore(conf Config) error {
+	if err := os.MkdirAll(conf.PersistPath, 0700); err != nil {
+		return err
+	}
+
+	state, err := persist.ReadSnapshot(s.snapshotPath(conf))
+	if err == nil {
+		if err = s.unmarshalState(state); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	replayed := 0
+	_, err = persist.ReadLog(s.logPath(conf), func(record []byte) error {
+		index, args, err := decodeLogRecord(record)
+		if err != nil {
+			return err
+		}
+		if index < s.applied {
+			return nil
+		} else if index > s.applied {
+			return fmt.Errorf("log skips from write %d to %d", s.applied, index)
+		}
+		s.insert(args, conf)
+		replayed++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.wal, err = persist.OpenLog(s.logPath(conf))
+	if err != nil {
+		return err
+	}
+	s.sinceSnapshot = replayed
+	s.log.Info.Printf("Restored %d writes (through seqno %d), %d from log.", s.applied, s.seqNo, replayed)
+	return nil
+}
+
+// snapshot durably records the current state, and truncates the log.
+func (s *Shard) snapshot() {
+	conf := s.config.Load().(Config)
+	state, err := s.marshalState()
+	if err == nil {
+		err = persist.WriteSnapshot(s.snapshotPath(conf), state)
+	}
+	if err == nil {
+		err = s.wal.Reset()
+	}
+	if err != nil {
+		s.log.Error.Printf("Failed to snapshot shard: %v", err)
+		return
+	}
+	s.sinceSnapshot = 0
+}
+
+func (s *Shard) closePersistence() {
+	if s.wal == nil {
+		return
+	}
+	s.snapshot()
+	s.wal.Close()
+	s.wal = nil
+}
+
+func (s *Shard) marshalState() ([]byte, error) {
+	var buf bytes.Buffer
+	header := []uint64{s.applied, s.seqNo, uint64(s.entries.len())}
+	if err := binary.Write(&buf, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	for i := 0; i < s.entries.len(); i++ {
+		e := s.entries.at(i)
+		if err := binary.Write(&buf, binary.LittleEndian, []uint64{e.ID, e.Bucket1, e.Bucket2, uint64(s.entries.timeAt(i))}); err != nil {
+			return nil, err
+		}
+	}
+	table, err := s.Table.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(table)
+	return buf.Bytes(), nil
+}
+
+func (s *Shard) unmarshalState(data []byte) error {
+	reader := bytes.NewReader(data)
+	var header [3]uint64
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header[2] > uint64(s.entries.capacity()) {
+		return errors.New("snapshot has more entries than the window holds")
+	}
+	entries := make([]cuckoo.Item, header[2])
+	times := make([]int64, header[2])
+	for i := range entries {
+		var e [4]uint64
+		if err := binary.Read(reader, binary.LittleEndian, &e); err != nil {
+			return err
+		}
+		entries[i] = cuckoo.Item{ID: e[0], Bucket1: e[1], Bucket2: e[2]}
+		times[i] = int64(e[3])
+	}
+	table := make([]byte, reader.Len())
+	reader.Read(table)
+	if err := s.Table.UnmarshalBinary(table); err != nil {
+		return err
+	}
+	s.applied = header[0]
+	s.seqNo = header[1]
+	s.entries.reset()
+	for i, e := range entries {
+		s.entries.push(e, times[i])
+	}
+	return nil
+}
+
+func encodeLogRecord(index uint64, args *common.WriteArgs) []byte {
+	record := make([]byte, 40+len(args.Data))
+	binary.LittleEndian.PutUint64(record[0:], index)
+	binary.LittleEndian.PutUint64(record[8:], args.GlobalSeqNo)
+	binary.LittleEndian.PutUint64(record[16:], args.Bucket1)
+	binary.LittleEndian.PutUint64(record[24:], args.Bucket2)
+	binary.LittleEndian.PutUint64(record[32:], uint64(args.Time))
+	copy(record[40:], args.Data)
+	return record
+}
+
+func decodeLogRecord(record []byte) (uint64, *common.WriteArgs, error) {
+	if len(record) < 40 {
+		return 0, nil, errors.New("malformed log record")
+	}
+	args := &common.WriteArgs{}
+	index := binary.LittleEndian.Uint64(record[0:])
+	args.GlobalSeqNo = binary.LittleEndian.Uint64(record[8:])
+	args.Bucket1 = binary.LittleEndian.Uint64(record[16:])
+	args.Bucket2 = binary.LittleEndian.Uint64(record[24:])
+	args.Time = int64(binary.LittleEndian.Uint64(record[32:]))
+	args.Data = record[40:]
+	return index, args, nil
+}
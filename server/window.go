@@ -0,0 +1,68 @@
+package server
+
+import (
+	"github.com/privacylab/talek/cuckoo"
+)
+
+// window is a fixed-capacity ring of the items in the database, oldest
+// first. Items are pushed in order of GlobalSeqNo, so they leave the window
+// in the order they entered it, as their retention expires.
+type window struct {
+	items []cuckoo.Item
+	times []int64 // When each item was written
+	start int
+	count int
+}
+
+func newWindow(capacity uint64) window {
+	if capacity == 0 {
+		capacity = 1
+	}
+	return window{items: make([]cuckoo.Item, capacity), times: make([]int64, capacity)}
+}
+
+func (w *window) len() int {
+	return w.count
+}
+
+func (w *window) capacity() int {
+	return len(w.items)
+}
+
+// at returns the i'th oldest item.
+func (w *window) at(i int) *cuckoo.Item {
+	return &w.items[(w.start+i)%len(w.items)]
+}
+
+func (w *window) oldest() *cuckoo.Item {
+	return w.at(0)
+}
+
+// timeAt returns when the i'th oldest item was written.
+func (w *window) timeAt(i int) int64 {
+	return w.times[(w.start+i)%len(w.items)]
+}
+
+// push adds the newest item, written at time. The window must not be full.
+func (w *window) push(item cuckoo.Item, time int64) {
+	w.items[(w.start+w.count)%len(w.items)] = item
+	w.times[(w.start+w.count)%len(w.items)] = time
+	w.count++
+}
+
+// pop removes the oldest item.
+func (w *window) pop() cuckoo.Item {
+	item := w.items[w.start]
+	w.items[w.start] = cuckoo.Item{}
+	w.start = (w.start + 1) % len(w.items)
+	w.count--
+	return item
+}
+
+// reset empties the window.
+func (w *window) reset() {
+	for w.count > 0 {
+		w.pop()
+	}
+	w.start = 0
+}
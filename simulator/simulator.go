@@ -0,0 +1,141 @@
+// Package simulator runs a Talek deployment of many clients, a frontend and
+// replicas under virtual time.
+//
+// Time only advances when the Simulator is run, and it advances one timer
+// at a time: each timer is fired only once every client and server loop is
+// again waiting on the clock. Together with randomness drawn from a single
+// seed, this makes runs reproducible, so tests can assert exactly when
+// messages are delivered and when they expire.
+package simulator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+	"github.com/privacylab/talek/libtalek/loopback"
+)
+
+// Config describes a simulated deployment.
+type Config struct {
+	loopback.Config
+
+	// Seed for all randomness controlled by the simulator
+	Seed int64
+}
+
+// DefaultConfig provides a small deployment with two trust domains, where
+// clients read and write every 10 virtual milliseconds.
+func DefaultConfig() Config {
+	config := loopback.DefaultConfig()
+	config.MaxLoadFactor = 0.5
+	config.WriteInterval = time.Millisecond * 10
+	config.ReadInterval = time.Millisecond * 10
+	config.ServerInterval = time.Millisecond * 10
+	config.ClientInterval = time.Millisecond * 10
+	return Config{Config: config, Seed: 1}
+}
+
+// Simulator is a deployment running under a VirtualClock.
+// Simulators are not threadsafe, and should be driven from a single goroutine.
+type Simulator struct {
+	Clock *common.VirtualClock
+
+	loopback *loopback.Loopback
+	clients  []*libtalek.Client
+	rand     *rand.Rand
+	start    time.Time
+}
+
+// New starts a simulated deployment with no clients.
+func New(config Config) *Simulator {
+	s := &Simulator{}
+	s.start = time.Unix(0, 0)
+	s.Clock = common.NewVirtualClock(s.start)
+	s.rand = rand.New(rand.NewSource(config.Seed))
+
+	config.Clock = s.Clock
+	s.loopback = loopback.New("sim", config.Config)
+	if s.loopback == nil {
+		return nil
+	}
+	s.Clock.BlockUntilIdle()
+	return s
+}
+
+/** PUBLIC METHODS **/
+
+// NewClient adds a client to the simulation. The client's randomness is
+// derived from the simulator seed.
+func (s *Simulator) NewClient(name string) *libtalek.Client {
+	c := libtalek.NewClient(name, s.loopback.ClientConfig(), s.loopback)
+	if c == nil {
+		return nil
+	}
+	// Client loops wait on the clock before acting, so this is set before use.
+	c.Rand = &lockedRand{r: rand.New(rand.NewSource(s.rand.Int63()))}
+	s.clients = append(s.clients, c)
+	s.Clock.BlockUntilIdle()
+	return c
+}
+
+// NewTopic creates a topic using randomness derived from the simulator seed.
+func (s *Simulator) NewTopic() (*libtalek.Topic, error) {
+	return libtalek.NewTopicFrom(s.rand)
+}
+
+// Elapsed returns the virtual time since the simulation began.
+func (s *Simulator) Elapsed() time.Duration {
+	return s.Clock.Now().Sub(s.start)
+}
+
+// Run advances the simulation by d.
+func (s *Simulator) Run(d time.Duration) {
+	s.RunUntil(func() bool { return false }, d)
+}
+
+// RunUntil advances the simulation until done returns true, or by at most
+// limit. done is checked whenever the system is idle. It returns whether
+// done was satisfied.
+func (s *Simulator) RunUntil(done func() bool, limit time.Duration) bool {
+	end := s.Clock.Now().Add(limit)
+	for {
+		s.Clock.BlockUntilIdle()
+		if done() {
+			return true
+		}
+		next, ok := s.Clock.Next()
+		if !ok || next.After(end) {
+			break
+		}
+		s.Clock.Step()
+	}
+	s.Clock.Advance(end.Sub(s.Clock.Now()))
+	return false
+}
+
+// Close stops all clients and servers of the simulation.
+func (s *Simulator) Close() {
+	// Let time run freely, so pending writes drain and loops observe shutdown.
+	s.Clock.Stop()
+	for _, c := range s.clients {
+		c.Kill()
+	}
+	s.loopback.Close()
+}
+
+/** Private methods **/
+
+// lockedRand allows a seeded source to be shared by a client's loops.
+type lockedRand struct {
+	lock sync.Mutex
+	r    *rand.Rand
+}
+
+func (l *lockedRand) Read(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.r.Read(p)
+}
@@ -0,0 +1,100 @@
+package simulator
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/privacylab/talek/common"
+	"github.com/privacylab/talek/libtalek"
+)
+
+func init() {
+	common.SilenceLoggers()
+}
+
+// deliver publishes a message and returns the virtual time taken for a
+// reader to receive it.
+func deliver(t *testing.T, seed int64) time.Duration {
+	config := DefaultConfig()
+	config.Seed = seed
+	s := New(config)
+	if s == nil {
+		t.Fatalf("Error creating simulator")
+	}
+	defer s.Close()
+
+	writer := s.NewClient("writer")
+	reader := s.NewClient("reader")
+	topic, err := s.NewTopic()
+	if err != nil {
+		t.Fatalf("Error creating topic: %v", err)
+	}
+	handle := topic.Handle
+	sub, err := reader.Subscribe(&handle, libtalek.DefaultSubscriptionConfig)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+
+	start := s.Elapsed()
+	if err := writer.Publish(topic, []byte("hello world")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if !s.RunUntil(func() bool { return len(sub.Messages()) > 0 }, time.Second) {
+		t.Fatalf("Message was not delivered within a virtual second")
+	}
+	if msg := <-sub.Messages(); !bytes.Equal(msg, []byte("hello world")) {
+		t.Fatalf("Read unexpected message: %v", msg)
+	}
+	return s.Elapsed() - start
+}
+
+func TestDeliveryLatency(t *testing.T) {
+	latency := deliver(t, 42)
+	config := DefaultConfig()
+	// Written at the next write interval, visible after the following epoch,
+	// and then found by one of the reader's next two reads.
+	if latency < config.ClientInterval || latency > 5*config.ClientInterval {
+		t.Fatalf("Unexpected delivery latency %v", latency)
+	}
+	if again := deliver(t, 42); again != latency {
+		t.Fatalf("Delivery was not reproducible: %v then %v", latency, again)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	config := DefaultConfig()
+	s := New(config)
+	if s == nil {
+		t.Fatalf("Error creating simulator")
+	}
+	defer s.Close()
+
+	writer := s.NewClient("writer")
+	for i := 0; i < 3; i++ {
+		s.NewClient("cover")
+	}
+	topic, _ := s.NewTopic()
+	handle := topic.Handle
+	if err := writer.Publish(topic, []byte("hello world")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	// Four clients each write once an interval. Run until the database has
+	// seen twice its window of writes, so the message must have been evicted.
+	window := config.WindowSize()
+	s.Run(config.ClientInterval * time.Duration(2*window/4))
+
+	reader := s.NewClient("reader")
+	sub, err := reader.Subscribe(&handle, libtalek.DefaultSubscriptionConfig)
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	if s.RunUntil(func() bool { return len(sub.Messages()) > 0 }, config.ClientInterval*20) {
+		t.Fatalf("Message outside of the window was still delivered")
+	}
+	// Reads of the evicted message miss it, rather than failing to decrypt.
+	if stats := reader.Stats(); stats.RealReads == 0 || stats.DecryptFailures != 0 {
+		t.Fatalf("Reader should have missed each read of the evicted message: %+v", stats)
+	}
+}